@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+)
+
+// adaptive_interval_pressure is the fraction of the interval a cycle can
+// take before the interval is stretched.
+const adaptive_interval_pressure = 0.8
+
+// AdaptiveInterval stretches the query interval while Prometheus is under
+// pressure (slow cycles or 503s), doubling it up to max, and halves it back
+// towards the configured interval once cycles are healthy again.
+type AdaptiveInterval struct {
+	sync.Mutex
+	base    time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// NewAdaptiveInterval returns a fixed interval if max isn't larger than base.
+func NewAdaptiveInterval(base, max time.Duration) *AdaptiveInterval {
+	if max < base {
+		max = base
+	}
+	effectiveInterval.Set(base.Seconds())
+	return &AdaptiveInterval{base: base, max: max, current: base}
+}
+
+func (adaptive *AdaptiveInterval) Current() time.Duration {
+	adaptive.Lock()
+	defer adaptive.Unlock()
+	return adaptive.current
+}
+
+// Observe records how long a cycle took and whether Prometheus pushed back
+// during it, returning the new interval and whether it changed.
+func (adaptive *AdaptiveInterval) Observe(took time.Duration, pushed_back bool) (time.Duration, bool) {
+	adaptive.Lock()
+	defer adaptive.Unlock()
+	next := adaptive.current
+	if pushed_back || took > time.Duration(adaptive_interval_pressure*float64(adaptive.current)) {
+		next = adaptive.current * 2
+		if next > adaptive.max {
+			next = adaptive.max
+		}
+	} else {
+		next = adaptive.current / 2
+		if next < adaptive.base {
+			next = adaptive.base
+		}
+	}
+	changed := next != adaptive.current
+	adaptive.current = next
+	effectiveInterval.Set(next.Seconds())
+	return next, changed
+}
+
+// prometheus_pushed_back is true for errors showing Prometheus is
+// overloaded rather than the query being wrong.
+func prometheus_pushed_back(err error) bool {
+	api_err, ok := err.(*prometheus.Error)
+	if !ok {
+		return false
+	}
+	return api_err.Type == prometheus.ErrTimeout || strings.HasSuffix(api_err.Msg, "bad response code 503")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/micktwomey/prometheus_to_datadog/adminpb"
+	"github.com/prometheus/client_golang/api/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Admin is the gRPC service (adminpb/admin.proto) for managing a running
+// bridge, served over TLS. Every call authenticates, e.g. from Go:
+//
+//	conn, _ := grpc.Dial("127.0.0.1:9133", grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(cas, "")))
+//	client := adminpb.NewAdminClient(conn)
+//	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+//	queries, _ := client.ListQueries(ctx, &adminpb.ListQueriesRequest{})
+type Admin struct {
+	adminpb.UnimplementedAdminServer
+	query_set *QuerySet
+	query_api prometheus.QueryAPI
+	sink      Sink
+	scheduler *Scheduler
+}
+
+func (admin *Admin) ListQueries(ctx context.Context, request *adminpb.ListQueriesRequest) (*adminpb.ListQueriesResponse, error) {
+	now := time.Now()
+	response := &adminpb.ListQueriesResponse{}
+	for _, query := range admin.query_set.Queries() {
+		response.Queries = append(response.Queries, &adminpb.Query{
+			Name:  query.Name,
+			Type:  query.Type.String(),
+			Query: query.Query,
+			Muted: admin.query_set.Muted(query.Name, now),
+		})
+	}
+	return response, nil
+}
+
+// Reload re-reads the query file and swaps in the new queries.
+func (admin *Admin) Reload(ctx context.Context, request *adminpb.ReloadRequest) (*adminpb.ReloadResponse, error) {
+	loaded, err := reload_queries(admin.query_set)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &adminpb.ReloadResponse{Queries: int32(len(loaded))}, nil
+}
+
+// RunQueryOnce runs a query immediately, pushing its results.
+func (admin *Admin) RunQueryOnce(ctx context.Context, request *adminpb.RunQueryOnceRequest) (*adminpb.RunQueryOnceResponse, error) {
+	query, ok := admin.query_set.Find(request.Name)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "No query named %v", request.Name)
+	}
+	err := run_query_once(query, admin.query_api, time.Now(), admin.sink)
+	if flush_err := admin.sink.Flush(); err == nil {
+		err = flush_err
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &adminpb.RunQueryOnceResponse{}, nil
+}
+
+func (admin *Admin) Mute(ctx context.Context, request *adminpb.MuteRequest) (*adminpb.MuteResponse, error) {
+	if _, ok := admin.query_set.Find(request.Name); !ok {
+		return nil, status.Errorf(codes.NotFound, "No query named %v", request.Name)
+	}
+	var until time.Time
+	if duration := request.Duration.AsDuration(); duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	admin.query_set.Mute(request.Name, until)
+	return &adminpb.MuteResponse{}, nil
+}
+
+// Pause skips every cycle until Resume, e.g. to mute every query during
+// Prometheus maintenance. RunQueryOnce still runs queries.
+func (admin *Admin) Pause(ctx context.Context, request *adminpb.PauseRequest) (*adminpb.PauseResponse, error) {
+	admin.scheduler.Pause()
+	return &adminpb.PauseResponse{}, nil
+}
+
+func (admin *Admin) Resume(ctx context.Context, request *adminpb.ResumeRequest) (*adminpb.ResumeResponse, error) {
+	admin.scheduler.Resume()
+	return &adminpb.ResumeResponse{}, nil
+}
+
+// Stats returns the stats of the scheduler's most recent tick.
+func (admin *Admin) Stats(ctx context.Context, request *adminpb.StatsRequest) (*adminpb.StatsResponse, error) {
+	stats := admin.scheduler.Stats()
+	response := &adminpb.StatsResponse{
+		Lag:      durationpb.New(stats.Lag),
+		Took:     durationpb.New(stats.Took),
+		Samples:  int64(stats.Samples),
+		Interval: durationpb.New(stats.Interval),
+		Paused:   stats.Paused,
+	}
+	if !stats.Time.IsZero() {
+		response.Time = timestamppb.New(stats.Time)
+	}
+	return response, nil
+}
+
+// admin_call_allowed checks a call's authorization metadata (a bearer token
+// or basic auth) and its connection's client certificate, like the checks of
+// the admin HTTP endpoints.
+func admin_call_allowed(ctx context.Context, auth HTTPAuth) bool {
+	if auth.open() {
+		return true
+	}
+	var state *tls.ConnectionState
+	if caller, ok := peer.FromContext(ctx); ok {
+		if info, ok := caller.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	if auth.client_cert_allowed(state) {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, header := range md.Get("authorization") {
+		if auth.credentials_allowed(parse_authorization(header)) {
+			return true
+		}
+	}
+	return false
+}
+
+// admin_auth returns an interceptor failing the calls which don't pass the
+// auth checks, counting them by method.
+func admin_auth(auth HTTPAuth) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !admin_call_allowed(ctx, auth) {
+			rejectedAdminCalls.WithLabelValues(info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]).Inc()
+			return nil, status.Error(codes.Unauthenticated, "Unauthenticated, pass -http-auth-token or -http-basic-auth as authorization metadata or a client certificate")
+		}
+		return handler(ctx, request)
+	}
+}
+
+// new_admin_server returns the gRPC server of the admin API, over TLS and
+// behind the same checks as the admin HTTP endpoints. With
+// -http-tls-client-ca-file clients must present a verified certificate,
+// which then authenticates them. It refuses to serve without TLS, or without
+// any authentication unless -admin-insecure, as the API can push samples
+// and stop the cycles.
+func new_admin_server(admin *Admin, tls_config *tls.Config, auth HTTPAuth) (*grpc.Server, error) {
+	if tls_config == nil {
+		return nil, fmt.Errorf("-admin-address needs -http-tls-cert-file and -http-tls-key-file, the admin API is only served over TLS")
+	}
+	if !auth.enabled() && !auth.Insecure {
+		return nil, fmt.Errorf("-admin-address needs -http-auth-token, -http-basic-auth or -http-tls-client-ca-file, or -admin-insecure")
+	}
+	server_tls := tls_config
+	if tls_config.ClientCAs != nil {
+		server_tls = tls_config.Clone()
+		server_tls.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(server_tls)), grpc.UnaryInterceptor(admin_auth(auth)))
+	adminpb.RegisterAdminServer(server, admin)
+	return server, nil
+}
+
+// serve_admin serves the admin API on address until stopping.
+func serve_admin(address string, admin *Admin, tls_config *tls.Config, auth HTTPAuth) error {
+	server, err := new_admin_server(admin, tls_config, auth)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	go_background("admin", func() {
+		closed := make(chan struct{})
+		defer close(closed)
+		go func() {
+			select {
+			case <-stopping:
+				server.Stop()
+			case <-closed:
+			}
+		}()
+		if err := server.Serve(listener); err != nil {
+			log.Printf("Admin server failed: %v", err)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/micktwomey/prometheus_to_datadog/adminpb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// self_signed returns a certificate for 127.0.0.1 and a pool trusting it.
+func self_signed(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	cert, pool := self_signed(t)
+	admin := &Admin{query_set: NewQuerySet(Queries{{Type: Gauge, Name: "up", Query: "up"}})}
+	server, err := new_admin_server(admin, &tls.Config{Certificates: []tls.Certificate{cert}}, HTTPAuth{Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(pool, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := adminpb.NewAdminClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, header := range []string{"", "Bearer wrong"} {
+		call_ctx := ctx
+		if header != "" {
+			call_ctx = metadata.AppendToOutgoingContext(ctx, "authorization", header)
+		}
+		if _, err := client.ListQueries(call_ctx, &adminpb.ListQueriesRequest{}); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("authorization %q: got %v, expected Unauthenticated", header, err)
+		}
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	listed, err := client.ListQueries(ctx, &adminpb.ListQueriesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Queries) != 1 || listed.Queries[0].Name != "up" || listed.Queries[0].Type != "gauge" {
+		t.Errorf("listed %v, expected the up gauge", listed.Queries)
+	}
+	if _, err := client.Mute(ctx, &adminpb.MuteRequest{Name: "down"}); status.Code(err) != codes.NotFound {
+		t.Errorf("muting an unknown query gave %v, expected NotFound", err)
+	}
+}
+
+func TestAdminNeedsTLSAndAuth(t *testing.T) {
+	cert, _ := self_signed(t)
+	if _, err := new_admin_server(&Admin{}, nil, HTTPAuth{Token: "secret"}); err == nil {
+		t.Error("served without TLS")
+	}
+	if _, err := new_admin_server(&Admin{}, &tls.Config{Certificates: []tls.Certificate{cert}}, HTTPAuth{}); err == nil {
+		t.Error("served without authentication")
+	}
+	if _, err := new_admin_server(&Admin{}, &tls.Config{Certificates: []tls.Certificate{cert}}, HTTPAuth{Insecure: true}); err != nil {
+		t.Errorf("refused to serve with -admin-insecure: %v", err)
+	}
+}
+
+func TestHTTPAuthWrap(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	get := func(auth HTTPAuth, authorization string) int {
+		r := httptest.NewRequest("GET", "/snapshot", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		response := httptest.NewRecorder()
+		auth.Wrap(ok).ServeHTTP(response, r)
+		return response.Code
+	}
+	for _, test := range []struct {
+		auth          HTTPAuth
+		authorization string
+		expected      int
+	}{
+		// Nothing configured refuses everything unless -admin-insecure
+		{HTTPAuth{}, "", http.StatusForbidden},
+		{HTTPAuth{}, "Bearer secret", http.StatusForbidden},
+		{HTTPAuth{Insecure: true}, "", http.StatusOK},
+		{HTTPAuth{Token: "secret"}, "Bearer secret", http.StatusOK},
+		{HTTPAuth{Token: "secret"}, "Bearer wrong", http.StatusUnauthorized},
+		// -admin-insecure doesn't open up configured checks
+		{HTTPAuth{Token: "secret", Insecure: true}, "", http.StatusUnauthorized},
+		{HTTPAuth{User: "u", Password: "p"}, "Basic dTpw", http.StatusOK},
+	} {
+		if code := get(test.auth, test.authorization); code != test.expected {
+			t.Errorf("%+v with %q returned %d, expected %d", test.auth, test.authorization, code, test.expected)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// Package adminpb is the gRPC admin API of the bridge, generated from
+// admin.proto with protoc-gen-go and protoc-gen-go-grpc.
+package adminpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// APISeries is a single series in a Datadog /api/v1/series submission.
+type APISeries struct {
+	Metric   string       `json:"metric"`
+	Points   [][2]float64 `json:"points"`
+	Type     string       `json:"type,omitempty"`
+	Interval int64        `json:"interval,omitempty"`
+	Host     string       `json:"host,omitempty"`
+	Tags     []string     `json:"tags,omitempty"`
+}
+
+type api_batch struct {
+	series []APISeries
+	bytes  int
+}
+
+// APISinkConfig configures the Datadog HTTP API sink.
+type APISinkConfig struct {
+	URL    string
+	APIKey string
+	// Namespace is prefixed to metric names unless a sample overrides it.
+	Namespace string
+	// Hostname is sent as the host of every series.
+	Hostname string
+	// Interval is sent with counts so Datadog can turn them into rates.
+	Interval time.Duration
+	// MaxPoints and MaxBytes bound the size of a single submission.
+	MaxPoints  int
+	MaxBytes   int
+	Submitters int
+	MaxRetries int
+	// MaxQueued is how many batches can wait for a free submitter, more
+	// are dropped rather than holding up the queries pushing them.
+	MaxQueued int
+	// WaitWhenFull waits for room in the queue instead of dropping, for
+	// backfills where nothing waits on the pushes and dropping would leave
+	// gaps in the history.
+	WaitWhenFull bool
+	// Compression is none or gzip.
+	Compression string
+	Client      *http.Client
+}
+
+// APISink submits samples to the Datadog HTTP API in bounded batches, using
+// a pool of concurrent submitters. Batches are retried on 429 and 5xx
+// responses; as every point carries the timestamp it was queried at a
+// retried batch overwrites rather than duplicates points already accepted.
+type APISink struct {
+	config APISinkConfig
+
+	sync.Mutex
+	current api_batch
+	closed  bool
+	// sending counts the batches being handed to the submitters outside
+	// the lock, which Close waits for before closing batches.
+	sending sync.WaitGroup
+
+	batches chan api_batch
+	done    sync.WaitGroup
+}
+
+var errAPISinkClosed = fmt.Errorf("The Datadog API sink is closed")
+
+func NewAPISink(config APISinkConfig) *APISink {
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if config.Submitters < 1 {
+		config.Submitters = 1
+	}
+	if config.MaxQueued < 1 {
+		config.MaxQueued = config.Submitters * 2
+	}
+	sink := &APISink{
+		config:  config,
+		batches: make(chan api_batch, config.MaxQueued),
+	}
+	apiSubmitters.Set(float64(config.Submitters))
+	for i := 0; i < config.Submitters; i++ {
+		sink.done.Add(1)
+		go sink.submitter()
+	}
+	return sink
+}
+
+func (sink *APISink) series_for(sample Sample) (APISeries, error) {
+	series := APISeries{
+		Metric: sample.metric_name(sink.config.Namespace),
+		Points: [][2]float64{{float64(sample.Timestamp.Unix()), sample.Value}},
+		Host:   sink.config.Hostname,
+		Tags:   sample.Tags,
+	}
+	switch sample.Type {
+	case Counter, CountPerRun, Rate:
+		series.Type = "count"
+		if sample.Type == Rate {
+			series.Type = "rate"
+		}
+		series.Interval = int64(sink.config.Interval / time.Second)
+		if sample.Interval > 0 {
+			series.Interval = int64(sample.Interval / time.Second)
+		}
+	case Set:
+		return series, fmt.Errorf("Can't send set %v to the Datadog API, it has no set type", sample.Name)
+	case Distribution:
+		return series, fmt.Errorf("Can't send distribution %v to the Datadog API, only series are supported", sample.Name)
+	default:
+		// The API has no histogram or timing types, those are sent as gauges
+		series.Type = "gauge"
+	}
+	return series, nil
+}
+
+func (sink *APISink) Push(sample Sample) error {
+	series, err := sink.series_for(sample)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(series)
+	if err != nil {
+		return err
+	}
+
+	sink.Lock()
+	if sink.closed {
+		sink.Unlock()
+		return errAPISinkClosed
+	}
+	var full []api_batch
+	if len(sink.current.series) > 0 && (len(sink.current.series)+1 > sink.config.MaxPoints || sink.current.bytes+len(encoded)+1 > sink.config.MaxBytes) {
+		full = sink.take(full)
+	}
+	sink.current.series = append(sink.current.series, series)
+	sink.current.bytes += len(encoded) + 1
+	sink.Unlock()
+	sink.enqueue(full)
+	return nil
+}
+
+// PushGroup adds the samples to the same batch, starting a new one if they
+// don't fit in the current one. Groups larger than a whole batch are split.
+func (sink *APISink) PushGroup(samples []Sample) error {
+	series := make([]APISeries, 0, len(samples))
+	sizes := make([]int, 0, len(samples))
+	total := 0
+	for _, sample := range samples {
+		one, err := sink.series_for(sample)
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(one)
+		if err != nil {
+			return err
+		}
+		series = append(series, one)
+		sizes = append(sizes, len(encoded)+1)
+		total += len(encoded) + 1
+	}
+
+	sink.Lock()
+	if sink.closed {
+		sink.Unlock()
+		return errAPISinkClosed
+	}
+	var full []api_batch
+	if len(sink.current.series)+len(series) > sink.config.MaxPoints || sink.current.bytes+total > sink.config.MaxBytes {
+		full = sink.take(full)
+	}
+	for i := range series {
+		if len(sink.current.series) > 0 && (len(sink.current.series)+1 > sink.config.MaxPoints || sink.current.bytes+sizes[i] > sink.config.MaxBytes) {
+			full = sink.take(full)
+		}
+		sink.current.series = append(sink.current.series, series[i])
+		sink.current.bytes += sizes[i]
+	}
+	sink.Unlock()
+	sink.enqueue(full)
+	return nil
+}
+
+// take appends the current batch, if any, to full for enqueue and starts a
+// new one. Lock must be held by caller.
+func (sink *APISink) take(full []api_batch) []api_batch {
+	if len(sink.current.series) == 0 {
+		return full
+	}
+	sink.sending.Add(1)
+	full = append(full, sink.current)
+	sink.current = api_batch{}
+	return full
+}
+
+// enqueue hands batches taken with take to the submitters, without the lock
+// held. A batch finding the queue full is dropped and counted, unless
+// WaitWhenFull.
+func (sink *APISink) enqueue(full []api_batch) {
+	for _, batch := range full {
+		if sink.config.WaitWhenFull {
+			sink.batches <- batch
+		} else {
+			select {
+			case sink.batches <- batch:
+			default:
+				apiBatches.WithLabelValues("dropped").Inc()
+				apiBatchPoints.WithLabelValues("dropped").Add(float64(len(batch.series)))
+				log_throttle.Printf("api-sink/queue-full", "Dropping %d points, %d batches are already waiting for the Datadog API submitters", len(batch.series), sink.config.MaxQueued)
+			}
+		}
+		sink.sending.Done()
+	}
+}
+
+func (sink *APISink) Flush() error {
+	sink.Lock()
+	if sink.closed {
+		sink.Unlock()
+		return errAPISinkClosed
+	}
+	full := sink.take(nil)
+	sink.Unlock()
+	sink.enqueue(full)
+	return nil
+}
+
+// Close submits anything still buffered and waits for the submitters to
+// finish. The sink can't be used afterwards.
+func (sink *APISink) Close() error {
+	sink.Lock()
+	if sink.closed {
+		sink.Unlock()
+		return errAPISinkClosed
+	}
+	sink.closed = true
+	full := sink.take(nil)
+	sink.Unlock()
+	sink.enqueue(full)
+	sink.sending.Wait()
+	close(sink.batches)
+	sink.done.Wait()
+	return nil
+}
+
+func (sink *APISink) submitter() {
+	defer sink.done.Done()
+	for batch := range sink.batches {
+		apiSubmittersBusy.Inc()
+		err := sink.submit(batch)
+		apiSubmittersBusy.Dec()
+		if err != nil {
+			apiBatches.WithLabelValues("failure").Inc()
+			apiBatchPoints.WithLabelValues("failure").Add(float64(len(batch.series)))
+			log_throttle.Printf("api-sink/"+error_class(err), "Failed to submit %d points to the Datadog API: %v", len(batch.series), err)
+			continue
+		}
+		apiBatches.WithLabelValues("success").Inc()
+		apiBatchPoints.WithLabelValues("success").Add(float64(len(batch.series)))
+	}
+}
+
+// APIError is a non successful response from the Datadog API.
+type APIError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Datadog API returned %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *APIError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode/100 == 5
+}
+
+func (sink *APISink) submit(batch api_batch) error {
+	body, err := json.Marshal(struct {
+		Series []APISeries `json:"series"`
+	}{batch.series})
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = sink.post(body)
+		api_err, ok := err.(*APIError)
+		if err == nil || attempt >= sink.config.MaxRetries || (ok && !api_err.retryable()) {
+			return err
+		}
+		apiBatchRetries.Inc()
+		wait := backoff
+		if ok && api_err.RetryAfter > 0 {
+			wait = api_err.RetryAfter
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+func (sink *APISink) post(body []byte) error {
+	body, err := compress(sink.config.Compression, body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", sink.config.URL+"/api/v1/series", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if sink.config.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", sink.config.APIKey)
+
+	resp, err := sink.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	response, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	api_err := &APIError{StatusCode: resp.StatusCode, Body: string(response)}
+	api_err.RetryAfter = retry_after(resp.Header.Get("Retry-After"), time.Now())
+	return api_err
+}
+
+// retry_after parses a Retry-After header, either a number of seconds or an
+// HTTP date. Zero if it's missing, invalid or in the past.
+func retry_after(header string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		header   string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-1", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	} {
+		if got := retry_after(test.header, now); got != test.expected {
+			t.Errorf("retry_after(%q) = %v, expected %v", test.header, got, test.expected)
+		}
+	}
+}
+
+func TestAPISinkClosed(t *testing.T) {
+	sink := NewAPISink(APISinkConfig{URL: "http://127.0.0.1:0", MaxPoints: 10, MaxBytes: 1024})
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sample := Sample{Type: Gauge, Name: "up", Value: 1, Timestamp: time.Now()}
+	if err := sink.Push(sample); err != errAPISinkClosed {
+		t.Errorf("Push after Close returned %v", err)
+	}
+	if err := sink.PushGroup([]Sample{sample}); err != errAPISinkClosed {
+		t.Errorf("PushGroup after Close returned %v", err)
+	}
+	if err := sink.Flush(); err != errAPISinkClosed {
+		t.Errorf("Flush after Close returned %v", err)
+	}
+	if err := sink.Close(); err != errAPISinkClosed {
+		t.Errorf("second Close returned %v", err)
+	}
+}
+
+func TestAPISinkDropsWhenQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		<-release
+	}))
+	defer server.Close()
+
+	// One batch being submitted, one waiting and the rest dropped
+	sink := NewAPISink(APISinkConfig{URL: server.URL, MaxPoints: 1, MaxBytes: 1024, Submitters: 1, MaxQueued: 1})
+	pushed := make(chan struct{})
+	go func() {
+		defer close(pushed)
+		for i := 0; i < 10; i++ {
+			sink.Push(Sample{Type: Gauge, Name: "up", Value: float64(i), Timestamp: time.Now()})
+			sink.Flush()
+		}
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Push blocked on a full queue")
+	}
+
+	close(release)
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&received); got < 1 || got > 2 {
+		t.Errorf("%d batches submitted, expected at most the one being submitted and the queued one", got)
+	}
+}
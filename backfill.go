@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// backfill_max_points keeps each range query under Prometheus' limit of
+// 11,000 points per series.
+const backfill_max_points = 10000
+
+// BackfillOptions is the historical window for the backfill command.
+type BackfillOptions struct {
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+}
+
+// parse_backfill_args parses `backfill -start ... -end ... -step ...`.
+func parse_backfill_args(args []string) (BackfillOptions, error) {
+	var options BackfillOptions
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	start := flags.String("start", "", "Start of the window to backfill (RFC3339).")
+	end := flags.String("end", "", "End of the window to backfill (RFC3339), defaults to now.")
+	flags.DurationVar(&options.Step, "step", time.Minute, "Time between backfilled points.")
+	flags.Parse(args)
+
+	var err error
+	if *start == "" {
+		return options, fmt.Errorf("backfill needs -start")
+	}
+	if options.Start, err = time.Parse(time.RFC3339, *start); err != nil {
+		return options, fmt.Errorf("Invalid -start %v: %v", *start, err)
+	}
+	options.End = time.Now()
+	if *end != "" {
+		if options.End, err = time.Parse(time.RFC3339, *end); err != nil {
+			return options, fmt.Errorf("Invalid -end %v: %v", *end, err)
+		}
+	}
+	if !options.End.After(options.Start) {
+		return options, fmt.Errorf("backfill -end must be after -start")
+	}
+	if options.Step <= 0 {
+		return options, fmt.Errorf("backfill -step must be positive")
+	}
+	return options, nil
+}
+
+type backfill_point struct {
+	query  Query
+	sample Sample
+}
+
+// run_backfill runs every query but the federate ones as a range query over the
+// window, in chunks, and pushes the points with their original timestamps.
+// Each step is treated as a cycle for tenant quotas. Returns the exit status.
+func run_backfill(options BackfillOptions, query_set *QuerySet, query_api prometheus.QueryAPI, sink Sink) int {
+	status := 0
+	chunk := options.Step * backfill_max_points
+	for start := options.Start; start.Before(options.End); start = start.Add(chunk) {
+		end := start.Add(chunk - options.Step)
+		if end.After(options.End) {
+			end = options.End
+		}
+
+		by_time := map[int64][]backfill_point{}
+		for _, query := range query_set.Queries() {
+			if len(query.Federate) > 0 {
+				// /federate only has the latest samples
+				continue
+			}
+			points, err := backfill_query(query, query_api, prometheus.Range{Start: start, End: end, Step: options.Step})
+			if err != nil {
+				log.Printf("Query %v failed for %v to %v: %v", query.Name, start, end, err)
+				status = 1
+				continue
+			}
+			for _, point := range points {
+				at := point.sample.Timestamp.UnixNano()
+				by_time[at] = append(by_time[at], point)
+			}
+		}
+
+		var times []int64
+		for at := range by_time {
+			times = append(times, at)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+		for _, at := range times {
+			quota_tracker.StartCycle()
+			for _, point := range by_time[at] {
+				if err := push_sample(point.query, point.sample, sink); err != nil {
+					log.Printf("Failed to push %v at %v: %v", point.sample.Name, point.sample.Timestamp, err)
+					status = 1
+				}
+			}
+		}
+		if err := sink.Flush(); err != nil {
+			log.Printf("Failed to flush sink: %v", err)
+			status = 1
+		}
+		log.Printf("Backfilled %v to %v (%d steps)", start, end, len(times))
+	}
+	if err := sink.Close(); err != nil {
+		log.Printf("Failed to close sink: %v", err)
+		status = 1
+	}
+	return status
+}
+
+// backfill_query runs a query over one chunk of the window, against each of
+// its regions if it has any, rendering its tags for every point.
+func backfill_query(query Query, query_api prometheus.QueryAPI, r prometheus.Range) ([]backfill_point, error) {
+	var matrix model.Matrix
+	if len(query.Regions) > 0 {
+		// Failures are counted per region
+		var err error
+		if matrix, err = query_regions_range(context.Background(), query, r); err != nil {
+			return nil, err
+		}
+	} else {
+		results, err := query_api.QueryRange(context.Background(), query.Query, r)
+		if err != nil {
+			count_failed_query(query, query_error_class(err), err)
+			return nil, err
+		}
+		var ok bool
+		if matrix, ok = results.(model.Matrix); !ok {
+			return nil, fmt.Errorf("Expected a range vector from %v, got %v", query.Name, results.Type())
+		}
+	}
+
+	query.backfill_step = r.Step
+	var points []backfill_point
+	for _, series := range matrix {
+		name, tags, keep, err := series_name_and_tags(query, series.Metric)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			continue
+		}
+		for _, value := range series.Values {
+			computed, err := render_tags(query, series.Metric, float64(value.Value))
+			if err != nil {
+				return nil, fmt.Errorf("Can't render tags for %v: %v", query.Name, err)
+			}
+			points = append(points, backfill_point{
+				query:  query,
+				sample: Sample{Name: name, Value: float64(value.Value), Tags: append(tags[:len(tags):len(tags)], computed...), Timestamp: value.Timestamp.Time()},
+			})
+		}
+	}
+	return points, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import "fmt"
+
+// canary_name is the metric the canary is pushed as, outside the namespace so
+// a single Datadog monitor covers every deployment.
+const canary_name = "prometheus_to_datadog.canary"
+
+// canary_queries returns the built-in canary with -canary: a constant
+// expression (vector(1) by default) evaluated every cycle, so a monitor on
+// its known value checks the whole pipeline from Prometheus to Datadog. It
+// runs first and is never shed, and failing to return a value fails it like
+// any query.
+func canary_queries(loaded Queries) (Queries, error) {
+	if !*canary {
+		return nil, nil
+	}
+	for _, query := range loaded {
+		if query.Name == canary_name {
+			return nil, fmt.Errorf("Query %v clashes with the -canary query", query.Name)
+		}
+	}
+	namespace := ""
+	return Queries{{
+		Name:      canary_name,
+		Type:      Gauge,
+		Query:     *canary_query,
+		Namespace: &namespace,
+		OnEmpty:   EmptyError,
+		Priority:  PriorityHigh,
+	}}, nil
+}
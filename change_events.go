@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// ChangeEventConfig sends a Datadog event when the series a query returns
+// change significantly between runs, e.g. after a deploy or an exporter
+// change.
+type ChangeEventConfig struct {
+	// Threshold is the number of series which appeared or disappeared as a
+	// fraction of the previous run's series, 0.2 if not set.
+	Threshold float64 `yaml:"threshold"`
+}
+
+func (config *ChangeEventConfig) threshold() float64 {
+	if config.Threshold == 0 {
+		return 0.2
+	}
+	return config.Threshold
+}
+
+// change_event_examples is how many changed series are listed in an event.
+const change_event_examples = 10
+
+var change_event_series = struct {
+	sync.Mutex
+	by_query map[string]SeriesSet
+}{by_query: map[string]SeriesSet{}}
+
+// series_changes records the current series for a query and returns the ones
+// which appeared and disappeared since the previous run, and whether there was
+// a previous run.
+func series_changes(query_name string, current SeriesSet) (appeared, disappeared []TrackedSeries, previous int, ok bool) {
+	change_event_series.Lock()
+	defer change_event_series.Unlock()
+
+	last, ok := change_event_series.by_query[query_name]
+	change_event_series.by_query[query_name] = current
+	if !ok {
+		return nil, nil, 0, false
+	}
+	for key, series := range current {
+		if _, seen := last[key]; !seen {
+			appeared = append(appeared, series)
+		}
+	}
+	for key, series := range last {
+		if _, still := current[key]; !still {
+			disappeared = append(disappeared, series)
+		}
+	}
+	return appeared, disappeared, len(last), true
+}
+
+// series_change_event returns an event if the series of a query changed by
+// more than its threshold, nil otherwise.
+func series_change_event(query Query, current SeriesSet) *statsd.Event {
+	appeared, disappeared, previous, ok := series_changes(query.Name, current)
+	if !ok {
+		return nil
+	}
+	changed := len(appeared) + len(disappeared)
+	if changed == 0 {
+		return nil
+	}
+	base := previous
+	if base == 0 {
+		base = 1
+	}
+	if float64(changed)/float64(base) < query.ChangeEvents.threshold() {
+		return nil
+	}
+
+	text := fmt.Sprintf("%d series appeared and %d disappeared (%d before, %d now).", len(appeared), len(disappeared), previous, len(current))
+	text += describe_series("Appeared", appeared) + describe_series("Disappeared", disappeared)
+	event := statsd.NewEvent(fmt.Sprintf("prometheus_to_datadog: series of %v changed", query.Name), text)
+	event.AggregationKey = query.Name
+	event.Tags = []string{"query:" + query.Name}
+	return event
+}
+
+func describe_series(heading string, series []TrackedSeries) string {
+	if len(series) == 0 {
+		return ""
+	}
+	var lines []string
+	for _, s := range series {
+		lines = append(lines, fmt.Sprintf("%v{%v}", s.Name, strings.Join(s.Tags, ",")))
+	}
+	sort.Strings(lines)
+	if len(lines) > change_event_examples {
+		lines = append(lines[:change_event_examples], fmt.Sprintf("... and %d more", len(series)-change_event_examples))
+	}
+	return fmt.Sprintf("\n%v:\n%v", heading, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where the scheduler gets the time from, so that the simulate
+// command can drive cycles deterministically instead of waiting for them.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// RealClock is the wall clock.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// SimClock only moves when told to, sleeping advances it immediately.
+type SimClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func NewSimClock(now time.Time) *SimClock {
+	return &SimClock{now: now}
+}
+
+func (clock *SimClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+func (clock *SimClock) Sleep(d time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	if d > 0 {
+		clock.now = clock.now.Add(d)
+	}
+}
+
+// AdvanceTo moves the clock forward to t, a clock already past t (e.g. after
+// sleeping through splay offsets) is left alone.
+func (clock *SimClock) AdvanceTo(t time.Time) {
+	clock.Lock()
+	defer clock.Unlock()
+	if t.After(clock.now) {
+		clock.now = t
+	}
+}
+
+// clock is used by the scheduler, replaced by a SimClock when simulating.
+var clock Clock = RealClock{}
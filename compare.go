@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+)
+
+// ValueChange is a series whose value differs between the two definitions.
+type ValueChange struct {
+	Series string  `json:"series"`
+	Old    float64 `json:"old"`
+	New    float64 `json:"new"`
+}
+
+// ComparisonDiff is what a cycle of the -compare-query-file queries would
+// have pushed differently from the running queries.
+type ComparisonDiff struct {
+	Time          time.Time     `json:"time"`
+	OnlyOldNames  []string      `json:"only_old_names,omitempty"`
+	OnlyNewNames  []string      `json:"only_new_names,omitempty"`
+	OnlyOldSeries []string      `json:"only_old_series,omitempty"`
+	OnlyNewSeries []string      `json:"only_new_series,omitempty"`
+	Changed       []ValueChange `json:"changed,omitempty"`
+}
+
+func (diff *ComparisonDiff) Empty() bool {
+	return len(diff.OnlyOldNames)+len(diff.OnlyNewNames)+len(diff.OnlyOldSeries)+len(diff.OnlyNewSeries)+len(diff.Changed) == 0
+}
+
+func (diff *ComparisonDiff) String() string {
+	return fmt.Sprintf("%d names only in old, %d names only in new, %d series only in old, %d series only in new, %d values changed",
+		len(diff.OnlyOldNames), len(diff.OnlyNewNames), len(diff.OnlyOldSeries), len(diff.OnlyNewSeries), len(diff.Changed))
+}
+
+// Comparison runs a second definition of the queries (e.g. a refactored
+// query file or one moving to another namespace) alongside the running ones
+// every cycle without pushing its results, comparing what both would send.
+type Comparison struct {
+	path string
+	// tolerance is the relative difference below which values are equal.
+	tolerance float64
+
+	sync.RWMutex
+	queries Queries
+	latest  *ComparisonDiff
+}
+
+// NewComparison loads the queries to compare from a query file (or
+// directory).
+func NewComparison(path string, tolerance float64) (*Comparison, error) {
+	loaded, err := load_comparison_queries(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Comparison{path: path, tolerance: tolerance, queries: loaded}, nil
+}
+
+// Reload re-reads the queries to compare, e.g. while staging changes to
+// them. A file which fails to load keeps the previous queries.
+func (comparison *Comparison) Reload() error {
+	loaded, err := load_comparison_queries(comparison.path)
+	if err != nil {
+		return err
+	}
+	comparison.Lock()
+	defer comparison.Unlock()
+	comparison.queries = loaded
+	return nil
+}
+
+// load_comparison_queries loads and checks the queries to compare. Options
+// keeping state between runs (zero_fill, keepalive, change_events and
+// exemplar events) are dropped from them, they would clash with the state of
+// the running queries of the same name.
+func load_comparison_queries(path string) (Queries, error) {
+	loaded, err := load_query_files(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate_query_names(loaded); err != nil {
+		return nil, err
+	}
+	if loaded, err = expand_query_vars(loaded, query_vars); err != nil {
+		return nil, err
+	}
+	if err := check_query_lengths(loaded); err != nil {
+		return nil, err
+	}
+	for i := range loaded {
+		query := &loaded[i]
+		query.comparison = true
+		query.ZeroFill = false
+		query.KeepAlive = 0
+		query.ChangeEvents = nil
+		if query.Exemplars != nil && query.Exemplars.Mode == "events" {
+			query.Exemplars = nil
+		}
+	}
+	return loaded, nil
+}
+
+// Run runs the queries for the cycle at now and compares their output with
+// the running queries' snapshot.
+func (comparison *Comparison) Run(now time.Time, old *Snapshot, query_api prometheus.QueryAPI) *ComparisonDiff {
+	snapshot := &SnapshotSink{}
+	comparison.RLock()
+	queries := comparison.queries
+	comparison.RUnlock()
+	for _, query := range queries {
+		if err := run_query(query, query_api, now, snapshot); err != nil {
+			log_throttle.Printf("compare/"+query.Name+"/"+query_error_class(err), "Comparison query %v failed: %v", query.Name, err)
+		}
+	}
+	diff := diff_snapshots(old, snapshot.Snapshot(now), comparison.tolerance)
+	for kind, count := range map[string]int{
+		"only_old_names":  len(diff.OnlyOldNames),
+		"only_new_names":  len(diff.OnlyNewNames),
+		"only_old_series": len(diff.OnlyOldSeries),
+		"only_new_series": len(diff.OnlyNewSeries),
+		"changed_values":  len(diff.Changed),
+	} {
+		comparisonDifferences.WithLabelValues(kind).Set(float64(count))
+	}
+	if !diff.Empty() {
+		log.Printf("Comparison: %v", diff)
+	}
+	comparison.Lock()
+	comparison.latest = diff
+	comparison.Unlock()
+	return diff
+}
+
+// snapshot_series maps each series of a snapshot (name and sorted tags) to
+// its value.
+func snapshot_series(snapshot *Snapshot) (map[string]float64, map[string]bool) {
+	series := map[string]float64{}
+	names := map[string]bool{}
+	for _, sample := range snapshot.Samples {
+		series[sample.Name+"{"+strings.Join(sample.Tags, ",")+"}"] = sample.Value
+		names[sample.Name] = true
+	}
+	return series, names
+}
+
+// diff_snapshots compares the output of two definitions of the queries.
+// Series of names only one side has aren't listed again as series.
+func diff_snapshots(old, new *Snapshot, tolerance float64) *ComparisonDiff {
+	diff := &ComparisonDiff{Time: new.Time}
+	old_series, old_names := snapshot_series(old)
+	new_series, new_names := snapshot_series(new)
+	for name := range old_names {
+		if !new_names[name] {
+			diff.OnlyOldNames = append(diff.OnlyOldNames, name)
+		}
+	}
+	for name := range new_names {
+		if !old_names[name] {
+			diff.OnlyNewNames = append(diff.OnlyNewNames, name)
+		}
+	}
+	for series, old_value := range old_series {
+		new_value, ok := new_series[series]
+		switch {
+		case !ok:
+			if new_names[series[:strings.Index(series, "{")]] {
+				diff.OnlyOldSeries = append(diff.OnlyOldSeries, series)
+			}
+		case !values_equal(old_value, new_value, tolerance):
+			diff.Changed = append(diff.Changed, ValueChange{Series: series, Old: old_value, New: new_value})
+		}
+	}
+	for series := range new_series {
+		if _, ok := old_series[series]; !ok && old_names[series[:strings.Index(series, "{")]] {
+			diff.OnlyNewSeries = append(diff.OnlyNewSeries, series)
+		}
+	}
+	sort.Strings(diff.OnlyOldNames)
+	sort.Strings(diff.OnlyNewNames)
+	sort.Strings(diff.OnlyOldSeries)
+	sort.Strings(diff.OnlyNewSeries)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Series < diff.Changed[j].Series })
+	return diff
+}
+
+func values_equal(a, b float64, tolerance float64) bool {
+	if a == b || (math.IsNaN(a) && math.IsNaN(b)) {
+		return true
+	}
+	return math.Abs(a-b) <= tolerance*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// comparison is set by -compare-query-file.
+var comparison *Comparison
+
+// serve_comparison returns the differences found in the most recent cycle,
+// on /compare and /shadow/diff.
+func serve_comparison(w http.ResponseWriter, r *http.Request) {
+	comparison.RLock()
+	diff := comparison.latest
+	comparison.RUnlock()
+	if diff == nil {
+		http.Error(w, "No cycle has completed yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(diff)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+)
+
+// compress compresses a payload of the API and Logs sinks with codec: none
+// or gzip.
+func compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", "none":
+		return data, nil
+	case "gzip":
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return compressed.Bytes(), nil
+	}
+	return nil, fmt.Errorf("Unknown compression %v", codec)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// apply_config_file sets every flag which wasn't given on the command line
+// or in the environment from the -config file, a YAML mapping of flag names
+// (without dashes) to values. The repeatable flags, which can be given
+// several times, take a list. The command line wins over the environment,
+// which wins over the config file.
+func apply_config_file(flags *pflag.FlagSet, path string, repeatable map[string]bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var settings yaml.MapSlice
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("Can't parse %v: %v", path, err)
+	}
+	given := map[string]bool{}
+	flags.Visit(func(f *pflag.Flag) {
+		given[f.Name] = true
+	})
+	for _, setting := range settings {
+		name := fmt.Sprint(setting.Key)
+		if name == "queries" {
+			// Read with the queries, see config_queries
+			continue
+		}
+		f := flags.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%v: unknown setting %v", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		values, is_list := setting.Value.([]interface{})
+		if !is_list {
+			values = []interface{}{setting.Value}
+		} else if !repeatable[name] {
+			return fmt.Errorf("%v: %v takes a single value", path, name)
+		}
+		for _, value := range values {
+			if value == nil {
+				value = ""
+			}
+			if err := flags.Set(name, fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("%v: invalid %v: %v", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// config_queries returns the YAML list of queries under queries: in the
+// -config file, nil if it has none. They're used instead of a query file
+// when -query-file isn't set, and read again on every reload.
+func config_queries(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Queries []interface{} `yaml:"queries"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Can't parse %v: %v", path, err)
+	}
+	if config.Queries == nil {
+		return nil, nil
+	}
+	return yaml.Marshal(config.Queries)
+}
+
+// load_config_queries decodes the queries in the -config file, see
+// config_queries, reporting every problem like a query file.
+func load_config_queries(path string) (Queries, []string) {
+	data, err := config_queries(path)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	if data == nil {
+		return nil, nil
+	}
+	return decode_queries(path, data, false)
+}
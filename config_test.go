@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	address := flags.String("prometheus-address", "", "")
+	file := flags.String("query-file", "", "")
+	vars := flags.StringArray("var", nil, "")
+	repeatable := map[string]bool{"var": true}
+	flags.Parse([]string{"--query-file", "given.yaml"})
+
+	path := t.TempDir() + "/config.yaml"
+	config := "prometheus-address: http://prometheus:9090\nquery-file: config.yaml\nvar: [a=1, b=2]\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply_config_file(flags, path, repeatable); err != nil {
+		t.Fatal(err)
+	}
+	if *address != "http://prometheus:9090" || *file != "given.yaml" || !reflect.DeepEqual(*vars, []string{"a=1", "b=2"}) {
+		t.Errorf("got %v, %v and %v", *address, *file, *vars)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("prometheus-adress: x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply_config_file(flags, path, repeatable); err == nil {
+		t.Error("unknown setting accepted")
+	}
+
+	// Only the repeatable flags take a list
+	flags = pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("prometheus-address", "", "Can be specified multiple times.")
+	if err := ioutil.WriteFile(path, []byte("prometheus-address: [a, b]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply_config_file(flags, path, repeatable); err == nil {
+		t.Error("list accepted for a single value flag")
+	}
+}
+
+func TestLoadConfigQueries(t *testing.T) {
+	path := t.TempDir() + "/config.yaml"
+	config := `
+interval: 30s
+queries:
+  - name: up
+    type: gauge
+    query: up
+  - name: broken
+    type: gauge
+`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, problems := load_config_queries(path)
+	if len(loaded) != 1 || loaded[0].Name != "up" {
+		t.Errorf("loaded %+v, expected just up", loaded)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "needs both a name and a query") {
+		t.Errorf("problems %q, expected one for the query without an expression", problems)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("interval: 30s\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, problems := load_config_queries(path); loaded != nil || problems != nil {
+		t.Errorf("got %+v and %q without queries", loaded, problems)
+	}
+}
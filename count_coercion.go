@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// CoercionPolicy decides how a count's value becomes the integer sent to
+// Datadog.
+type CoercionPolicy string
+
+const (
+	CoercionTruncate CoercionPolicy = "truncate"
+	CoercionRound    CoercionPolicy = "round"
+	CoercionFloor    CoercionPolicy = "floor"
+	// CoercionError fails the query on a fractional value.
+	CoercionError CoercionPolicy = "error"
+)
+
+// CoercionPolicies maps the count types to their coercion policy. Counters
+// truncate (as they always have) and count_per_run rounds, as an increase()
+// of 2.9999 is 3.
+type CoercionPolicies map[QueryType]CoercionPolicy
+
+func (flags CoercionPolicies) String() string {
+	return "CoercionPolicies"
+}
+
+func (flags CoercionPolicies) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Count coercion must be in the form type:policy (%v)", value)
+	}
+	query_type, err := parse_query_type(parts[0])
+	if err != nil {
+		return fmt.Errorf("%v (%v)", err, value)
+	}
+	if query_type != Counter && query_type != CountPerRun {
+		return fmt.Errorf("Count coercion only applies to counter and count_per_run (%v)", value)
+	}
+	switch policy := CoercionPolicy(parts[1]); policy {
+	case CoercionTruncate, CoercionRound, CoercionFloor, CoercionError:
+		flags[query_type] = policy
+		return nil
+	}
+	return fmt.Errorf("Can't handle count coercion %v (expected truncate, round, floor or error)", parts[1])
+}
+
+// count_out_of_range is true for values which can't be sent as an int64
+// count: NaN, infinities and anything beyond ±2^63.
+func count_out_of_range(value float64) bool {
+	return math.IsNaN(value) || value >= math.MaxInt64 || value < math.MinInt64
+}
+
+// coerce_count makes a count's value integral under its type's policy,
+// counting lossy conversions. Returns false if the sample should be dropped
+// as it can't be sent as an int64.
+func coerce_count(sample Sample) (Sample, bool, error) {
+	if sample.Type != Counter && sample.Type != CountPerRun {
+		return sample, true, nil
+	}
+	if count_out_of_range(sample.Value) {
+		return sample, false, nil
+	}
+	policy := coercion_policies[sample.Type]
+	var coerced float64
+	switch policy {
+	case CoercionRound:
+		coerced = math.Round(sample.Value)
+	case CoercionFloor:
+		coerced = math.Floor(sample.Value)
+	default:
+		coerced = math.Trunc(sample.Value)
+	}
+	if coerced == sample.Value {
+		return sample, true, nil
+	}
+	lossyCountConversions.WithLabelValues(sample.Query, string(policy)).Inc()
+	if policy == CoercionError {
+		return sample, false, fmt.Errorf("Query %v returned a fractional count %v (-count-coercion %v:error)", sample.Query, sample.Value, sample.Type)
+	}
+	sample.Value = coerced
+	return sample, true, nil
+}
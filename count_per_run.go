@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// count_per_run_guard makes sure a count_per_run series is counted once per
+// interval: a second sample for the same series in the same run (e.g. two
+// series which only differed by a dropped label) or from an extra run within
+// the interval (e.g. the admin API's RunQueryOnce) is dropped instead of
+// being added to the count in Datadog.
+var count_per_run_guard = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: map[string]time.Time{}}
+
+// count_once_interval is the interval a count_per_run series is counted
+// once in: the query's, or the step when backfilling, whose points are
+// usually closer together.
+func count_once_interval(query Query) time.Duration {
+	if query.backfill_step > 0 {
+		return query.backfill_step
+	}
+	return query_interval(query, time.Duration(interval))
+}
+
+// count_once returns false if the series was already counted in this
+// interval.
+func count_once(sample Sample, interval time.Duration) bool {
+	key := sample.Query + "|" + series_key(sample.Name, sample.Tags)
+	count_per_run_guard.Lock()
+	defer count_per_run_guard.Unlock()
+	if last, ok := count_per_run_guard.last[key]; ok {
+		// Half an interval leaves room for scheduling jitter
+		if since := sample.Timestamp.Sub(last); since >= 0 && since < interval/2 {
+			return false
+		}
+	}
+	count_per_run_guard.last[key] = sample.Timestamp
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// counter_total is a series' total and when Prometheus evaluated it.
+type counter_total struct {
+	value float64
+	at    time.Time
+}
+
+// counter_totals holds the last total of every series of the cumulative
+// queries, by query and series_key. Comparison queries have their own state
+// as they share the names of the running queries.
+var counter_totals = struct {
+	sync.Mutex
+	by_query map[string]map[string]counter_total
+}{by_query: map[string]map[string]counter_total{}}
+
+func counter_totals_key(query Query) string {
+	if query.comparison {
+		return "compare|" + query.Name
+	}
+	return query.Name
+}
+
+// total_stager is a sink holding samples back until the run completes,
+// which then holds back the totals they were computed from too: if the run
+// is discarded or its push fails the next run's delta still covers the
+// increase.
+type total_stager interface {
+	staged_total(query_key string, series string) (counter_total, bool)
+	stage_total(query_key string, series string, total counter_total)
+}
+
+// counter_delta turns the total of a cumulative counter series (e.g.
+// http_requests_total) into the increase since the previous run, which is
+// what a dogstatsd count expects. A total lower than the previous one is a
+// counter reset, the counter counted up from zero since. Also returns the time
+// between the two evaluations, for rates. Returns false the first time a
+// series is seen, there's nothing to compare it with yet.
+func counter_delta(query Query, sample Sample, sink Sink) (float64, time.Duration, bool) {
+	key := series_key(sample.Name, sample.Tags)
+	query_key := counter_totals_key(query)
+	total := counter_total{value: sample.Value, at: sample.Timestamp}
+	stager, staging := sink.(total_stager)
+	var last counter_total
+	var seen bool
+	if staging {
+		last, seen = stager.staged_total(query_key, key)
+	}
+
+	counter_totals.Lock()
+	if !seen {
+		last, seen = counter_totals.by_query[query_key][key]
+	}
+	if !staging {
+		store_counter_total(query_key, key, total)
+	}
+	counter_totals.Unlock()
+	if staging {
+		stager.stage_total(query_key, key, total)
+	}
+
+	if !seen {
+		return 0, 0, false
+	}
+	elapsed := sample.Timestamp.Sub(last.at)
+	if sample.Value < last.value {
+		counterResets.WithLabelValues(query.Name).Inc()
+		return sample.Value, elapsed, true
+	}
+	return sample.Value - last.value, elapsed, true
+}
+
+// store_counter_total records a series' total, with counter_totals locked.
+func store_counter_total(query_key string, series string, total counter_total) {
+	totals, ok := counter_totals.by_query[query_key]
+	if !ok {
+		totals = map[string]counter_total{}
+		counter_totals.by_query[query_key] = totals
+	}
+	totals[series] = total
+}
+
+// check_cumulative_names rejects cumulative queries sharing a name, their
+// totals are kept by query name.
+func check_cumulative_names(loaded Queries) error {
+	seen := map[string]bool{}
+	for _, query := range loaded {
+		if !query.Cumulative {
+			continue
+		}
+		if seen[query.Name] {
+			return fmt.Errorf("Query %v: more than one cumulative query has this name, rename one", query.Name)
+		}
+		seen[query.Name] = true
+	}
+	return nil
+}
+
+// forget_counter_totals drops the totals of the series a cumulative query no
+// longer returns, so churning series don't accumulate. A series which comes
+// back starts over without a delta for its first run.
+func forget_counter_totals(query Query, current SeriesSet) {
+	counter_totals.Lock()
+	defer counter_totals.Unlock()
+	for key := range counter_totals.by_query[counter_totals_key(query)] {
+		if _, ok := current[key]; !ok {
+			delete(counter_totals.by_query[counter_totals_key(query)], key)
+		}
+	}
+}
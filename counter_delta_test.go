@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterDeltaStagedUntilCommit(t *testing.T) {
+	query := Query{Type: Counter, Name: "staged_total", Cumulative: true}
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	sample := func(value float64, at time.Duration) Sample {
+		return Sample{Name: "requests", Value: value, Tags: []string{"job:a"}, Timestamp: start.Add(at)}
+	}
+	defer forget_removed_queries([]string{query.Name})
+
+	if _, _, ok := counter_delta(query, sample(100, 0), discard_sink{}); ok {
+		t.Fatal("first total gave a delta")
+	}
+
+	// A discarded run: staged but never committed
+	discarded := &PendingSink{sink: discard_sink{}}
+	if delta, _, _ := counter_delta(query, sample(110, 10*time.Second), discarded); delta != 10 {
+		t.Errorf("delta %v, expected 10", delta)
+	}
+
+	committed := &PendingSink{sink: discard_sink{}}
+	if delta, _, _ := counter_delta(query, sample(125, 20*time.Second), committed); delta != 25 {
+		t.Errorf("delta after a discarded run %v, expected 25 since the last sent total", delta)
+	}
+	if err := committed.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if delta, elapsed, _ := counter_delta(query, sample(130, 30*time.Second), discard_sink{}); delta != 5 || elapsed != 10*time.Second {
+		t.Errorf("delta %v over %v after a commit, expected 5 over 10s", delta, elapsed)
+	}
+}
+
+func TestCheckCumulativeNames(t *testing.T) {
+	if err := check_cumulative_names(Queries{{Name: "a", Cumulative: true}, {Name: "a"}, {Name: "b", Cumulative: true}}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := check_cumulative_names(Queries{{Name: "a", Cumulative: true}, {Name: "a", Cumulative: true}}); err == nil {
+		t.Error("duplicate cumulative names accepted")
+	}
+}
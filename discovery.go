@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// DiscoveryMatchers are the series selectors whose metric families are
+// turned into queries.
+type DiscoveryMatchers []string
+
+func (flags *DiscoveryMatchers) String() string {
+	return "DiscoveryMatchers"
+}
+
+func (flags *DiscoveryMatchers) Set(value string) error {
+	*flags = append(*flags, value)
+	return nil
+}
+
+// DiscoveredFamily is the data the discovery templates are executed with.
+type DiscoveredFamily struct {
+	// Metric is the metric family name, e.g. node_load1.
+	Metric string
+	// Matcher is the selector the family was discovered with, e.g.
+	// {job="node"}.
+	Matcher string
+}
+
+// Discovery generates a gauge query per metric family matching its
+// selectors. Families named *_total are counters and use the counter query
+// template, which takes a rate.
+type Discovery struct {
+	matchers               []string
+	name_template          *template.Template
+	query_template         *template.Template
+	counter_query_template *template.Template
+
+	sync.Mutex
+	queries Queries
+}
+
+func NewDiscovery(matchers []string, name_template, query_template, counter_query_template string) (*Discovery, error) {
+	discovery := &Discovery{matchers: matchers}
+	var err error
+	if discovery.name_template, err = template.New("name").Parse(name_template); err != nil {
+		return nil, fmt.Errorf("Invalid discovery name template: %v", err)
+	}
+	if discovery.query_template, err = template.New("query").Parse(query_template); err != nil {
+		return nil, fmt.Errorf("Invalid discovery query template: %v", err)
+	}
+	if discovery.counter_query_template, err = template.New("counter_query").Parse(counter_query_template); err != nil {
+		return nil, fmt.Errorf("Invalid discovery counter query template: %v", err)
+	}
+	return discovery, nil
+}
+
+// Queries returns the queries generated by the last discovery, nil safe.
+func (discovery *Discovery) Queries() Queries {
+	if discovery == nil {
+		return nil
+	}
+	discovery.Lock()
+	defer discovery.Unlock()
+	return discovery.queries
+}
+
+// Discover looks up the metric families and regenerates the queries,
+// returning whether they changed.
+func (discovery *Discovery) Discover() (bool, error) {
+	var generated Queries
+	seen := map[string]bool{}
+	for _, matcher := range discovery.matchers {
+		families, err := fetch_metric_names(*prometheus_addr, matcher)
+		if err != nil {
+			return false, err
+		}
+		for _, family := range families {
+			// Histogram buckets aren't useful as separate Datadog metrics
+			if strings.HasSuffix(family, "_bucket") {
+				continue
+			}
+			query, err := discovery.query_for(DiscoveredFamily{Metric: family, Matcher: matcher})
+			if err != nil {
+				return false, err
+			}
+			if seen[query.Name] {
+				continue
+			}
+			seen[query.Name] = true
+			generated = append(generated, query)
+		}
+	}
+
+	discovery.Lock()
+	defer discovery.Unlock()
+	if reflect.DeepEqual(generated, discovery.queries) {
+		return false, nil
+	}
+	discovery.queries = generated
+	return true, nil
+}
+
+func (discovery *Discovery) query_for(family DiscoveredFamily) (Query, error) {
+	query := Query{Type: Gauge}
+	query_template := discovery.query_template
+	if strings.HasSuffix(family.Metric, "_total") {
+		query_template = discovery.counter_query_template
+	}
+	var name, expression bytes.Buffer
+	if err := discovery.name_template.Execute(&name, family); err != nil {
+		return query, err
+	}
+	if err := query_template.Execute(&expression, family); err != nil {
+		return query, err
+	}
+	query.Name = name.String()
+	query.Query = expression.String()
+	return query, nil
+}
+
+// fetch_metric_names returns the metric names of the series matching a
+// selector.
+func fetch_metric_names(address string, matcher string) ([]string, error) {
+	params := url.Values{}
+	params.Set("match[]", matcher)
+	resp, err := prometheus_http_client.Get(strings.TrimRight(address, "/") + "/api/v1/label/__name__/values?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string   `json:"status"`
+		Error  string   `json:"error"`
+		Data   []string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("Metric name lookup for %v failed: %v", matcher, result.Error)
+	}
+	sort.Strings(result.Data)
+	return result.Data, nil
+}
+
+// start_discovery rediscovers the metric families every interval, reloading
+// the queries when they change.
+func start_discovery(discovery *Discovery, query_set *QuerySet, interval time.Duration) {
+	go_background("discovery", func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopping:
+				return
+			case <-ticker.C:
+			}
+			changed, err := discovery.Discover()
+			if err != nil {
+				log_throttle.Printf("discovery/"+error_class(err), "Discovery failed: %v", err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			loaded, err := reload_queries(query_set)
+			if err != nil {
+				log.Printf("Failed to reload discovered queries: %v", err)
+				continue
+			}
+			log.Printf("Discovery changed the queries, now running %d", len(loaded))
+		}
+	})
+}
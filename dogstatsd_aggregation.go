@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// DogstatsdAggregator aggregates samples before they're sent to the agent,
+// like the client-side aggregation of newer datadog-go clients: samples for
+// the same context (name, type and tags) are combined into one datagram per
+// flush. Gauges and rates keep the last value, counts are summed and sets
+// send each member once. With extended aggregation histograms, timings and
+// distributions are buffered too and sent as multi-value datagrams
+// (name:1:2:3|h), which needs Datadog agent 6.25 or 7.25 and later.
+//
+// Samples with a sample rate are sent straight away, the agent scales them
+// back up one by one.
+type DogstatsdAggregator struct {
+	extended bool
+
+	sync.Mutex
+	contexts map[string]*aggregated_context
+	// order keeps the contexts in the order they were first seen, so
+	// push_together samples are still sent next to each other.
+	order []string
+}
+
+type aggregated_context struct {
+	sample Sample
+	name   string
+	// count is the sum of the counts.
+	count int64
+	// members are a set's distinct members, in order.
+	members []string
+	seen    map[string]bool
+	// values are buffered histogram, timing and distribution values.
+	values []float64
+}
+
+func NewDogstatsdAggregator(extended bool) *DogstatsdAggregator {
+	return &DogstatsdAggregator{extended: extended, contexts: map[string]*aggregated_context{}}
+}
+
+// accepts is whether a sample is aggregated rather than sent straight away.
+func (aggregator *DogstatsdAggregator) accepts(sample Sample) bool {
+	if aggregator == nil || sample.sample_rate() < 1 {
+		return false
+	}
+	switch sample.Type {
+	case Gauge, Rate, Counter, CountPerRun, Set:
+		return true
+	case Histogram, Milliseconds, Distribution:
+		return aggregator.extended
+	}
+	return false
+}
+
+// Add aggregates a sample sent as name.
+func (aggregator *DogstatsdAggregator) Add(name string, sample Sample) {
+	key := name + "|" + sample.Type.String() + "|" + strings.Join(sample.Tags, ",")
+	aggregator.Lock()
+	defer aggregator.Unlock()
+	context, ok := aggregator.contexts[key]
+	if !ok {
+		context = &aggregated_context{name: name}
+		aggregator.contexts[key] = context
+		aggregator.order = append(aggregator.order, key)
+	}
+	// The last sample's value for gauges, and its query for accounting
+	context.sample = sample
+	switch sample.Type {
+	case Counter:
+		context.count += int64(sample.Value)
+	case CountPerRun:
+		context.count += rounded_count(sample.Value)
+	case Set:
+		member := sample.set_member()
+		if context.seen == nil {
+			context.seen = map[string]bool{}
+		}
+		if !context.seen[member] {
+			context.seen[member] = true
+			context.members = append(context.members, member)
+		}
+	case Histogram, Milliseconds, Distribution:
+		context.values = append(context.values, sample.Value)
+	}
+}
+
+// aggregated_datagram is a datagram for the agent and the query it's
+// accounted to.
+type aggregated_datagram struct {
+	query    string
+	datagram string
+}
+
+// Flush returns the datagrams for everything aggregated since the previous
+// flush and starts over.
+func (aggregator *DogstatsdAggregator) Flush(client *statsd.Client) []aggregated_datagram {
+	aggregator.Lock()
+	contexts, order := aggregator.contexts, aggregator.order
+	aggregator.contexts, aggregator.order = map[string]*aggregated_context{}, nil
+	aggregator.Unlock()
+
+	var datagrams []aggregated_datagram
+	add := func(context *aggregated_context, stat []byte) {
+		datagrams = append(datagrams, aggregated_datagram{
+			query:    context.sample.Query,
+			datagram: format_datagram(client, context.name, string(stat), 1, context.sample.Tags),
+		})
+	}
+	for _, key := range order {
+		context := contexts[key]
+		switch context.sample.Type {
+		case Gauge, Rate:
+			stat, _ := append_stat(nil, context.sample)
+			add(context, stat)
+		case Counter, CountPerRun:
+			add(context, append(strconv.AppendInt(nil, context.count, 10), "|c"...))
+		case Set:
+			for _, member := range context.members {
+				add(context, append([]byte(member), "|s"...))
+			}
+		case Histogram, Milliseconds, Distribution:
+			for _, stat := range multi_value_stats(context, client) {
+				add(context, stat)
+			}
+		}
+	}
+	return datagrams
+}
+
+// multi_value_stats packs a context's buffered values into as few stats as
+// fit in datagrams of statsd.OptimalPayloadSize.
+func multi_value_stats(context *aggregated_context, client *statsd.Client) [][]byte {
+	suffix := map[QueryType]string{Histogram: "|h", Milliseconds: "|ms", Distribution: "|d"}[context.sample.Type]
+	// Everything around the values
+	overhead := len(format_datagram(client, context.name, suffix, 1, context.sample.Tags))
+	var stats [][]byte
+	var stat []byte
+	for _, value := range context.values {
+		formatted := strconv.FormatFloat(value, 'f', 6, 64)
+		if len(stat) > 0 && overhead+len(stat)+len(":")+len(formatted) > statsd.OptimalPayloadSize {
+			stats = append(stats, append(stat, suffix...))
+			stat = nil
+		}
+		if len(stat) > 0 {
+			stat = append(stat, ':')
+		}
+		stat = append(stat, formatted...)
+	}
+	if len(stat) > 0 {
+		stats = append(stats, append(stat, suffix...))
+	}
+	return stats
+}
+
+// start_dogstatsd_aggregation flushes the sink's aggregates every interval,
+// in between the flushes at the end of every cycle, e.g. for keepalives.
+func start_dogstatsd_aggregation(sink *DogstatsdSink, interval time.Duration) {
+	go_background("dogstatsd_aggregation", func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopping:
+				return
+			case <-ticker.C:
+			}
+			if err := sink.flush_aggregates(); err != nil {
+				log_throttle.Printf("flush/"+error_class(err), "Failed to flush aggregated dogstatsd samples: %v", err)
+			}
+		}
+	})
+}
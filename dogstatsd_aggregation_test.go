@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+func TestDogstatsdAggregation(t *testing.T) {
+	client, err := statsd.New("127.0.0.1:8125")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var output bytes.Buffer
+	sink := NewDogstatsdSink(client, "prometheus", "")
+	sink.output = &output
+	sink.aggregator = NewDogstatsdAggregator(true)
+
+	samples := []Sample{
+		{Type: Gauge, Name: "temp", Value: 1, Tags: []string{"room:a"}},
+		{Type: Counter, Name: "requests", Value: 2, Tags: []string{"job:a"}},
+		{Type: Gauge, Name: "temp", Value: 3, Tags: []string{"room:a"}},
+		{Type: Counter, Name: "requests", Value: 5, Tags: []string{"job:a"}},
+		{Type: Histogram, Name: "latency", Value: 0.5},
+		{Type: Histogram, Name: "latency", Value: 1.5},
+		{Type: Gauge, Name: "sampled", Value: 7, SampleRate: 0.9999999},
+	}
+	for _, sample := range samples {
+		if err := sink.Push(sample); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := output.String(); !strings.HasPrefix(got, "prometheus.sampled:7") || strings.Count(got, "\n") != 1 {
+		t.Fatalf("before flushing sent %q, expected just the sampled gauge", got)
+	}
+	output.Reset()
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"prometheus.temp:3.000000|g|#room:a",
+		"prometheus.requests:7|c|#job:a",
+		"prometheus.latency:0.500000:1.500000|h",
+	}
+	if got := strings.Split(strings.TrimSpace(output.String()), "\n"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("flushed %q, expected %q", got, expected)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// PrintSink writes samples to an output instead of sending them, one per
+// line as name, type, value and comma separated tags, for -dry-run.
+type PrintSink struct {
+	output    io.Writer
+	namespace string
+
+	sync.Mutex
+}
+
+func NewPrintSink(output io.Writer, namespace string) *PrintSink {
+	return &PrintSink{output: output, namespace: namespace}
+}
+
+func (sink *PrintSink) Push(sample Sample) error {
+	value := strconv.FormatFloat(sample.Value, 'g', -1, 64)
+	if sample.Type == Set {
+		value = sample.set_member()
+	}
+	line := fmt.Sprintf("%v %v %v", sample.metric_name(sink.namespace), sample.Type, value)
+	if len(sample.Tags) > 0 {
+		line += " " + strings.Join(sample.Tags, ",")
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	_, err := io.WriteString(sink.output, line+"\n")
+	return err
+}
+
+func (sink *PrintSink) Event(event *statsd.Event) error {
+	line := fmt.Sprintf("event %q %v\n", event.Title, strings.Join(event.Tags, ","))
+	sink.Lock()
+	defer sink.Unlock()
+	_, err := io.WriteString(sink.output, line)
+	return err
+}
+
+func (sink *PrintSink) Flush() error {
+	return nil
+}
+
+func (sink *PrintSink) Close() error {
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// env_prefix is prepended to flag names to find their environment variables,
+// e.g. P2D_DOGSTATSD_ADDRESS for -dogstatsd-address.
+const env_prefix = "P2D_"
+
+// env_name returns the environment variable overriding a flag.
+func env_name(flag_name string) string {
+	return env_prefix + strings.ToUpper(strings.Replace(flag_name, "-", "_", -1))
+}
+
+// apply_env_overrides sets every flag which wasn't given on the command line
+// from its environment variable, if set. Command line flags win over the
+// environment, which wins over the defaults. Repeatable flags take a single
+// value from the environment.
+func apply_env_overrides(flags *pflag.FlagSet) error {
+	given := map[string]bool{}
+	flags.Visit(func(f *pflag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(env_name(f.Name))
+		if !ok {
+			return
+		}
+		if set_err := flags.Set(f.Name, value); set_err != nil {
+			err = fmt.Errorf("Invalid %v: %v", env_name(f.Name), set_err)
+		}
+	})
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/micktwomey/prometheus_to_datadog/tagformat"
+	"github.com/prometheus/common/model"
+)
+
+// ExemplarConfig links a query's samples to traces using the exemplars of
+// the series it reads, either as a tag on each sample or as separate
+// events.
+type ExemplarConfig struct {
+	// Mode is tags or events.
+	Mode string `yaml:"mode"`
+	// Label is the exemplar label holding the trace id, trace_id by default.
+	Label string `yaml:"label"`
+	// Window is how far back to look for exemplars, the query interval by
+	// default.
+	Window time.Duration `yaml:"window"`
+	// MaxEvents caps the events sent per run in events mode, 5 by default.
+	MaxEvents int `yaml:"max_events"`
+}
+
+type Exemplar struct {
+	Labels    map[string]string `json:"labels"`
+	Value     string            `json:"value"`
+	Timestamp float64           `json:"timestamp"`
+}
+
+type ExemplarSeries struct {
+	SeriesLabels map[string]string `json:"seriesLabels"`
+	Exemplars    []Exemplar        `json:"exemplars"`
+}
+
+func (config *ExemplarConfig) label() string {
+	if config.Label == "" {
+		return "trace_id"
+	}
+	return config.Label
+}
+
+func fetch_exemplars(address string, query string, start time.Time, end time.Time) ([]ExemplarSeries, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(start.Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix(), 10))
+
+	resp, err := prometheus_http_client.Get(strings.TrimRight(address, "/") + "/api/v1/query_exemplars?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string           `json:"status"`
+		Error  string           `json:"error"`
+		Data   []ExemplarSeries `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("Exemplar query failed: %v", result.Error)
+	}
+	return result.Data, nil
+}
+
+// latest_trace_id returns the newest trace id among the exemplars of the
+// series matching all of a sample's labels.
+func latest_trace_id(config *ExemplarConfig, series []ExemplarSeries, metric model.Metric) string {
+	var latest Exemplar
+	for _, candidate := range series {
+		matches := true
+		for label, value := range metric {
+			if label != model.MetricNameLabel && candidate.SeriesLabels[string(label)] != string(value) {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		for _, exemplar := range candidate.Exemplars {
+			if exemplar.Labels[config.label()] != "" && exemplar.Timestamp >= latest.Timestamp {
+				latest = exemplar
+			}
+		}
+	}
+	return latest.Labels[config.label()]
+}
+
+// exemplar_events turns the newest exemplars into correlation events.
+func exemplar_events(query Query, series []ExemplarSeries) []*statsd.Event {
+	max_events := query.Exemplars.MaxEvents
+	if max_events == 0 {
+		max_events = 5
+	}
+	var exemplars []Exemplar
+	for _, candidate := range series {
+		for _, exemplar := range candidate.Exemplars {
+			if exemplar.Labels[query.Exemplars.label()] != "" {
+				exemplars = append(exemplars, exemplar)
+			}
+		}
+	}
+	sort.Slice(exemplars, func(i, j int) bool { return exemplars[i].Timestamp < exemplars[j].Timestamp })
+
+	var events []*statsd.Event
+	for i := len(exemplars) - 1; i >= 0 && len(events) < max_events; i-- {
+		exemplar := exemplars[i]
+		trace_id := exemplar.Labels[query.Exemplars.label()]
+		event := statsd.NewEvent(
+			fmt.Sprintf("%v exemplar", query.Name),
+			fmt.Sprintf("Exemplar value %v for trace %v", exemplar.Value, trace_id),
+		)
+		event.Timestamp = time.Unix(int64(exemplar.Timestamp), 0)
+		event.AggregationKey = query.Name
+		event.Tags = []string{tagformat.Format("trace_id", trace_id), tagformat.Format("metric", query.Name)}
+		events = append(events, event)
+	}
+	return events
+}
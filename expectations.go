@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// Expectation asserts the range a query's values should be in, e.g.
+//
+//	expect: {min: 0, max: 1}
+//
+// catching broken exporters at the bridge rather than in dashboards.
+type Expectation struct {
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+	// OnFailure decides whether samples outside the range are pushed
+	// (default) or dropped.
+	OnFailure ExpectationPolicy `yaml:"on_failure"`
+	// Event also sends a Datadog event when samples are outside the range,
+	// at most once per -log-throttle-interval for each query.
+	Event bool `yaml:"event"`
+}
+
+type ExpectationPolicy string
+
+const (
+	ExpectationPush ExpectationPolicy = "push"
+	ExpectationDrop ExpectationPolicy = "drop"
+)
+
+func (policy *ExpectationPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	switch ExpectationPolicy(value) {
+	case "", ExpectationPush, ExpectationDrop:
+		*policy = ExpectationPolicy(value)
+		return nil
+	}
+	return fmt.Errorf("Can't handle expect on_failure %v (expected push or drop)", value)
+}
+
+func (expectation *Expectation) validate() error {
+	if expectation.Min == nil && expectation.Max == nil {
+		return fmt.Errorf("expect needs a min, a max or both")
+	}
+	if expectation.Min != nil && expectation.Max != nil && *expectation.Min > *expectation.Max {
+		return fmt.Errorf("expect min can't be above max")
+	}
+	return nil
+}
+
+// failed_bound returns the bound a value is outside of, min or max, or ""
+// if it's in range. NaN fails both, reported as min.
+func (expectation *Expectation) failed_bound(value float64) string {
+	if expectation.Min != nil && (value < *expectation.Min || math.IsNaN(value)) {
+		return "min"
+	}
+	if expectation.Max != nil && (value > *expectation.Max || math.IsNaN(value)) {
+		return "max"
+	}
+	return ""
+}
+
+func (expectation *Expectation) describe() string {
+	var bounds []string
+	if expectation.Min != nil {
+		bounds = append(bounds, fmt.Sprintf("min %v", *expectation.Min))
+	}
+	if expectation.Max != nil {
+		bounds = append(bounds, fmt.Sprintf("max %v", *expectation.Max))
+	}
+	return strings.Join(bounds, ", ")
+}
+
+// expectation_events holds when each query last sent an expectation event.
+var expectation_events = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: map[string]time.Time{}}
+
+func expectation_event_due(query_name string, now time.Time) bool {
+	expectation_events.Lock()
+	defer expectation_events.Unlock()
+	if last, ok := expectation_events.last[query_name]; ok && now.Sub(last) < *log_interval {
+		return false
+	}
+	expectation_events.last[query_name] = now
+	return true
+}
+
+func expectation_failed_event(query Query, sample Sample) *statsd.Event {
+	event := statsd.NewEvent(
+		fmt.Sprintf("prometheus_to_datadog: %v outside its expected range", query.Name),
+		fmt.Sprintf("%v{%v} was %v, expected %v.", sample.Name, strings.Join(sample.Tags, ","), sample.Value, query.Expect.describe()),
+	)
+	event.AlertType = statsd.Warning
+	event.AggregationKey = query.Name
+	event.Tags = []string{"query:" + query.Name}
+	return event
+}
+
+// check_expectation counts a sample outside its query's expected range,
+// returning false if it should be dropped.
+func check_expectation(query Query, sample Sample, sink Sink) bool {
+	bound := query.Expect.failed_bound(sample.Value)
+	if bound == "" {
+		return true
+	}
+	assertionFailures.WithLabelValues(query.Name, bound).Inc()
+	log_throttle.Printf(query.Name+"/expect", "%v{%v} from %v was %v, expected %v", sample.Name, strings.Join(sample.Tags, ","), query.Name, sample.Value, query.Expect.describe())
+	if query.Expect.Event && expectation_event_due(query.Name, time.Now()) {
+		if err := send_event(sink, expectation_failed_event(query, sample)); err != nil {
+			log.Printf("Failed to send expectation event for %v: %v", query.Name, err)
+		}
+	}
+	return query.Expect.OnFailure != ExpectationDrop
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// external_labels caches the external_labels of each Prometheus server by
+// address. Servers which couldn't be asked are tried again on the next run.
+var external_labels = struct {
+	sync.Mutex
+	by_address map[string]model.LabelSet
+}{by_address: map[string]model.LabelSet{}}
+
+// fetch_external_labels reads a server's external_labels from its loaded
+// configuration.
+func fetch_external_labels(address string) (model.LabelSet, error) {
+	resp, err := prometheus_http_client.Get(strings.TrimRight(address, "/") + "/api/v1/status/config")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			YAML string `json:"yaml"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("Config request failed: %v", result.Error)
+	}
+	var config struct {
+		Global struct {
+			ExternalLabels model.LabelSet `yaml:"external_labels"`
+		} `yaml:"global"`
+	}
+	if err := yaml.Unmarshal([]byte(result.Data.YAML), &config); err != nil {
+		return nil, fmt.Errorf("Can't parse the Prometheus config: %v", err)
+	}
+	if config.Global.ExternalLabels == nil {
+		return model.LabelSet{}, nil
+	}
+	return config.Global.ExternalLabels, nil
+}
+
+// add_external_labels adds the external_labels of the server at address to
+// every series which doesn't have a label of the same name already, as
+// Prometheus does for federation and remote write.
+func add_external_labels(vector model.Vector, address string) model.Vector {
+	external_labels.Lock()
+	labels, ok := external_labels.by_address[address]
+	external_labels.Unlock()
+	if !ok {
+		var err error
+		if labels, err = fetch_external_labels(address); err != nil {
+			log_throttle.Printf("external-labels/"+address, "Failed to fetch external labels from %v: %v", address, err)
+			return vector
+		}
+		external_labels.Lock()
+		external_labels.by_address[address] = labels
+		external_labels.Unlock()
+	}
+	if len(labels) == 0 {
+		return vector
+	}
+
+	labelled := make(model.Vector, 0, len(vector))
+	for _, sample := range vector {
+		copied := *sample
+		copied.Metric = sample.Metric.Clone()
+		for name, value := range labels {
+			if _, ok := copied.Metric[name]; !ok {
+				copied.Metric[name] = value
+			}
+		}
+		labelled = append(labelled, &copied)
+	}
+	return labelled
+}
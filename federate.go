@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+// Longest line of a /federate response, a series with many long labels
+const federate_max_line = 1024 * 1024
+
+// validate_federate checks a query's federate selectors, and that it doesn't
+// use options which need the whole result at once.
+func validate_federate(query Query) error {
+	if len(query.Federate) == 0 {
+		if query.FederateBatch != 0 {
+			return fmt.Errorf("federate_batch needs federate")
+		}
+		return nil
+	}
+	if query.Query != "" {
+		return fmt.Errorf("federate replaces query, give one or the other")
+	}
+	if query.FederateBatch < 0 {
+		return fmt.Errorf("federate_batch can't be negative")
+	}
+	for _, selector := range query.Federate {
+		if strings.TrimSpace(selector) == "" {
+			return fmt.Errorf("federate has an empty selector")
+		}
+	}
+	switch {
+	case query.Range > 0, len(query.Regions) > 0, query.KeepAlive > 0, query.Summary != nil, query.TagSampling != nil,
+		query.ChangeEvents != nil, query.Exemplars != nil, len(query.TimeShifts) > 0, query.MaxSamples > 0, query.PushTogether, query.SetLabel != "":
+		return fmt.Errorf("federate can't be used with range, regions, keepalive, summary, tag_sampling, change_events, exemplars, time_shifts, max_samples, push_together or set_label")
+	}
+	return nil
+}
+
+// federate_batches splits the selectors into the match[] sets of each
+// /federate request, one selector per request by default.
+func federate_batches(query Query) [][]string {
+	size := query.FederateBatch
+	if size <= 0 {
+		size = 1
+	}
+	var batches [][]string
+	for start := 0; start < len(query.Federate); start += size {
+		end := start + size
+		if end > len(query.Federate) {
+			end = len(query.Federate)
+		}
+		batches = append(batches, query.Federate[start:end])
+	}
+	return batches
+}
+
+// run_federate mirrors the series matching a query's federate selectors from
+// Prometheus' /federate endpoint, in a request per batch of selectors rather
+// than one for everything. Each response is pushed as it's read, so
+// thousands of series are never held at once. A batch failing part way is
+// retried once, skipping the series it already pushed (a series matched by
+// several batches is pushed once too), and batches failing again are
+// counted and logged while the others still push. The run only fails if
+// every batch did.
+func run_federate(ctx context.Context, query Query, when time.Time, sink Sink, policy TimeoutPolicy) error {
+	batches := federate_batches(query)
+	// The series pushed this run, by their exposition text
+	pushed := map[string]bool{}
+	current_series := SeriesSet{}
+	var failed int
+	var last error
+	for _, batch := range batches {
+		if ctx.Err() != nil {
+			return budget_exceeded(ctx, query, policy, len(pushed), len(pushed))
+		}
+		err := federate_batch(ctx, query, batch, when, sink, pushed, current_series)
+		if err != nil && ctx.Err() == nil {
+			federateBatches.WithLabelValues(query.Name, "retried").Inc()
+			err = federate_batch(ctx, query, batch, when, sink, pushed, current_series)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return budget_exceeded(ctx, query, policy, len(pushed), len(pushed))
+			}
+			federateBatches.WithLabelValues(query.Name, "failure").Inc()
+			log_throttle.Printf(query.Name+"/federate", "Federating %v for %v failed: %v", batch, query.Name, err)
+			failed++
+			last = err
+			continue
+		}
+		federateBatches.WithLabelValues(query.Name, "success").Inc()
+	}
+	debugf("Federate %v pushed %d series from %d batches, %d failed", query.Name, len(pushed), len(batches), failed)
+	if failed == len(batches) {
+		count_failed_query(query, query_error_class(last), last)
+		return fmt.Errorf("Every federate request of %v failed, the last with: %v", query.Name, last)
+	}
+	if len(pushed) == 0 {
+		return handle_empty_result(query, when, sink)
+	}
+
+	if query.Cumulative {
+		forget_counter_totals(query, current_series)
+	}
+	if query.ZeroFill {
+		return zero_fill_series(query, current_series, when, sink)
+	}
+	return nil
+}
+
+// federate_batch fetches one batch of selectors and pushes the series read
+// which aren't in pushed yet.
+func federate_batch(ctx context.Context, query Query, selectors []string, when time.Time, sink Sink, pushed map[string]bool, current_series SeriesSet) error {
+	params := url.Values{}
+	for _, selector := range selectors {
+		params.Add("match[]", selector)
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(*prometheus_addr, "/")+"/federate?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	resp, err := prometheus_http_client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		response, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Prometheus returned %d: %s", resp.StatusCode, strings.TrimSpace(string(response)))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), federate_max_line)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		series, metric, value, timestamp, err := parse_federate_line(line)
+		if err != nil {
+			return err
+		}
+		if pushed[series] {
+			continue
+		}
+		if timestamp.IsZero() {
+			timestamp = when
+		}
+		name, tags, keep, err := series_name_and_tags(query, metric)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			pushed[series] = true
+			continue
+		}
+		computed, err := render_tags(query, metric, value)
+		if err != nil {
+			return fmt.Errorf("Can't render tags for %v: %v", query.Name, err)
+		}
+		tags = append(tags, computed...)
+		if err := push_sample(query, Sample{Name: name, Value: value, Tags: tags, Timestamp: timestamp}, sink); err != nil {
+			return err
+		}
+		pushed[series] = true
+		current_series.Add(name, tags)
+	}
+	return scanner.Err()
+}
+
+// parse_federate_line parses a sample line of the Prometheus text format,
+// name{label="value",...} value [timestamp], returning the series part of
+// the line too.
+//
+// expfmt's TextParser isn't used as it decodes a whole response into metric
+// families before returning any, and a /federate response for a broad
+// selector can run to hundreds of megabytes, while this reads it a line at a
+// time (textparse, Prometheus' own streaming parser, isn't vendored). HELP
+// and TYPE lines are skipped by the caller: the query's type decides how the
+// samples are pushed.
+func parse_federate_line(line string) (string, model.Metric, float64, time.Time, error) {
+	var timestamp time.Time
+	series_end := strings.IndexAny(line, "{ ")
+	if series_end <= 0 || !model.IsValidMetricName(model.LabelValue(line[:series_end])) {
+		return "", nil, 0, timestamp, fmt.Errorf("Can't parse federated line %q", line)
+	}
+	metric := model.Metric{model.MetricNameLabel: model.LabelValue(line[:series_end])}
+	rest := line[series_end:]
+	if rest[0] == '{' {
+		rest = rest[1:]
+		for {
+			rest = strings.TrimLeft(rest, " ")
+			if rest == "" {
+				return "", nil, 0, timestamp, fmt.Errorf("Unterminated labels in federated line %q", line)
+			}
+			if rest[0] == '}' {
+				rest = rest[1:]
+				break
+			}
+			equals := strings.Index(rest, "=\"")
+			if equals <= 0 {
+				return "", nil, 0, timestamp, fmt.Errorf("Can't parse the labels of federated line %q", line)
+			}
+			label := model.LabelName(strings.TrimSpace(rest[:equals]))
+			if !label.IsValid() || label == model.MetricNameLabel {
+				return "", nil, 0, timestamp, fmt.Errorf("Invalid label %q in federated line %q", label, line)
+			}
+			if _, ok := metric[label]; ok {
+				return "", nil, 0, timestamp, fmt.Errorf("Duplicate label %v in federated line %q", label, line)
+			}
+			value, remainder, err := unquote_label_value(rest[equals+2:])
+			if err != nil {
+				return "", nil, 0, timestamp, fmt.Errorf("%v in federated line %q", err, line)
+			}
+			metric[label] = model.LabelValue(value)
+			// Labels are separated by commas, with one allowed after the last
+			rest = strings.TrimLeft(remainder, " ")
+			switch {
+			case strings.HasPrefix(rest, ","):
+				rest = rest[1:]
+			case !strings.HasPrefix(rest, "}"):
+				return "", nil, 0, timestamp, fmt.Errorf("Can't parse the labels of federated line %q", line)
+			}
+		}
+	}
+	series := line[:len(line)-len(rest)]
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", nil, 0, timestamp, fmt.Errorf("Can't parse the value of federated line %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, timestamp, fmt.Errorf("Can't parse the value of federated line %q: %v", line, err)
+	}
+	if len(fields) == 2 {
+		millis, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return "", nil, 0, timestamp, fmt.Errorf("Can't parse the timestamp of federated line %q: %v", line, err)
+		}
+		timestamp = time.Unix(0, millis*int64(time.Millisecond))
+	}
+	return series, metric, value, timestamp, nil
+}
+
+// unquote_label_value reads a label value up to its closing quote, undoing
+// the \\, \" and \n escapes (the only ones the text format has), returning
+// what follows the quote.
+func unquote_label_value(s string) (string, string, error) {
+	var value strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return value.String(), s[i+1:], nil
+		case '\\':
+			if i+1 == len(s) {
+				return "", "", fmt.Errorf("Unterminated escape")
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case '\\', '"':
+				value.WriteByte(s[i])
+			default:
+				return "", "", fmt.Errorf("Invalid escape \\%c", s[i])
+			}
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return "", "", fmt.Errorf("Unterminated label value")
+}
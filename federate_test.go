@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestRunFederate(t *testing.T) {
+	var lock sync.Mutex
+	requests := map[string]int{}
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selectors := r.URL.Query()["match[]"]
+		lock.Lock()
+		requests[strings.Join(selectors, ",")]++
+		attempt := requests[strings.Join(selectors, ",")]
+		lock.Unlock()
+		for _, selector := range selectors {
+			switch selector {
+			case "up":
+				fmt.Fprint(w, "# TYPE up untyped\n")
+				fmt.Fprint(w, "up{job=\"a\",zone=\"z1\"} 1 946684800000\n")
+				fmt.Fprint(w, "up{job=\"b\",zone=\"z\\\"2\\\"\"} 0 946684800000\n")
+			case "flaky":
+				fmt.Fprint(w, "flaky{job=\"a\"} 5 946684800000\n")
+				if attempt == 1 {
+					// Cut off part way through the response
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				fmt.Fprint(w, "flaky{job=\"b\"} 6 946684800000\n")
+			case "down":
+				http.Error(w, "overloaded", http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}))
+	defer prometheus.Close()
+	real_addr := *prometheus_addr
+	*prometheus_addr = prometheus.URL
+	defer func() { *prometheus_addr = real_addr }()
+
+	when := time.Unix(946684810, 0)
+	sink := &recording_sink{}
+	query := Query{Type: Gauge, Name: "mirror", Federate: []string{"up", "flaky", "down", "up"}}
+	if err := run_query(query, nil, when, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	var pushed []string
+	for _, sample := range sink.take() {
+		if !sample.Timestamp.Equal(time.Unix(946684800, 0)) {
+			t.Errorf("%v pushed at %v, expected its federated timestamp", sample.Name, sample.Timestamp)
+		}
+		pushed = append(pushed, fmt.Sprintf("%v %v %v", sample.Name, sample.Value, sample.Tags))
+	}
+	sort.Strings(pushed)
+	expected := []string{
+		"flaky 5 [job:a]",
+		"flaky 6 [job:b]",
+		"up 0 [job:b zone:z\"2\"]",
+		"up 1 [job:a zone:z1]",
+	}
+	if !reflect.DeepEqual(pushed, expected) {
+		t.Errorf("Pushed %q, expected %q", pushed, expected)
+	}
+	if requests["flaky"] != 2 || requests["down"] != 2 || requests["up"] != 2 {
+		t.Errorf("Requests %v, expected flaky and down retried once and up requested by both its batches", requests)
+	}
+
+	// Every batch failing fails the run
+	query.Federate = []string{"down"}
+	if err := run_query(query, nil, when, sink); err == nil {
+		t.Errorf("Expected the run to fail when every batch fails")
+	}
+}
+
+func TestFederateBatches(t *testing.T) {
+	query := Query{Federate: []string{"a", "b", "c", "d", "e"}, FederateBatch: 2}
+	expected := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	if batches := federate_batches(query); !reflect.DeepEqual(batches, expected) {
+		t.Errorf("Batches %v, expected %v", batches, expected)
+	}
+}
+
+func TestParseFederateLine(t *testing.T) {
+	series, metric, value, timestamp, err := parse_federate_line(`http_requests_total{path="/a,b",note="x\ny\\"} 12.5 1500`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := model.Metric{"__name__": "http_requests_total", "path": "/a,b", "note": "x\ny\\"}
+	if !reflect.DeepEqual(metric, expected) || value != 12.5 || !timestamp.Equal(time.Unix(1, 500*int64(time.Millisecond))) {
+		t.Errorf("Parsed %v %v %v, expected %v 12.5 at 1.5s", metric, value, timestamp, expected)
+	}
+	if series != `http_requests_total{path="/a,b",note="x\ny\\"}` {
+		t.Errorf("Series %q", series)
+	}
+
+	if _, _, value, timestamp, err = parse_federate_line("process_open_fds NaN"); err != nil || value == value || !timestamp.IsZero() {
+		t.Errorf("Expected NaN without a timestamp, got %v %v %v", value, timestamp, err)
+	}
+	// Escaped quotes, quoted braces and commas and a comma after the last label
+	_, metric, _, _, err = parse_federate_line(`up{a="say \"hi\"", b="}{,=\"" ,} 1`)
+	if expected := (model.Metric{"__name__": "up", "a": `say "hi"`, "b": `}{,="`}); err != nil || !reflect.DeepEqual(metric, expected) {
+		t.Errorf("Parsed %v (%v), expected %v", metric, err, expected)
+	}
+
+	for _, line := range []string{
+		`up{job="a" 1`, `up{job="a"}`, `{job="a"} 1`, `up 1 2 3`, `up x`, `up 1 x`, `1up 1`,
+		// Malformed labels
+		`up{a="b"c="d"} 1`, `up{,a="b"} 1`, `up{1a="b"} 1`, `up{a-b="c"} 1`, `up{a="b",a="c"} 1`, `up{__name__="x"} 1`,
+		// Malformed values
+		`up{a="\t"} 1`, `up{a="b} 1`, `up{a="b\`,
+	} {
+		if _, _, _, _, err := parse_federate_line(line); err == nil {
+			t.Errorf("Expected %q not to parse", line)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+// Fixtures are recorded /api/v1/query responses by query, written by
+// -record-fixtures and served back by -replay-fixtures and simulate.
+type Fixtures map[string][]fixture_response
+
+// fixture_response is a recorded /api/v1/query response body.
+type fixture_response struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Data      struct {
+		ResultType string       `json:"resultType"`
+		Result     model.Vector `json:"result"`
+	} `json:"data"`
+}
+
+func load_fixtures(path string) (Fixtures, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fixtures := Fixtures{}
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("Can't parse fixtures %v: %v", path, err)
+	}
+	for query, recorded := range fixtures {
+		if len(recorded) == 0 {
+			return nil, fmt.Errorf("No recorded responses for %v in %v", query, path)
+		}
+		for _, response := range recorded {
+			if response.Status == "success" && response.Data.ResultType != "vector" {
+				return nil, fmt.Errorf("Can't replay %v results for %v (expected vector)", response.Data.ResultType, query)
+			}
+		}
+	}
+	return fixtures, nil
+}
+
+// save writes the fixtures atomically.
+func (fixtures Fixtures) save(path string) error {
+	data, err := json.MarshalIndent(fixtures, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// FixtureQueryAPI answers queries from recorded responses: the nth run of a
+// query gets its nth recording, the last one repeating once they run out.
+// Sample timestamps are moved to the query time, as Prometheus would.
+type FixtureQueryAPI struct {
+	sync.Mutex
+	fixtures Fixtures
+	runs     map[string]int
+}
+
+func NewFixtureQueryAPI(path string) (*FixtureQueryAPI, error) {
+	fixtures, err := load_fixtures(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FixtureQueryAPI{fixtures: fixtures, runs: map[string]int{}}, nil
+}
+
+func (api *FixtureQueryAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	api.Lock()
+	defer api.Unlock()
+	recorded, ok := api.fixtures[query]
+	if !ok {
+		return nil, fmt.Errorf("No recorded response for %v", query)
+	}
+	run := api.runs[query]
+	api.runs[query]++
+	if run >= len(recorded) {
+		run = len(recorded) - 1
+	}
+	response := recorded[run]
+	if response.Status != "success" {
+		return nil, &prometheus.Error{Type: prometheus.ErrorType(response.ErrorType), Msg: response.Error}
+	}
+	vector := make(model.Vector, 0, len(response.Data.Result))
+	for _, sample := range response.Data.Result {
+		copied := *sample
+		copied.Timestamp = model.TimeFromUnixNano(ts.UnixNano())
+		vector = append(vector, &copied)
+	}
+	return vector, nil
+}
+
+func (api *FixtureQueryAPI) QueryRange(ctx context.Context, query string, r prometheus.Range) (model.Value, error) {
+	return nil, fmt.Errorf("Range queries can't be replayed")
+}
+
+// RecordingQueryAPI passes queries through to Prometheus, saving every
+// response (including errors) to a fixtures file after each query.
+type RecordingQueryAPI struct {
+	sync.Mutex
+	query_api prometheus.QueryAPI
+	path      string
+	fixtures  Fixtures
+}
+
+func NewRecordingQueryAPI(query_api prometheus.QueryAPI, path string) *RecordingQueryAPI {
+	return &RecordingQueryAPI{query_api: query_api, path: path, fixtures: Fixtures{}}
+}
+
+func (api *RecordingQueryAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	result, err := api.query_api.Query(ctx, query, ts)
+
+	var response fixture_response
+	switch {
+	case err != nil:
+		response.Status = "error"
+		response.Error = err.Error()
+		if api_err, ok := err.(*prometheus.Error); ok {
+			response.ErrorType = string(api_err.Type)
+			response.Error = api_err.Msg
+		}
+	case result.Type() == model.ValVector:
+		response.Status = "success"
+		response.Data.ResultType = result.Type().String()
+		response.Data.Result = result.(model.Vector)
+	default:
+		log_throttle.Printf("record/"+query, "Not recording %v result of %v", result.Type(), query)
+		return result, err
+	}
+
+	api.Lock()
+	defer api.Unlock()
+	api.fixtures[query] = append(api.fixtures[query], response)
+	if save_err := api.fixtures.save(api.path); save_err != nil {
+		log_throttle.Printf("record/"+error_class(save_err), "Failed to save fixtures to %v: %v", api.path, save_err)
+	}
+	return result, err
+}
+
+func (api *RecordingQueryAPI) QueryRange(ctx context.Context, query string, r prometheus.Range) (model.Value, error) {
+	return api.query_api.QueryRange(ctx, query, r)
+}
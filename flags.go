@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// repeatable_flags are the flags which can be given several times, their
+// Set adding to the value rather than replacing it. They take a list in the
+// -config file.
+var repeatable_flags = map[string]bool{}
+
+// repeatable_var defines a flag which can be given several times, see
+// repeatable_flags.
+func repeatable_var(value flag.Value, name string, usage string) {
+	flag.Var(value, name, usage)
+	repeatable_flags[name] = true
+}
+
+// parse_flags parses the command line with pflag, which takes the flags
+// defined with the flag package throughout the bridge with two dashes
+// (--interval=30). Long flags given with a single dash, as before pflag, are
+// rewritten to two dashes so existing command lines keep working. Flags not
+// given are then set from the environment and after that the -config file.
+func parse_flags(args []string) error {
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	// Stop at the command (once, backfill...), whose flags are its own
+	pflag.CommandLine.SetInterspersed(false)
+	pflag.CommandLine.Parse(double_dash_flags(pflag.CommandLine, args))
+	if err := apply_env_overrides(pflag.CommandLine); err != nil {
+		return err
+	}
+	if *config_path == "" {
+		return nil
+	}
+	return apply_config_file(pflag.CommandLine, *config_path, repeatable_flags)
+}
+
+// double_dash_flags rewrites -name and -name=value to --name and
+// --name=value, up to the first argument which isn't a flag or its value.
+// Single letters are left alone, pflag reads them as shorthands (e.g. -h).
+func double_dash_flags(flags *pflag.FlagSet, args []string) []string {
+	rewritten := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			return append(rewritten, args[i:]...)
+		}
+		name := strings.TrimPrefix(arg[1:], "-")
+		if arg[1] != '-' && len(name) > 1 {
+			arg = "-" + arg
+		}
+		rewritten = append(rewritten, arg)
+		parts := strings.SplitN(name, "=", 2)
+		f := flags.Lookup(parts[0])
+		if f != nil && len(parts) == 1 && f.NoOptDefVal == "" && i+1 < len(args) {
+			// The value is the next argument
+			i++
+			rewritten = append(rewritten, args[i])
+		}
+	}
+	return rewritten
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestDoubleDashFlags(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("query-file", "", "")
+	flags.Bool("dry-run", false, "")
+	args := []string{"-query-file", "-", "-dry-run", "--interval=30", "-h", "backfill", "-start", "2000-01-01T00:00:00Z"}
+	expected := []string{"--query-file", "-", "--dry-run", "--interval=30", "-h", "backfill", "-start", "2000-01-01T00:00:00Z"}
+	if got := double_dash_flags(flags, args); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
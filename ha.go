@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// The keys of the HA pair's state in the -ha-state-store
+const (
+	ha_lease_key  = "leader"
+	ha_totals_key = "counter_totals"
+)
+
+// ha_lease is who leads the HA pair until when. The term counts the
+// leaderships.
+type ha_lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+	Term    uint64    `json:"term"`
+}
+
+// ha_checkpoint is the counter totals of the cumulative queries as of the
+// last cycle a leader completed.
+type ha_checkpoint struct {
+	Holder string                         `json:"holder"`
+	Term   uint64                         `json:"term"`
+	Totals map[string]map[string]ha_total `json:"totals"`
+}
+
+type ha_total struct {
+	Value float64   `json:"value"`
+	At    time.Time `json:"at"`
+}
+
+// LeaderElection runs a pair (or more) of bridges sharing a StateStore as
+// an HA pair: they compete for a lease and only the leader runs cycles. The
+// leader checkpoints the totals of the cumulative queries (delta mode) after
+// every cycle, with writes fenced by its lease so a bridge which stalled
+// past its lease can't overwrite a newer checkpoint, and a new leader
+// restores them before its first cycle. A failover then neither resends an
+// increase the old leader sent nor loses the increase since, the new
+// leader's first deltas pick up from the old leader's last totals.
+//
+// A leader only starts cycles with at least half a lease left, so with a
+// lease over twice the longest cycle the two never push at once.
+type LeaderElection struct {
+	store StateStore
+	id    string
+	lease time.Duration
+
+	sync.Mutex
+	term uint64
+	// lease_version is the store's version of our lease, which the
+	// checkpoint writes check.
+	lease_version uint64
+	// until is when our lease lapses, zero while standing by.
+	until time.Time
+	// restored is whether this term's leader restored the checkpoint.
+	restored bool
+}
+
+func NewLeaderElection(store StateStore, id string, lease time.Duration) *LeaderElection {
+	return &LeaderElection{store: store, id: id, lease: lease}
+}
+
+// Campaign acquires the lease once the current one lapsed, or renews ours.
+// Returns whether this bridge leads.
+func (election *LeaderElection) Campaign(now time.Time) (bool, error) {
+	election.Lock()
+	defer election.Unlock()
+	data, version, err := election.store.Get(ha_lease_key)
+	if err != nil {
+		// Our lease is still ours until it lapses
+		return election.leading(now), err
+	}
+	var current ha_lease
+	if version > 0 {
+		if err := json.Unmarshal(data, &current); err != nil {
+			return election.leading(now), err
+		}
+	}
+	renewing := !election.until.IsZero() && version == election.lease_version
+	if !renewing && version > 0 && now.Before(current.Expires) {
+		// Someone else's lease, or ours from before a restart
+		election.step_down()
+		return false, nil
+	}
+	next := ha_lease{Holder: election.id, Expires: now.Add(election.lease), Term: current.Term}
+	if !renewing {
+		next.Term++
+	}
+	encoded, err := json.Marshal(next)
+	if err != nil {
+		return election.leading(now), err
+	}
+	next_version, ok, err := election.store.Put(ha_lease_key, encoded, ha_lease_key, version)
+	if err != nil {
+		return election.leading(now), err
+	}
+	if !ok {
+		election.step_down()
+		return false, nil
+	}
+	if !renewing {
+		log.Printf("Leading the HA pair as %v (term %d)", election.id, next.Term)
+		election.term, election.restored = next.Term, false
+		haLeaderChanges.Inc()
+	}
+	election.lease_version, election.until = next_version, next.Expires
+	haLeader.Set(1)
+	return true, nil
+}
+
+// Leading is whether this bridge leads with enough of the lease left to run
+// a cycle.
+func (election *LeaderElection) Leading(now time.Time) bool {
+	election.Lock()
+	defer election.Unlock()
+	return election.leading(now)
+}
+
+func (election *LeaderElection) leading(now time.Time) bool {
+	return !election.until.IsZero() && election.until.Sub(now) > election.lease/2
+}
+
+// step_down stands by, with election locked.
+func (election *LeaderElection) step_down() {
+	if !election.until.IsZero() {
+		log.Printf("No longer leading the HA pair (term %d)", election.term)
+	}
+	election.until = time.Time{}
+	haLeader.Set(0)
+}
+
+// Restore replaces the counter totals with the checkpoint, once per term
+// before its first cycle: the totals this bridge kept from an earlier term
+// are stale if the other bridge led since.
+func (election *LeaderElection) Restore() error {
+	election.Lock()
+	defer election.Unlock()
+	if election.restored {
+		return nil
+	}
+	data, version, err := election.store.Get(ha_totals_key)
+	if err != nil {
+		return err
+	}
+	var checkpoint ha_checkpoint
+	if version > 0 {
+		if err := json.Unmarshal(data, &checkpoint); err != nil {
+			return err
+		}
+	}
+	totals := map[string]map[string]counter_total{}
+	for query, series := range checkpoint.Totals {
+		totals[query] = make(map[string]counter_total, len(series))
+		for key, total := range series {
+			totals[query][key] = counter_total{value: total.Value, at: total.At}
+		}
+	}
+	counter_totals.Lock()
+	counter_totals.by_query = totals
+	counter_totals.Unlock()
+	election.restored = true
+	if version > 0 {
+		log.Printf("Restored the totals of %d cumulative queries checkpointed by %v (term %d)", len(totals), checkpoint.Holder, checkpoint.Term)
+	}
+	return nil
+}
+
+// Checkpoint saves the counter totals after a cycle. If the lease moved on
+// in the meantime the checkpoint isn't saved, the new leader's totals win,
+// and this bridge stands by.
+func (election *LeaderElection) Checkpoint() error {
+	election.Lock()
+	defer election.Unlock()
+	if election.until.IsZero() || !election.restored {
+		return nil
+	}
+	checkpoint := ha_checkpoint{Holder: election.id, Term: election.term, Totals: map[string]map[string]ha_total{}}
+	counter_totals.Lock()
+	for query, series := range counter_totals.by_query {
+		checkpoint.Totals[query] = make(map[string]ha_total, len(series))
+		for key, total := range series {
+			checkpoint.Totals[query][key] = ha_total{Value: total.value, At: total.at}
+		}
+	}
+	counter_totals.Unlock()
+	encoded, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	_, ok, err := election.store.Put(ha_totals_key, encoded, ha_lease_key, election.lease_version)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		election.step_down()
+		return fmt.Errorf("Lost the HA lease, the totals of term %d weren't checkpointed", election.term)
+	}
+	haCheckpoints.Inc()
+	return nil
+}
+
+// Release ends our lease when shutting down, after the last cycle's
+// checkpoint, so the other bridge takes over without waiting for it to
+// lapse.
+func (election *LeaderElection) Release() {
+	election.Lock()
+	defer election.Unlock()
+	if election.until.IsZero() {
+		return
+	}
+	// A lease without an expiry has lapsed
+	encoded, err := json.Marshal(ha_lease{Holder: election.id, Term: election.term})
+	if err == nil {
+		_, _, err = election.store.Put(ha_lease_key, encoded, ha_lease_key, election.lease_version)
+	}
+	if err != nil {
+		log.Printf("Failed to release the HA lease: %v", err)
+	}
+	election.step_down()
+}
+
+// start_leader_election campaigns every third of the lease until stopping.
+func start_leader_election(election *LeaderElection) {
+	go_background("leader_election", func() {
+		ticker := time.NewTicker(election.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopping:
+				return
+			case <-ticker.C:
+			}
+			if _, err := election.Campaign(time.Now()); err != nil {
+				log_throttle.Printf("ha/"+error_class(err), "Failed to campaign for the HA lease: %v", err)
+			}
+		}
+	})
+}
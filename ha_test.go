@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fake_consul serves the KV and transaction endpoints of Consul the
+// ConsulStateStore uses.
+type fake_consul struct {
+	sync.Mutex
+	index   uint64
+	entries map[string]consul_kv
+}
+
+func (consul *fake_consul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	consul.Lock()
+	defer consul.Unlock()
+	if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/kv/") {
+		entry, ok := consul.entries[strings.TrimPrefix(r.URL.Path, "/v1/kv/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]consul_kv{entry})
+		return
+	}
+	if r.Method != "PUT" || r.URL.Path != "/v1/txn" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	var operations []struct {
+		KV struct {
+			Verb  string
+			Key   string
+			Index uint64
+			Value string
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&operations); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var results []map[string]consul_kv
+	for _, operation := range operations {
+		entry, exists := consul.entries[operation.KV.Key]
+		switch operation.KV.Verb {
+		case "check-index":
+			if !exists || entry.ModifyIndex != operation.KV.Index {
+				http.Error(w, `{"Errors":[{"OpIndex":0,"What":"index check failed"}]}`, http.StatusConflict)
+				return
+			}
+			results = append(results, map[string]consul_kv{"KV": entry})
+		case "check-not-exists":
+			if exists {
+				http.Error(w, `{"Errors":[{"OpIndex":0,"What":"key exists"}]}`, http.StatusConflict)
+				return
+			}
+		}
+	}
+	for _, operation := range operations {
+		if operation.KV.Verb != "set" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(operation.KV.Value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		consul.index++
+		entry := consul_kv{Key: operation.KV.Key, Value: value, ModifyIndex: consul.index}
+		consul.entries[operation.KV.Key] = entry
+		results = append(results, map[string]consul_kv{"KV": {Key: entry.Key, ModifyIndex: entry.ModifyIndex}})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"Results": results})
+}
+
+func TestLeaderElectionFailover(t *testing.T) {
+	consul := httptest.NewServer(&fake_consul{entries: map[string]consul_kv{}})
+	defer consul.Close()
+	file_store, err := NewFileStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]StateStore{
+		"file":   file_store,
+		"consul": NewConsulStateStore(consul.URL+"/bridges/payments", "", http.DefaultClient),
+	}
+
+	real_totals := counter_totals.by_query
+	defer func() { counter_totals.by_query = real_totals }()
+
+	for name, store := range stores {
+		now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		a := NewLeaderElection(store, "a", 30*time.Second)
+		b := NewLeaderElection(store, "b", 30*time.Second)
+		if leading, err := a.Campaign(now); !leading || err != nil {
+			t.Fatalf("%v: a didn't lead: %v", name, err)
+		}
+		if leading, err := b.Campaign(now); leading || err != nil {
+			t.Fatalf("%v: b led alongside a: %v", name, err)
+		}
+
+		// a runs a cycle and checkpoints its totals
+		if err := a.Restore(); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		counter_totals.by_query = map[string]map[string]counter_total{"requests": {"requests|job:api": {value: 42, at: now}}}
+		if err := a.Checkpoint(); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if leading, err := a.Campaign(now.Add(10 * time.Second)); !leading || err != nil {
+			t.Fatalf("%v: a didn't renew its lease: %v", name, err)
+		}
+		if !a.Leading(now.Add(20*time.Second)) || a.Leading(now.Add(30*time.Second)) {
+			t.Errorf("%v: a should only start cycles with half of its lease left", name)
+		}
+
+		// a stalls, b takes over once a's lease lapsed
+		if leading, _ := b.Campaign(now.Add(35 * time.Second)); leading {
+			t.Fatalf("%v: b took over before a's renewed lease lapsed", name)
+		}
+		if leading, err := b.Campaign(now.Add(41 * time.Second)); !leading || err != nil {
+			t.Fatalf("%v: b didn't take over: %v", name, err)
+		}
+		// a's late checkpoint is fenced off
+		counter_totals.by_query = map[string]map[string]counter_total{"requests": {"requests|job:api": {value: 50, at: now}}}
+		if err := a.Checkpoint(); err == nil {
+			t.Errorf("%v: a checkpointed after losing its lease", name)
+		}
+		if a.Leading(now.Add(41 * time.Second)) {
+			t.Errorf("%v: a still leads after losing its lease", name)
+		}
+
+		// b picks up from a's last checkpoint
+		counter_totals.by_query = map[string]map[string]counter_total{}
+		if err := b.Restore(); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if total := counter_totals.by_query["requests"]["requests|job:api"]; total.value != 42 || !total.at.Equal(now) {
+			t.Errorf("%v: b restored %+v, expected a's checkpointed total of 42", name, total)
+		}
+		if b.term != 2 {
+			t.Errorf("%v: b leads term %d, expected 2", name, b.term)
+		}
+
+		// b shuts down and hands over straight away
+		b.Release()
+		if leading, err := a.Campaign(now.Add(42 * time.Second)); !leading || err != nil {
+			t.Errorf("%v: a didn't take over after b released its lease: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/prometheus/client_golang/api/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+// Benchmarks for the per sample path, which runs for every series of every
+// query each cycle. Compare allocations with:
+//
+//	go test -run - -bench . -benchmem
+
+// vector_query_api answers every instant query with the same vector.
+type vector_query_api struct {
+	vector model.Vector
+}
+
+func (api vector_query_api) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	return api.vector, nil
+}
+
+func (api vector_query_api) QueryRange(ctx context.Context, query string, r prometheus.Range) (model.Value, error) {
+	return nil, fmt.Errorf("Range queries aren't supported")
+}
+
+// fixture_vector is a result of n series with the labels of a typical
+// kubernetes workload.
+func fixture_vector(n int, when time.Time) model.Vector {
+	vector := make(model.Vector, 0, n)
+	for i := 0; i < n; i++ {
+		vector = append(vector, &model.Sample{
+			Metric: model.Metric{
+				"__name__":  "http_requests_total",
+				"job":       "api",
+				"namespace": "payments",
+				"pod":       model.LabelValue(fmt.Sprintf("api-7d9f8b6c5-%05d", i)),
+				"zone":      model.LabelValue(fmt.Sprintf("eu-west-1%c", 'a'+i%3)),
+				"code":      model.LabelValue(fmt.Sprintf("%d", 200+i%5)),
+				"method":    "GET",
+			},
+			Value:     model.SampleValue(i) * 1.5,
+			Timestamp: model.TimeFromUnixNano(when.UnixNano()),
+		})
+	}
+	return vector
+}
+
+func BenchmarkSeriesKey(b *testing.B) {
+	tags := []string{"job:api", "namespace:payments", "pod:api-7d9f8b6c5-00042", "zone:eu-west-1a", "code:200", "method:GET"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		series_key("http.requests", tags)
+	}
+}
+
+func BenchmarkAppendStat(b *testing.B) {
+	sample := Sample{Type: Gauge, Value: 1234.5678}
+	var stat []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		stat, _ = append_stat(stat[:0], sample)
+	}
+}
+
+func BenchmarkRunQuery(b *testing.B) {
+	client, err := statsd.New("127.0.0.1:8125")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	sink := NewDogstatsdSink(client, "prometheus", "")
+	sink.output = ioutil.Discard
+
+	when := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	query_api := vector_query_api{vector: fixture_vector(1000, when)}
+	query := Query{Type: Gauge, Name: "http.requests", Query: "http_requests_total", Tags: []string{"team:payments", "shard:{{.labels.zone}}"}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := run_query(query, query_api, when, sink); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HTTPAuth guards the admin HTTP endpoints (everything but /metrics, which
+// Prometheus scrapes). A request passing any configured check is let
+// through. With none configured every request is refused, unless Insecure
+// lets them all through.
+type HTTPAuth struct {
+	// Token is a static bearer token.
+	Token string
+	// User and Password are basic auth credentials.
+	User     string
+	Password string
+	// ClientCerts lets through requests with a TLS client certificate
+	// verified against -http-tls-client-ca-file.
+	ClientCerts bool
+	// Insecure serves without authentication when no check is configured,
+	// over -admin-insecure.
+	Insecure bool
+}
+
+// NewHTTPAuth builds the auth from the -http-* flags and -admin-insecure.
+func NewHTTPAuth(token string, basic string, client_ca_file string, insecure bool) (HTTPAuth, error) {
+	auth := HTTPAuth{Token: token, ClientCerts: client_ca_file != "", Insecure: insecure}
+	if basic != "" {
+		parts := strings.SplitN(basic, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return auth, fmt.Errorf("-http-basic-auth must be in the form user:password")
+		}
+		auth.User, auth.Password = parts[0], parts[1]
+	}
+	return auth, nil
+}
+
+func (auth HTTPAuth) enabled() bool {
+	return auth.Token != "" || auth.User != "" || auth.ClientCerts
+}
+
+// open is whether the endpoints are served without authentication.
+func (auth HTTPAuth) open() bool {
+	return !auth.enabled() && auth.Insecure
+}
+
+// equal compares secrets in constant time.
+func equal(given string, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// credentials_allowed checks a token or basic auth credentials, for the
+// HTTP endpoints and the admin API alike.
+func (auth HTTPAuth) credentials_allowed(token string, user string, password string) bool {
+	if auth.Token != "" && token != "" && equal(token, auth.Token) {
+		return true
+	}
+	return auth.User != "" && user != "" && equal(user, auth.User) && equal(password, auth.Password)
+}
+
+// client_cert_allowed checks the connection presented a verified client
+// certificate.
+func (auth HTTPAuth) client_cert_allowed(state *tls.ConnectionState) bool {
+	return auth.ClientCerts && state != nil && len(state.VerifiedChains) > 0
+}
+
+// parse_authorization returns the bearer token or basic auth credentials
+// of an Authorization header (or the authorization metadata of a gRPC call).
+func parse_authorization(header string) (token string, user string, password string) {
+	switch {
+	case strings.HasPrefix(header, "Bearer "):
+		token = strings.TrimPrefix(header, "Bearer ")
+	case strings.HasPrefix(header, "Basic "):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+		if err != nil {
+			return
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) == 2 {
+			user, password = parts[0], parts[1]
+		}
+	}
+	return
+}
+
+func (auth HTTPAuth) allowed(r *http.Request) bool {
+	token, user, password := parse_authorization(r.Header.Get("Authorization"))
+	return auth.credentials_allowed(token, user, password) || auth.client_cert_allowed(r.TLS)
+}
+
+// Wrap returns handler behind the auth checks, answering 401 to requests
+// failing them, or 403 to every request when no check is configured.
+func (auth HTTPAuth) Wrap(handler http.Handler) http.Handler {
+	if auth.open() {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.enabled() {
+			rejectedHTTPRequests.WithLabelValues(r.URL.Path).Inc()
+			http.Error(w, "Forbidden, configure -http-auth-token, -http-basic-auth or -http-tls-client-ca-file, or -admin-insecure", http.StatusForbidden)
+			return
+		}
+		if !auth.allowed(r) {
+			rejectedHTTPRequests.WithLabelValues(r.URL.Path).Inc()
+			if auth.User != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="prometheus_to_datadog"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// TLSServerFiles are the files used to build a TLS server configuration.
+type TLSServerFiles struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile verifies client certificates, which are then asked for
+	// but not required: the HTTP endpoints check them per request.
+	ClientCAFile string
+}
+
+// server_tls_config returns nil when no certificate is set, serving plain
+// HTTP.
+func server_tls_config(files TLSServerFiles) (*tls.Config, error) {
+	if files.CertFile == "" && files.KeyFile == "" {
+		if files.ClientCAFile != "" {
+			return nil, fmt.Errorf("-http-tls-client-ca-file needs -http-tls-cert-file and -http-tls-key-file")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if files.ClientCAFile != "" {
+		client_cas, err := load_cert_pool(files.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = client_cas
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// InstrumentedTransport records the count, status and duration of outbound
+// requests, so network problems can be told apart from query errors.
+type InstrumentedTransport struct {
+	client string
+	next   http.RoundTripper
+}
+
+func NewInstrumentedTransport(client string, next http.RoundTripper) *InstrumentedTransport {
+	return &InstrumentedTransport{client: client, next: next}
+}
+
+func (transport *InstrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := transport.next.RoundTrip(req)
+	httpClientDuration.WithLabelValues(transport.client).Observe(time.Since(start).Seconds())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	httpClientRequests.WithLabelValues(transport.client, req.Method, code).Inc()
+	return resp, err
+}
+
+// CancelRequest lets the Prometheus client cancel requests through the
+// wrapper.
+func (transport *InstrumentedTransport) CancelRequest(req *http.Request) {
+	if canceler, ok := transport.next.(interface {
+		CancelRequest(*http.Request)
+	}); ok {
+		canceler.CancelRequest(req)
+	}
+}
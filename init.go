@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	init_env_file   = "prometheus_to_datadog.env"
+	init_query_file = "queries.yaml"
+	// init_plain_chars are left unquoted in the environment file.
+	init_plain_chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.,/:_-+@%="
+)
+
+// init_queries is the example query file written by init, with one query of
+// each supported type (sets aren't supported).
+const init_queries = `# Queries pushed to Datadog, see the Query file section of the README for
+# every option. Check changes with:
+#
+#   prometheus_to_datadog -query-file queries.yaml validate
+
+# gauge: the last value of each flush interval is kept, for levels and rates.
+- name: http.requests
+  type: gauge
+  query: sum by (job) (rate(http_requests_total[1m]))
+
+# counter: the value is truncated to an integer and added up by Datadog,
+# cumulative totals need cumulative: true to send the increase instead.
+- name: deploys.recent
+  type: counter
+  query: sum(changes(process_start_time_seconds[1m]))
+
+# rate: a per-second rate, a Datadog rate with -sink api (a gauge over
+# dogstatsd). cumulative: true computes it from successive totals.
+- name: http.bytes
+  type: rate
+  query: sum by (job) (http_response_size_bytes_sum)
+  cumulative: true
+
+# count_per_run: "this many things happened since the last run", sent as a
+# count exactly once per interval.
+- name: http.errors
+  type: count_per_run
+  query: sum by (job) (increase(http_requests_total{code=~"5.."}[10s]))
+
+# set: the agent counts the distinct members, here the values of the user
+# label.
+- name: http.users
+  type: set
+  query: count by (user) (http_requests_total)
+  set_label: user
+
+# histogram: aggregated by the agent into .avg, .max, .count etc.
+- name: queue.depth
+  type: histogram
+  query: sum by (queue) (queue_length)
+
+# distribution: aggregated by Datadog across hosts, for global percentiles.
+- name: http.request.size
+  type: distribution
+  query: sum by (job) (rate(http_request_size_bytes_sum[1m])) / sum by (job) (rate(http_request_size_bytes_count[1m]))
+
+# milliseconds: sent as a timing, or as a histogram or distribution with
+# timing.as.
+- name: http.latency.p99
+  type: milliseconds
+  query: histogram_quantile(0.99, sum by (le) (rate(http_request_duration_seconds_bucket[1m]))) * 1000
+  timing:
+    as: distribution
+    aggregates: [max, avg, p95]
+`
+
+// init_env writes every flag as a commented out environment variable with
+// its default value and usage.
+func init_env() []byte {
+	var out bytes.Buffer
+	out.WriteString("# Settings of prometheus_to_datadog as environment variables, uncomment and\n")
+	out.WriteString("# change the ones you need. Command line flags win over the environment.\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&out, "\n# -%v: %v\n", f.Name, f.Usage)
+		value := f.DefValue
+		if repeatable_flags[f.Name] {
+			// Repeatable flags take a single value from the environment
+			// and their defaults aren't values.
+			value = ""
+		} else if strings.Trim(value, init_plain_chars) != "" {
+			value = "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+		}
+		if f.Name == "query-file" {
+			value = init_query_file
+		}
+		fmt.Fprintf(&out, "# %v=%v\n", env_name(f.Name), value)
+	})
+	return out.Bytes()
+}
+
+// run_init writes a starter environment file and example query file to the
+// directory given (the current one by default), returning the exit status.
+// Existing files are left alone.
+func run_init(args []string) int {
+	dir := "."
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "init takes at most one argument, the directory to write to")
+		return 2
+	}
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{init_env_file, init_env()},
+		{init_query_file, []byte(init_queries)},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if _, err := os.Stat(path); err == nil {
+			fmt.Fprintf(os.Stderr, "%v already exists, not overwriting it\n", path)
+			return 1
+		}
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := ioutil.WriteFile(path, file.content, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't write %v: %v\n", path, err)
+			return 1
+		}
+		fmt.Printf("Wrote %v\n", path)
+	}
+	return 0
+}
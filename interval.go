@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Interval is the query interval flag, a Go duration (30s, 2m, 1h) or, as it
+// used to be, a plain number of seconds.
+type Interval time.Duration
+
+func (flag *Interval) String() string {
+	return time.Duration(*flag).String()
+}
+
+func (flag *Interval) Set(value string) error {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		*flag = Interval(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("Interval must be a duration such as 30s or a number of seconds (%v)", value)
+	}
+	*flag = Interval(duration)
+	return nil
+}
+
+// range_selector formats a duration for a PromQL range selector, e.g. 30s.
+func range_selector(duration time.Duration) string {
+	if duration%time.Second == 0 {
+		return fmt.Sprintf("%ds", duration/time.Second)
+	}
+	return fmt.Sprintf("%dms", duration/time.Millisecond)
+}
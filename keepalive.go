@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const keepalive_check_interval = time.Second
+
+// KeepAlive re-pushes the last value of gauges between query runs, so that
+// queries with long intervals don't trip Datadog "no data" monitors.
+type KeepAlive struct {
+	sync.Mutex
+	// adaptive is the cycle interval, which the queries without their own
+	// interval run at.
+	adaptive *AdaptiveInterval
+	entries  map[string]*keepalive_entry
+}
+
+type keepalive_entry struct {
+	query   Query
+	samples []Sample
+	// expires stops re-pushing values from a query which stopped
+	// succeeding, two of its intervals after it last did.
+	expires     time.Time
+	last_pushed time.Time
+}
+
+func NewKeepAlive(adaptive *AdaptiveInterval) *KeepAlive {
+	return &KeepAlive{adaptive: adaptive, entries: map[string]*keepalive_entry{}}
+}
+
+// Update replaces the samples re-pushed for a query after it ran.
+func (keepalive *KeepAlive) Update(query Query, samples []Sample, now time.Time) {
+	if keepalive == nil {
+		return
+	}
+	keepalive.Lock()
+	defer keepalive.Unlock()
+	expires := now.Add(2 * query_interval(query, keepalive.adaptive.Current()))
+	keepalive.entries[query.Name] = &keepalive_entry{query: query, samples: samples, expires: expires, last_pushed: now}
+}
+
+// Due returns the samples which need re-pushing now.
+func (keepalive *KeepAlive) Due(now time.Time) map[string][]Sample {
+	keepalive.Lock()
+	defer keepalive.Unlock()
+	due := map[string][]Sample{}
+	for name, entry := range keepalive.entries {
+		if now.After(entry.expires) {
+			delete(keepalive.entries, name)
+			continue
+		}
+		// Allow for the check ticking slightly before the value is due
+		if now.Sub(entry.last_pushed) < entry.query.KeepAlive-keepalive_check_interval/2 {
+			continue
+		}
+		entry.last_pushed = now
+		due[name] = entry.samples
+	}
+	return due
+}
+
+func start_keepalive(keepalive *KeepAlive, query_set *QuerySet, sink Sink) {
+	go_background("keepalive", func() {
+		ticker := time.NewTicker(keepalive_check_interval)
+		defer ticker.Stop()
+		for {
+			var now time.Time
+			select {
+			case <-stopping:
+				return
+			case now = <-ticker.C:
+			}
+			due := keepalive.Due(now)
+			if len(due) == 0 {
+				continue
+			}
+			for name, samples := range due {
+				query, ok := query_set.Find(name)
+				if !ok || query_set.Muted(name, now) {
+					continue
+				}
+				for _, sample := range samples {
+					sample.Timestamp = now
+					if err := push_sample(query, sample, sink); err != nil {
+						log_throttle.Printf(name+"/keepalive", "Failed to re-push %v: %v", name, err)
+						break
+					}
+					keepaliveSamples.WithLabelValues(name).Inc()
+				}
+			}
+			if err := sink.Flush(); err != nil {
+				log_throttle.Printf("flush/"+error_class(err), "Failed to flush sink: %v", err)
+			}
+		}
+	})
+}
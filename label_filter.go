@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+)
+
+// keep_label is whether a Prometheus label becomes a tag under a query's
+// include_labels and exclude_labels, e.g. to leave out high cardinality
+// labels like instance or pod.
+func keep_label(query Query, label string) bool {
+	if len(query.IncludeLabels) > 0 {
+		return contains_label(query.IncludeLabels, label)
+	}
+	return !contains_label(query.ExcludeLabels, label)
+}
+
+func contains_label(labels []string, label string) bool {
+	for _, candidate := range labels {
+		if candidate == label {
+			return true
+		}
+	}
+	return false
+}
+
+// missing_required_label returns the first of a query's require_labels a
+// series lacks (or has empty), "" if it has them all.
+func missing_required_label(query Query, metric model.Metric) string {
+	for _, label := range query.RequireLabels {
+		if metric[model.LabelName(label)] == "" {
+			return label
+		}
+	}
+	return ""
+}
+
+func validate_label_filter(query Query) error {
+	if len(query.IncludeLabels) > 0 && len(query.ExcludeLabels) > 0 {
+		return fmt.Errorf("include_labels and exclude_labels can't be used together")
+	}
+	for _, label := range append(query.IncludeLabels, query.ExcludeLabels...) {
+		if label == "" {
+			return fmt.Errorf("include_labels and exclude_labels can't list an empty label")
+		}
+	}
+	for _, label := range query.RequireLabels {
+		if label == "" {
+			return fmt.Errorf("require_labels can't list an empty label")
+		}
+	}
+	return nil
+}
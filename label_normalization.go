@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LabelNormalizer rewrites a single label value.
+type LabelNormalizer func(string) string
+
+var label_normalizers = map[string]LabelNormalizer{
+	"lowercase": strings.ToLower,
+	"uppercase": strings.ToUpper,
+	"trim":      strings.TrimSpace,
+	"collapse-whitespace": func(value string) string {
+		return strings.Join(strings.Fields(value), " ")
+	},
+}
+
+// LabelRules maps a label name (or "*" for every label) to the normalizers
+// applied to its values, in order.
+type LabelRules map[string][]LabelNormalizer
+
+func (flags LabelRules) String() string {
+	return "LabelRules"
+}
+
+func (flags LabelRules) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Label normalization must be in the form label:rule[,rule...] (%v)", value)
+	}
+	label := parts[0]
+	for _, rule := range strings.Split(parts[1], ",") {
+		normalizer, ok := label_normalizers[rule]
+		if !ok {
+			return fmt.Errorf("Unknown label normalization rule %v (%v)", rule, value)
+		}
+		flags[label] = append(flags[label], normalizer)
+	}
+	return nil
+}
+
+// LabelValueMaps maps a label name (or "*" for every label) to specific
+// value replacements, applied after the normalization rules.
+type LabelValueMaps map[string]map[string]string
+
+func (flags LabelValueMaps) String() string {
+	return "LabelValueMaps"
+}
+
+func (flags LabelValueMaps) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Label value map must be in the form label:from=to (%v)", value)
+	}
+	mapping := strings.SplitN(parts[1], "=", 2)
+	if len(mapping) != 2 {
+		return fmt.Errorf("Label value map must be in the form label:from=to (%v)", value)
+	}
+	label := parts[0]
+	if flags[label] == nil {
+		flags[label] = map[string]string{}
+	}
+	flags[label][mapping[0]] = mapping[1]
+	return nil
+}
+
+// LabelMap renames labels to the tag keys they're sent as, e.g.
+// kubernetes_namespace to kube_namespace.
+type LabelMap map[string]string
+
+func (flags LabelMap) String() string {
+	return "LabelMap"
+}
+
+func (flags LabelMap) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("Label map must be in the form label=tag (%v)", value)
+	}
+	flags[parts[0]] = parts[1]
+	return nil
+}
+
+// tag_key is the tag key a label is sent as: the query's label_map, then
+// -map-label, falling back to the label itself.
+func tag_key(query Query, label string) string {
+	if key, ok := query.LabelMap[label]; ok {
+		return key
+	}
+	if key, ok := label_map[label]; ok {
+		return key
+	}
+	return label
+}
+
+// normalize_label_value applies the wildcard rules, then the label specific
+// rules and finally any value mappings to a label value.
+func normalize_label_value(label string, value string) string {
+	for _, normalizer := range label_rules["*"] {
+		value = normalizer(value)
+	}
+	for _, normalizer := range label_rules[label] {
+		value = normalizer(value)
+	}
+	if mapped, ok := label_value_maps[label][value]; ok {
+		return mapped
+	}
+	if mapped, ok := label_value_maps["*"][value]; ok {
+		return mapped
+	}
+	return value
+}
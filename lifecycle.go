@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// background tracks the bridge's long-running goroutines (the scheduler,
+// keepalive, watchdog, discovery and signal handlers) so shutdown can wait
+// for them. Each returns once stopping is closed. They're counted by name in
+// prometheus_to_datadog_background_goroutines, where a count above one is a
+// leak, e.g. a loop started again by every reload.
+var background sync.WaitGroup
+
+// go_background runs a long-running goroutine counted under name.
+func go_background(name string, run func()) {
+	background.Add(1)
+	backgroundGoroutines.WithLabelValues(name).Inc()
+	go func() {
+		defer background.Done()
+		defer backgroundGoroutines.WithLabelValues(name).Dec()
+		run()
+	}()
+}
+
+// wait_background waits for the background goroutines to return after
+// stopping is closed, returning false if they didn't by the deadline.
+func wait_background(deadline time.Time) bool {
+	returned := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// forget_removed_queries drops the state kept by query name for queries a
+// reload removed, so months of reloads with changing queries don't grow it
+// forever. A query added back later starts over, like a new one.
+func forget_removed_queries(removed []string) {
+	if len(removed) == 0 {
+		return
+	}
+	gone := make(map[string]bool, len(removed))
+	for _, name := range removed {
+		gone[name] = true
+	}
+
+	counter_totals.Lock()
+	change_event_series.Lock()
+	query_failures.Lock()
+	last_seen_series.Lock()
+	for _, name := range removed {
+		delete(counter_totals.by_query, name)
+		delete(change_event_series.by_query, name)
+		delete(query_failures.by_query, name)
+		delete(last_seen_series.by_query, name)
+	}
+	last_seen_series.Unlock()
+	query_failures.Unlock()
+	change_event_series.Unlock()
+	counter_totals.Unlock()
+
+	count_per_run_guard.Lock()
+	for key := range count_per_run_guard.last {
+		if gone[strings.SplitN(key, "|", 2)[0]] {
+			delete(count_per_run_guard.last, key)
+		}
+	}
+	count_per_run_guard.Unlock()
+
+	expectation_events.Lock()
+	for _, name := range removed {
+		delete(expectation_events.last, name)
+	}
+	expectation_events.Unlock()
+
+	for _, name := range removed {
+		queryNextRun.DeleteLabelValues(name)
+		queryInterval.DeleteLabelValues(name)
+	}
+
+	in_flight_queries.Forget(removed)
+}
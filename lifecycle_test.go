@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestLifecycleReturnsGoroutines starts the long-running goroutines the way
+// main does, reloads, stops them and checks none were left behind.
+func TestLifecycleReturnsGoroutines(t *testing.T) {
+	real_stopping := stopping
+	stopping = make(chan struct{})
+	defer func() { stopping = real_stopping }()
+
+	// os/signal starts a goroutine for good on first use
+	warm_up := make(chan os.Signal, 1)
+	signal.Notify(warm_up, syscall.SIGHUP)
+	signal.Stop(warm_up)
+	baseline := runtime.NumGoroutine()
+
+	// The queries the next reload loads, read by the reload goroutine
+	var next struct {
+		sync.Mutex
+		queries Queries
+	}
+	load_next := func(queries Queries) {
+		next.Lock()
+		defer next.Unlock()
+		next.queries = queries
+	}
+	query_set := NewQuerySet(Queries{{Type: Gauge, Name: "up", Query: "up"}})
+	query_set.load = func() (Queries, error) {
+		next.Lock()
+		defer next.Unlock()
+		return next.queries, nil
+	}
+	query_api := vector_query_api{vector: fixture_vector(10, time.Now())}
+	adaptive := NewAdaptiveInterval(10*time.Millisecond, 0)
+	watchdog := NewScheduleWatchdog(time.Now())
+	keepalive := NewKeepAlive(adaptive)
+
+	scheduler := NewScheduler(adaptive, nil, query_set, query_api, discard_sink{}, watchdog)
+	cycles_done := scheduler.Run(stopping_context())
+	start_watchdog(watchdog, query_set, adaptive)
+	start_keepalive(keepalive, query_set, discard_sink{})
+	handle_verbosity_signals(query_set, watchdog)
+	handle_reload_signal(query_set)
+
+	load_next(Queries{{Type: Gauge, Name: "up", Query: "up"}, {Type: Gauge, Name: "up2", Query: "up"}})
+	if _, err := reload_queries(query_set); err != nil {
+		t.Fatal(err)
+	}
+
+	// up's zero_fill series from before it's removed
+	disappeared_series("up", SeriesSet{"up|job:a": {Name: "up", Tags: []string{"job:a"}}})
+	defer disappeared_series("up", nil)
+
+	signalled := time.Now()
+	load_next(Queries{{Type: Gauge, Name: "up2", Query: "up"}})
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// Recorded once the reload finished
+		reload_history.Lock()
+		reloads := reload_history.reloads
+		reloaded := len(reloads) > 0 && !reloads[len(reloads)-1].Time.Before(signalled)
+		reload_history.Unlock()
+		if reloaded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the SIGHUP reload didn't happen")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if names := query_set.Queries(); len(names) != 1 || names[0].Name != "up2" {
+		t.Fatalf("SIGHUP reload gave %+v, expected just up2", names)
+	}
+	// up coming back starts over rather than zero filling its old series
+	if gone := disappeared_series("up", SeriesSet{}); len(gone) != 0 {
+		t.Errorf("Removed query up still zero fills %+v", gone)
+	}
+
+	close(stopping)
+	select {
+	case <-cycles_done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scheduler didn't stop")
+	}
+	if !wait_background(time.Now().Add(5 * time.Second)) {
+		t.Fatal("background goroutines didn't return")
+	}
+
+	// Returned goroutines take a moment to be gone from the count
+	deadline = time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if running := runtime.NumGoroutine(); running > baseline {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("%d goroutines running after stopping, %d before starting:\n%s", running, baseline, buf[:runtime.Stack(buf, true)])
+	}
+}
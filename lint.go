@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// LintFinding is a query which is likely to misbehave once it reaches
+// Datadog.
+type LintFinding struct {
+	Query   string
+	Message string
+}
+
+func (finding LintFinding) String() string {
+	return fmt.Sprintf("%v: %v", finding.Query, finding.Message)
+}
+
+var (
+	lint_string_literal = regexp.MustCompile(`"(\\.|[^"\\])*"|'(\\.|[^'\\])*'`)
+	// A counter selector, with optional label matchers and range.
+	lint_counter_selector = regexp.MustCompile(`\b[a-zA-Z_:][a-zA-Z0-9_:]*_total\b\s*(\{[^}]*\})?\s*(\[[^\]]*\])?`)
+	lint_aggregation      = regexp.MustCompile(`\b(sum|avg|min|max|count|count_values|stddev|stdvar|topk|bottomk|quantile|group)\b\s*(\(|by|without)|\b(by|without)\s*\(`)
+	lint_rate             = regexp.MustCompile(`\b(rate|irate|deriv|histogram_quantile|avg|avg_over_time)\s*\(`)
+	lint_scalar           = regexp.MustCompile(`\b(scalar|vector|time)\s*\(`)
+	// The range of a range selector or subquery, e.g. [5m] or [1h:1m].
+	lint_range = regexp.MustCompile(`\[\s*([0-9][0-9a-z]*)\s*(:[^\]]*)?\]`)
+)
+
+// range_mismatches describes the range selectors of a query which don't fit
+// how often it runs: a range shorter than the interval misses what happens
+// between runs (gappy data), and a count over a range of several intervals
+// counts every event several times.
+func range_mismatches(query Query, cycle time.Duration) []string {
+	every := query_interval(query, cycle)
+	expression := lint_string_literal.ReplaceAllString(query.Query, `""`)
+	var mismatches []string
+	for _, selector := range lint_range.FindAllStringSubmatch(expression, -1) {
+		window, ok := parse_range(selector[1])
+		if !ok {
+			continue
+		}
+		switch {
+		case window < every:
+			mismatches = append(mismatches, fmt.Sprintf("range [%v] is shorter than the %v interval, what happens between runs is missed", selector[1], every))
+		case window >= 2*every && (query.Type == Counter || query.Type == CountPerRun):
+			mismatches = append(mismatches, fmt.Sprintf("range [%v] covers %d runs of the %v interval, each event is counted %d times", selector[1], window/every, every, window/every))
+		}
+	}
+	return mismatches
+}
+
+// parse_range parses a PromQL duration, e.g. 5m, or a compound one such as
+// 1h30m.
+func parse_range(text string) (time.Duration, bool) {
+	if parsed, err := model.ParseDuration(text); err == nil {
+		return time.Duration(parsed), true
+	}
+	if parsed, err := time.ParseDuration(text); err == nil {
+		return parsed, true
+	}
+	return 0, false
+}
+
+// lint_queries looks for common mistakes which make a query a poor fit for
+// Datadog: unrated counters, unaggregated selectors, clashing metric names,
+// metric types which don't fit the expression and ranges which don't fit the
+// interval.
+func lint_queries(queries Queries) []LintFinding {
+	var findings []LintFinding
+	add := func(query Query, format string, args ...interface{}) {
+		findings = append(findings, LintFinding{Query: query.Name, Message: fmt.Sprintf(format, args...)})
+	}
+
+	names := map[string]Query{}
+	for _, query := range queries {
+		if previous, ok := names[query.Name]; ok {
+			add(query, "metric name collides with another query (%v and %v)", previous.Query, query.Query)
+		}
+		names[query.Name] = query
+		if len(query.Federate) > 0 {
+			// Selectors, there's no expression to lint
+			continue
+		}
+
+		expression := lint_string_literal.ReplaceAllString(query.Query, `""`)
+
+		for _, mismatch := range range_mismatches(query, time.Duration(interval)) {
+			add(query, "%v", mismatch)
+		}
+
+		for _, selector := range lint_counter_selector.FindAllStringSubmatch(expression, -1) {
+			if selector[2] == "" {
+				add(query, "counter %v is used without rate() or increase()", strings.TrimSpace(selector[0]))
+			}
+		}
+
+		if !lint_aggregation.MatchString(expression) && !lint_scalar.MatchString(expression) {
+			add(query, "expression has no aggregation and may return one series per scraped target")
+		}
+
+		if query.Type == Counter || query.Type == CountPerRun {
+			if strings.Contains(expression, "/") {
+				add(query, "counter type on a ratio, the value will be truncated to an integer")
+			} else if lint_rate.MatchString(expression) {
+				add(query, "counter type on a per-second or averaged value, the value will be truncated to an integer")
+			}
+		}
+	}
+	return findings
+}
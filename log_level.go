@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type LogLevel int32
+
+const (
+	LevelError LogLevel = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var log_level_names = []string{"error", "warn", "info", "debug"}
+
+var current_log_level = int32(LevelInfo)
+
+func (level LogLevel) String() string {
+	if level < LevelError || level > LevelDebug {
+		return fmt.Sprintf("LogLevel(%d)", int32(level))
+	}
+	return log_level_names[level]
+}
+
+func (level *LogLevel) Set(value string) error {
+	for i, name := range log_level_names {
+		if name == value {
+			*level = LogLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Can't handle log level %v (expected %v)", value, strings.Join(log_level_names, ", "))
+}
+
+func log_enabled(level LogLevel) bool {
+	return LogLevel(atomic.LoadInt32(&current_log_level)) >= level
+}
+
+func set_log_level(level LogLevel) {
+	if level < LevelError {
+		level = LevelError
+	}
+	if level > LevelDebug {
+		level = LevelDebug
+	}
+	atomic.StoreInt32(&current_log_level, int32(level))
+}
+
+func debugf(format string, args ...interface{}) {
+	if log_enabled(LevelDebug) {
+		log.Printf(format, args...)
+	}
+}
+
+// handle_verbosity_signals raises the log level on SIGUSR1 and lowers it on
+// SIGUSR2, dumping the scheduler state to the log either way.
+func handle_verbosity_signals(query_set *QuerySet, watchdog *ScheduleWatchdog) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go_background("verbosity_signal", func() {
+		defer signal.Stop(signals)
+		for {
+			var sig os.Signal
+			select {
+			case <-stopping:
+				return
+			case sig = <-signals:
+			}
+			level := LogLevel(atomic.LoadInt32(&current_log_level))
+			if sig == syscall.SIGUSR1 {
+				level++
+			} else {
+				level--
+			}
+			set_log_level(level)
+			log.Printf("Log level is now %v", LogLevel(atomic.LoadInt32(&current_log_level)))
+			dump_scheduler_state(query_set, watchdog, time.Now())
+		}
+	})
+}
+
+func dump_scheduler_state(query_set *QuerySet, watchdog *ScheduleWatchdog, now time.Time) {
+	watchdog.Lock()
+	last_runs := make(map[string]time.Time, len(watchdog.last_run))
+	for name, last := range watchdog.last_run {
+		last_runs[name] = last
+	}
+	watchdog.Unlock()
+
+	queries := query_set.Queries()
+	names := make([]string, 0, len(queries))
+	for _, query := range queries {
+		names = append(names, query.Name)
+	}
+	sort.Strings(names)
+
+	log.Printf("Scheduler state: %d queries", len(queries))
+	for _, name := range names {
+		last_run := "never"
+		if last, ok := last_runs[name]; ok {
+			last_run = fmt.Sprintf("%v ago", now.Sub(last))
+		}
+		log.Printf("  %v: last run %v, muted %v", name, last_run, query_set.Muted(name, now))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+)
+
+// LogThrottle logs the first occurrence of a message for a key, then at most
+// once per interval with a count of the messages suppressed in between.
+type LogThrottle struct {
+	sync.Mutex
+	interval time.Duration
+	entries  map[string]*throttled_entry
+}
+
+type throttled_entry struct {
+	last_logged time.Time
+	suppressed  int
+}
+
+func NewLogThrottle(interval time.Duration) *LogThrottle {
+	return &LogThrottle{interval: interval, entries: map[string]*throttled_entry{}}
+}
+
+func (throttle *LogThrottle) Printf(key string, format string, args ...interface{}) {
+	if !log_enabled(LevelWarn) {
+		return
+	}
+	throttle.Lock()
+	defer throttle.Unlock()
+
+	now := time.Now()
+	entry, ok := throttle.entries[key]
+	if !ok {
+		throttle.entries[key] = &throttled_entry{last_logged: now}
+		log.Printf(format, args...)
+		return
+	}
+	if now.Sub(entry.last_logged) < throttle.interval {
+		entry.suppressed++
+		suppressedLogMessages.Inc()
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	if entry.suppressed > 0 {
+		message = fmt.Sprintf("%v (%d similar messages suppressed in the last %v)", message, entry.suppressed, now.Sub(entry.last_logged))
+	}
+	entry.last_logged = now
+	entry.suppressed = 0
+	log.Print(message)
+}
+
+// error_class gives a coarse classification of an error for deduplicating log
+// messages.
+func error_class(err error) string {
+	if api_err, ok := err.(*prometheus.Error); ok {
+		return string(api_err.Type)
+	}
+	return fmt.Sprintf("%T", err)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+const (
+	// Limits of a single Datadog Logs HTTP intake request, the byte limit
+	// leaves room below the intake's 5MB.
+	logs_max_entries = 1000
+	logs_max_bytes   = 4 * 1024 * 1024
+)
+
+// LogEntry is a sample as a structured log in the Datadog Logs intake.
+type LogEntry struct {
+	Source   string  `json:"ddsource"`
+	Tags     string  `json:"ddtags,omitempty"`
+	Hostname string  `json:"hostname,omitempty"`
+	Service  string  `json:"service"`
+	Message  string  `json:"message"`
+	Metric   string  `json:"metric"`
+	Type     string  `json:"type"`
+	Value    float64 `json:"value"`
+	Query    string  `json:"query"`
+	// Timestamp is in milliseconds since the epoch.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// LogsSink ships samples to the Datadog Logs HTTP intake as structured logs,
+// for queries with logs: true (e.g. low frequency audit measurements, which
+// are cheaper and easier to search as logs than as custom metrics). Entries
+// are sent when the sink is flushed at the end of each cycle, compressed
+// with compression (none or gzip).
+type LogsSink struct {
+	url         string
+	api_key     string
+	namespace   string
+	hostname    string
+	compression string
+	client      *http.Client
+
+	sync.Mutex
+	entries [][]byte
+}
+
+func NewLogsSink(url, api_key, namespace, hostname, compression string, client *http.Client) *LogsSink {
+	return &LogsSink{url: url, api_key: api_key, namespace: namespace, hostname: hostname, compression: compression, client: client}
+}
+
+func (sink *LogsSink) Push(sample Sample) error {
+	name := sample.metric_name(sink.namespace)
+	value := strconv.FormatFloat(sample.Value, 'g', -1, 64)
+	encoded, err := json.Marshal(LogEntry{
+		Source:    "prometheus",
+		Tags:      strings.Join(sample.Tags, ","),
+		Hostname:  sink.hostname,
+		Service:   "prometheus_to_datadog",
+		Message:   name + "=" + value,
+		Metric:    name,
+		Type:      sample.Type.String(),
+		Value:     sample.Value,
+		Query:     sample.Query,
+		Timestamp: sample.Timestamp.UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		return err
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	sink.entries = append(sink.entries, encoded)
+	return nil
+}
+
+// Flush sends the entries pushed since the last flush, in requests within
+// the intake's limits.
+func (sink *LogsSink) Flush() error {
+	sink.Lock()
+	entries := sink.entries
+	sink.entries = nil
+	sink.Unlock()
+
+	var first error
+	for len(entries) > 0 {
+		count, size := 0, 2
+		for count < len(entries) && count < logs_max_entries && (count == 0 || size+len(entries[count])+1 <= logs_max_bytes) {
+			size += len(entries[count]) + 1
+			count++
+		}
+		body := append([]byte{'['}, bytes.Join(entries[:count], []byte{','})...)
+		body = append(body, ']')
+		err := sink.post(body)
+		result := "success"
+		if err != nil {
+			result = "failure"
+			log_throttle.Printf("logs-sink/"+error_class(err), "Failed to send %d logs to Datadog: %v", count, err)
+			if first == nil {
+				first = err
+			}
+		}
+		logsSubmissions.WithLabelValues(result).Inc()
+		entries = entries[count:]
+	}
+	return first
+}
+
+func (sink *LogsSink) post(body []byte) error {
+	body, err := compress(sink.compression, body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", sink.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if sink.compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", sink.api_key)
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	response, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("Datadog Logs intake returned %d: %s", resp.StatusCode, response)
+}
+
+func (sink *LogsSink) Close() error {
+	return sink.Flush()
+}
+
+// LogRoutingSink sends the samples of logs: true queries to the logs sink
+// and everything else to the metrics sink.
+type LogRoutingSink struct {
+	metrics Sink
+	logs    *LogsSink
+}
+
+func (router LogRoutingSink) Push(sample Sample) error {
+	if sample.Log {
+		return router.logs.Push(sample)
+	}
+	return router.metrics.Push(sample)
+}
+
+func (router LogRoutingSink) PushGroup(samples []Sample) error {
+	if len(samples) > 0 && samples[0].Log {
+		var first error
+		for _, sample := range samples {
+			if err := router.logs.Push(sample); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+	return push_group(router.metrics, samples)
+}
+
+func (router LogRoutingSink) Flush() error {
+	err := router.metrics.Flush()
+	if logs_err := router.logs.Flush(); err == nil {
+		err = logs_err
+	}
+	return err
+}
+
+func (router LogRoutingSink) Close() error {
+	err := router.metrics.Close()
+	if logs_err := router.logs.Close(); err == nil {
+		err = logs_err
+	}
+	return err
+}
+
+func (router LogRoutingSink) Event(event *statsd.Event) error {
+	return send_event(router.metrics, event)
+}
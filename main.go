@@ -1,14 +1,21 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/DataDog/datadog-go/statsd"
+	"github.com/micktwomey/prometheus_to_datadog/tagformat"
 	"github.com/prometheus/client_golang/api/prometheus"
 	prometheus_metrics "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/spf13/pflag"
 	"golang.org/x/net/context"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"sort"
 	"strings"
 	"time"
 )
@@ -21,40 +28,198 @@ const (
 	Histogram
 	Set
 	Milliseconds
+	// CountPerRun pushes the value as a count exactly once per interval.
+	CountPerRun
+	// Distribution is aggregated by Datadog rather than the agent, giving
+	// global percentiles. Also sent for milliseconds queries with timing as
+	// distribution.
+	Distribution
+	// Rate is a per-second rate, submitted as a Datadog rate by the api sink.
+	Rate
 )
 
 type Query struct {
-	Type  QueryType
-	Name  string
-	Query string
+	Type    QueryType         `yaml:"type"`
+	Name    string            `yaml:"name"`
+	Query   string            `yaml:"query"`
+	OnEmpty EmptyResultPolicy `yaml:"on_empty"`
+	// ZeroFill pushes a final zero for series which disappeared since the
+	// previous run, optionally tagged with ZeroFillTag.
+	ZeroFill    bool   `yaml:"zero_fill"`
+	ZeroFillTag string `yaml:"zero_fill_tag"`
+	// ValueLabels maps the values of one label to distinct metric names.
+	ValueLabels *ValueLabels `yaml:"value_labels"`
+	// SetLabel makes a set query count the distinct values of this label
+	// rather than of the sample values, e.g. users from count by (user).
+	SetLabel string `yaml:"set_label"`
+	// KeepAlive re-pushes the last value of a gauge this often between
+	// runs.
+	KeepAlive time.Duration `yaml:"keepalive"`
+	// Exemplars links samples to traces.
+	Exemplars *ExemplarConfig `yaml:"exemplars"`
+	// Tenant groups queries for -tenant-quota limits.
+	Tenant string `yaml:"tenant"`
+	// Namespace overrides -namespace for this query, "" sends the bare
+	// name.
+	Namespace *string `yaml:"namespace"`
+	// ChangeEvents sends an event when the returned series change.
+	ChangeEvents *ChangeEventConfig `yaml:"change_events"`
+	// TagSampling keeps full tags only on the highest valued series.
+	TagSampling *TagSampling `yaml:"tag_sampling"`
+	// Timeout is the time budget for running the query and pushing its
+	// results, OnTimeout decides whether a partial run is pushed.
+	Timeout   time.Duration `yaml:"timeout"`
+	OnTimeout TimeoutPolicy `yaml:"on_timeout"`
+	// Tags are templates rendered per sample with .labels and .value.
+	Tags []string `yaml:"tags"`
+	// ValueTags tag each sample with the band its value falls in.
+	ValueTags []ValueTag `yaml:"value_tags"`
+	// IncludeLabels sends only these labels as tags, ExcludeLabels every
+	// label but these.
+	IncludeLabels []string `yaml:"include_labels"`
+	ExcludeLabels []string `yaml:"exclude_labels"`
+	// RequireLabels drops series missing any of these labels, usually
+	// the result of a wrong aggregation.
+	RequireLabels []string `yaml:"require_labels"`
+	// LabelMap renames labels to tag keys, over -map-label.
+	LabelMap map[string]string `yaml:"label_map"`
+	// MultiplyBy and then Add transform every value pushed, e.g. 1000 to
+	// publish seconds as milliseconds.
+	MultiplyBy *float64 `yaml:"multiply_by"`
+	Add        float64  `yaml:"add"`
+	// MaxSamples caps the series a run pushes, OnMaxSamples decides
+	// whether a larger result is skipped (default) or truncated.
+	MaxSamples   int              `yaml:"max_samples"`
+	OnMaxSamples MaxSamplesPolicy `yaml:"on_max_samples"`
+	// Expect asserts the range the query's values should be in.
+	Expect *Expectation `yaml:"expect"`
+	// SampleRate sends only this fraction (0 to 1) of the samples to
+	// dogstatsd, e.g. for very high cardinality queries.
+	SampleRate float64 `yaml:"sample_rate"`
+	// Regions runs the query against these -prometheus-region servers
+	// instead of -prometheus-address, RegionDedup keeps one copy of series
+	// returned by several of them.
+	Regions     []string `yaml:"regions"`
+	RegionDedup bool     `yaml:"region_dedup"`
+	// PushTogether sends the metrics value_labels makes from each label set
+	// in one dogstatsd packet (or api batch).
+	PushTogether bool `yaml:"push_together"`
+	// Summary also pushes statistics across all the returned series.
+	Summary *ResultSummary `yaml:"summary"`
+	// Timing sends a milliseconds query as a histogram or distribution.
+	Timing *TimingConfig `yaml:"timing"`
+	// TimeShifts also evaluates the query a day (dod) or week (wow) ago,
+	// pushed as <name>.dod and <name>.wow.
+	TimeShifts []string `yaml:"time_shifts"`
+	// Logs sends the query's samples to Datadog Logs (-datadog-logs-url)
+	// as structured logs instead of as metrics.
+	Logs bool `yaml:"logs"`
+	// DoubleWrite also submits the query's samples to the
+	// -secondary-datadog-api-key org.
+	DoubleWrite bool `yaml:"double_write"`
+	// Range runs a range query over this window up to now every run,
+	// pushing each point at Step (the query's interval by default) with
+	// its own timestamp.
+	Range time.Duration `yaml:"range"`
+	Step  time.Duration `yaml:"step"`
+	// Federate mirrors the series matching these match[] selectors from
+	// Prometheus' /federate endpoint instead of running query, with
+	// FederateBatch selectors per request (1 by default).
+	Federate      []string `yaml:"federate"`
+	FederateBatch int      `yaml:"federate_batch"`
+	// Cumulative pushes the increase of a counter query's totals (e.g.
+	// http_requests_total) since the previous run instead of the totals.
+	Cumulative bool `yaml:"cumulative"`
+	// Priority orders the queries of a cycle and decides which are shed
+	// when it runs late.
+	Priority QueryPriority `yaml:"priority"`
+	// Interval runs the query less often than every cycle (-interval),
+	// e.g. for expensive queries.
+	Interval time.Duration `yaml:"interval"`
+
+	// comparison is set on the -compare-query-file queries, whose samples
+	// aren't pushed and mustn't count towards the running queries' limits.
+	comparison bool
+	// backfill_step is the time between backfilled points, each a run of
+	// the query.
+	backfill_step time.Duration
 }
 
 type Queries []Query
 
+func parse_query_type(metric_type string) (QueryType, error) {
+	switch metric_type {
+	case "gauge":
+		return Gauge, nil
+	case "counter":
+		return Counter, nil
+	case "histogram":
+		return Histogram, nil
+	case "set":
+		return Set, nil
+	case "milliseconds":
+		return Milliseconds, nil
+	case "count_per_run":
+		return CountPerRun, nil
+	case "distribution":
+		return Distribution, nil
+	case "rate":
+		return Rate, nil
+	}
+	return Gauge, fmt.Errorf("Can't handle query type %v", metric_type)
+}
+
+func (query_type QueryType) String() string {
+	switch query_type {
+	case Gauge:
+		return "gauge"
+	case Counter:
+		return "counter"
+	case Histogram:
+		return "histogram"
+	case Set:
+		return "set"
+	case Milliseconds:
+		return "milliseconds"
+	case CountPerRun:
+		return "count_per_run"
+	case Distribution:
+		return "distribution"
+	case Rate:
+		return "rate"
+	}
+	return fmt.Sprintf("QueryType(%d)", int(query_type))
+}
+
+func (query_type *QueryType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var metric_type string
+	if err := unmarshal(&metric_type); err != nil {
+		return err
+	}
+	parsed, err := parse_query_type(metric_type)
+	if err != nil {
+		return err
+	}
+	*query_type = parsed
+	return nil
+}
+
 func (flags *Queries) String() string {
 	return "Queries"
 }
 
 func (flags *Queries) Set(value string) error {
 	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("Query must be in the form type:datadog_metric_name:prometheus_query (%v)", value)
+	}
 	metric_type := parts[0]
 	metric_name := parts[1]
 	prometheus_query := parts[2]
 
-	var query_type QueryType
-	switch metric_type {
-	case "gauge":
-		query_type = Gauge
-	case "counter":
-		query_type = Counter
-	case "histogram":
-		query_type = Histogram
-	case "set":
-		return fmt.Errorf("Don't know how to handle sets (yet)")
-	case "milliseconds":
-		query_type = Milliseconds
-	default:
-		return fmt.Errorf("Can't handle query type %v (%v)", metric_type, value)
+	query_type, err := parse_query_type(metric_type)
+	if err != nil {
+		return fmt.Errorf("%v (%v)", err, value)
 	}
 
 	*flags = append(*flags, Query{Type: query_type, Name: metric_name, Query: prometheus_query})
@@ -62,14 +227,144 @@ func (flags *Queries) Set(value string) error {
 }
 
 var (
-	dogstatsd_addr  = flag.String("dogstatsd-address", "127.0.0.1:8125", "The address to send dogstatsd metrics to.")
-	prometheus_addr = flag.String("prometheus-address", "127.0.0.1:9090", "The prometheus address")
-	listen_addr     = flag.String("listen-address", ":9132", "HTTP address to listen on to publish internal metrics.")
-	interval        = flag.Int("interval", 10, "Frequency to query Prometheus (in seconds)")
-	queries         Queries
+	dogstatsd_addr         = flag.String("dogstatsd-address", "127.0.0.1:8125", "The address to send dogstatsd metrics to.")
+	prometheus_addr        = flag.String("prometheus-address", "127.0.0.1:9090", "The prometheus address")
+	admin_addr             = flag.String("admin-address", "", "TCP address to serve the gRPC admin API (adminpb/admin.proto: ListQueries, Reload, RunQueryOnce, Mute, Pause, Resume and Stats) on, over TLS with the -http-tls-* files and the same authentication as the admin HTTP endpoints. Disabled if empty.")
+	listen_addr            = flag.String("listen-address", ":9132", "HTTP address to listen on to publish internal metrics.")
+	http_auth_token        = flag.String("http-auth-token", "", "Bearer token accepted by the admin HTTP endpoints (all but /metrics) and the gRPC admin API.")
+	http_basic_auth        = flag.String("http-basic-auth", "", "Basic auth credentials accepted by the admin HTTP endpoints (all but /metrics) and the gRPC admin API, in form user:password.")
+	admin_insecure         = flag.Bool("admin-insecure", false, "Serve the admin HTTP endpoints, the -remote-write and -pushgateway intakes and the gRPC admin API without authentication when none of -http-auth-token, -http-basic-auth and -http-tls-client-ca-file is set, e.g. on a trusted network. Otherwise they refuse to.")
+	http_tls_cert_file     = flag.String("http-tls-cert-file", "", "Certificate to serve HTTPS with on -listen-address.")
+	http_tls_key_file      = flag.String("http-tls-key-file", "", "Key for -http-tls-cert-file.")
+	http_tls_client_ca     = flag.String("http-tls-client-ca-file", "", "CA certificates verifying client certificates, which the admin HTTP endpoints accept instead of a token or password and the -admin-address API then requires.")
+	config_path            = flag.String("config", "", "YAML file of settings named after the flags (e.g. prometheus-address: http://prometheus:9090), for the flags given neither on the command line nor in the environment. Can also list the queries under queries:, used if -query-file isn't set.")
+	query_file             = flag.String("query-file", "", "YAML (or JSON or TOML, see -query-file-format) file containing a list of queries (name, type, query and optional on_empty), used in addition to any -query flags. A directory reads every .yaml, .yml, .json and .toml file in it and a glob pattern every matching file. Use - to read from stdin.")
+	query_file_format      = flag.String("query-file-format", "", "Format of -query-file: yaml, json or toml. Guessed from the extension (.json is json, .toml is toml, anything else yaml) if empty, e.g. set it for json on stdin. The files of a directory or glob are always guessed from their extension.")
+	openmetrics_file       = flag.String("openmetrics-file", "", "Datadog agent OpenMetrics check configuration (or just its metrics: list) translated into queries, used in addition to any other queries.")
+	discover_interval      = flag.Duration("discover-interval", 5*time.Minute, "How often -discover looks for new metric families.")
+	discover_name          = flag.String("discover-name-template", "{{.Metric}}", "Go template for the Datadog metric name of discovered families, with .Metric and .Matcher.")
+	discover_query         = flag.String("discover-query-template", "sum({{.Metric}}{{.Matcher}})", "Go template for the query of discovered gauge families.")
+	discover_counter_query = flag.String("discover-counter-query-template", "sum(rate({{.Metric}}{{.Matcher}}[5m]))", "Go template for the query of discovered counter (*_total) families.")
+	use_external_labels    = flag.Bool("external-labels", false, "Tag samples with the external_labels of the Prometheus server they came from, unless the series has a label of the same name.")
+	splay_enabled          = flag.Bool("splay", false, "Stagger queries across the interval with a random offset per query.")
+	splay_state_file       = flag.String("splay-state-file", "", "File keeping the -splay offsets across restarts, so a fleet restarting together keeps its stagger pattern.")
+	query_timeout          = flag.Duration("query-timeout", 0, "Time budget for running a query and pushing its results, unlimited if zero. Can be overridden per query.")
+	max_interval           = flag.Duration("max-interval", 0, "Stretch the interval up to this while Prometheus is slow (cycles taking most of the interval) or returning 503s, shrinking back once healthy. Disabled if not larger than -interval.")
+	hostname               = flag.String("hostname", "", "Hostname used for events and the api sink's host field (defaults to the system hostname).")
+	sink_type              = flag.String("sink", "dogstatsd", "Where to send metrics, either dogstatsd or api (the Datadog HTTP API).")
+	api_url                = flag.String("datadog-api-url", "https://api.datadoghq.com", "The Datadog API URL used by the api sink.")
+	api_key                = flag.String("datadog-api-key", "", "The Datadog API key used by the api sink.")
+	secondary_api_key      = flag.String("secondary-datadog-api-key", "", "API key of a second Datadog org the samples of queries with double_write: true are also submitted to, e.g. during an org migration.")
+	secondary_api_url      = flag.String("secondary-datadog-api-url", "", "Datadog API URL of the -secondary-datadog-api-key org, e.g. https://api.datadoghq.eu for another site. Defaults to -datadog-api-url.")
+	api_max_points         = flag.Int("api-batch-max-points", 1000, "Maximum number of points in a single Datadog API submission.")
+	api_max_bytes          = flag.Int("api-batch-max-bytes", 512*1024, "Maximum size in bytes of a single Datadog API submission.")
+	api_submitters         = flag.Int("api-submitters", 2, "Number of concurrent Datadog API submissions.")
+	api_max_retries        = flag.Int("api-max-retries", 3, "Number of times a Datadog API submission is retried on 429 or 5xx responses.")
+	api_max_queued         = flag.Int("api-max-queued-batches", 100, "Batches which can wait for a free Datadog API submitter, further batches are dropped rather than holding up the queries (backfill waits instead).")
+	query_label_max_length = flag.Int("query-label-max-length", 80, "Maximum length of the query label on the bridge's own metrics in truncate mode.")
+	api_compression        = flag.String("api-compression", "gzip", "Compression for Datadog API and Logs submissions: none or gzip.")
+	api_tls_ca_file        = flag.String("api-tls-ca-file", "", "CA certificates used to verify the Datadog API and Logs (or proxy) servers.")
+	api_tls_cert_file      = flag.String("api-tls-cert-file", "", "Client certificate for the Datadog API and Logs (or proxy) connections.")
+	api_tls_key_file       = flag.String("api-tls-key-file", "", "Client key for the Datadog API and Logs (or proxy) connections.")
+	api_tls_insecure       = flag.Bool("api-tls-insecure-skip-verify", false, "Don't verify the Datadog API and Logs (or proxy) server certificates.")
+	ha_state_store         = flag.String("ha-state-store", "", "State store shared by an HA pair of bridges, only the leader runs cycles: file:///dir (a directory on shared storage) or http(s)://consul:8500/prefix (Consul KV, CONSUL_HTTP_TOKEN is the token).")
+	ha_id                  = flag.String("ha-id", "", "This bridge's name in the HA pair (defaults to -hostname).")
+	ha_lease_duration      = flag.Duration("ha-lease", 30*time.Second, "How long the HA leader's lease lasts without renewal, it should be more than twice the longest cycle.")
+	remote_write           = flag.Bool("remote-write", false, "Accept Prometheus remote_write on /api/v1/write of -listen-address, rolling the samples up per series into -remote-write-bucket buckets before pushing them as gauges.")
+	remote_write_bucket    = flag.Duration("remote-write-bucket", time.Minute, "Length of the time buckets -remote-write samples are rolled up into, each pushed as one point per series.")
+	remote_write_delay     = flag.Duration("remote-write-delay", 30*time.Second, "How long after a bucket ends it's pushed, samples remote_write sends later are dropped.")
+	remote_write_rollup    = flag.String("remote-write-rollup", "last", "How the samples of a series within a bucket are rolled up: sum, last or avg.")
+	pushgateway            = flag.Bool("pushgateway", false, "Accept Pushgateway pushes (the text format) on /metrics/job/<job>{/<label>/<value>} of -listen-address, rolled up like -remote-write with the grouping key as tags.")
+	namespace_flag         = flag.String("namespace", "prometheus", "Namespace prefixed (with a dot) to every metric name, can be overridden per query. Empty sends the bare names.")
+	record_fixtures        = flag.String("record-fixtures", "", "Save every Prometheus query response to this file, for -replay-fixtures.")
+	replay_fixtures        = flag.String("replay-fixtures", "", "Answer queries from responses saved with -record-fixtures instead of Prometheus.")
+	dogstatsd_output       = flag.String("dogstatsd-output", "", "Write dogstatsd datagrams to this file, one per line, instead of sending them to the agent. Use - for stdout.")
+	dogstatsd_aggregation  = flag.Bool("dogstatsd-aggregation", false, "Aggregate gauges, rates, counts and sets client-side and send one datagram per series every -dogstatsd-aggregation-interval (and at the end of every cycle).")
+	dogstatsd_agg_interval = flag.Duration("dogstatsd-aggregation-interval", 2*time.Second, "How often to send what -dogstatsd-aggregation aggregated.")
+	dogstatsd_extended_agg = flag.Bool("dogstatsd-extended-aggregation", false, "With -dogstatsd-aggregation also buffer histograms, timings and distributions and send them as multi-value datagrams, which needs Datadog agent 6.25 or 7.25 and later.")
+	compare_query_file     = flag.String("compare-query-file", "", "Query file (or directory) with new definitions of the queries, run every cycle alongside the running ones without pushing their results, logging and serving on /compare the differences in metric names, series and values.")
+	compare_tolerance      = flag.Float64("compare-tolerance", 0, "Relative difference below which -compare-query-file values are considered equal.")
+	recent_metrics_size    = flag.Int("recent-metrics-size", 0, "Keep this many of the most recently pushed samples and serve the newest value of each series on /recent_metrics in the Prometheus exposition format. Disabled if zero.")
+	logs_url               = flag.String("datadog-logs-url", "", "Datadog Logs HTTP intake URL (e.g. https://http-intake.logs.datadoghq.com/api/v2/logs) the samples of queries with logs: true are sent to as structured logs, using -datadog-api-key.")
+	dry_run                = flag.Bool("dry-run", false, "Print the samples (name, type, value and tags) to stdout instead of sending them to Datadog or any plugin sink.")
+	shutdown_timeout       = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait on SIGTERM or SIGINT for the running cycle and queries to finish before flushing the sink and exiting.")
+	log_interval           = flag.Duration("log-throttle-interval", 5*time.Minute, "Repeated log messages for the same query and error class are summarized at most this often.")
+	queries                Queries
+	label_rules            = LabelRules{}
+	only_queries           = QueryNames{}
+	skip_queries           = QueryNames{}
+	label_value_maps       = LabelValueMaps{}
+	label_map              = LabelMap{}
+	query_method           = QueryPost
+	canary                 = flag.Bool("canary", false, "Also push the value of -canary-query every cycle as prometheus_to_datadog.canary, for a Datadog monitor checking the whole pipeline.")
+	canary_query           = flag.String("canary-query", "vector(1)", "Constant expression evaluated by -canary.")
+	max_query_length       = flag.Int("max-query-length", 0, "Refuse to load query expressions longer than this many bytes (after -var expansion), 0 for no limit.")
+	log_throttle           *LogThrottle
+	query_label_mode       = QueryLabelTruncate
+	plugin_specs           PluginSpecs
+	tenant_quotas          = TenantQuotas{}
+	sink_routes            SinkRoutes
+	query_vars             = QueryVars{}
+	prometheus_regions     = PrometheusRegions{}
+	negative_policies      = NegativePolicies{Counter: NegativeDrop, CountPerRun: NegativeDrop}
+	remote_write_rollups   = Rollups{}
+	push_grouping_headers  = GroupingHeaders{}
+	coercion_policies      = CoercionPolicies{Counter: CoercionTruncate, CountPerRun: CoercionRound}
+	quota_tracker          = NewQuotaTracker(tenant_quotas)
+	enrichers              []Enricher
+	keepalive              *KeepAlive
+	log_level              = LevelInfo
+	default_namespace      string
+	timeout_policy         = TimeoutDiscard
+	interval               = Interval(10 * time.Second)
+	overlap_policy         = OverlapSkip
+	discover_matchers      DiscoveryMatchers
+	discovery              *Discovery
+	// prometheus_http_client is used for Prometheus requests the query API
+	// doesn't support.
+	prometheus_http_client = http.DefaultClient
 )
 
 var (
+	httpClientRequests = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "http_client_requests_total",
+			Help:      "Number of outbound HTTP requests by client, method and status code (error if no response)",
+		},
+		[]string{"client", "method", "code"},
+	)
+	httpClientDuration = prometheus_metrics.NewHistogramVec(
+		prometheus_metrics.HistogramOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "http_client_request_duration_seconds",
+			Help:      "Duration of outbound HTTP requests by client",
+		},
+		[]string{"client"},
+	)
+	effectiveInterval = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "effective_interval_seconds",
+			Help:      "Current query interval, stretched by -max-interval while Prometheus is under pressure.",
+		},
+	)
+	configInfo = prometheus_metrics.NewGaugeVec(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "config_info",
+			Help:      "Always 1, labelled with the SHA256 of the loaded query file and queries.",
+		},
+		[]string{"query_file_sha256", "queries_sha256"},
+	)
+	reloadsTotal = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "reloads_total",
+			Help:      "Number of query reloads, including the initial load, by result",
+		},
+		[]string{"result"},
+	)
 	pushedMetrics = prometheus_metrics.NewCounterVec(
 		prometheus_metrics.CounterOpts{
 			Namespace: "prometheus_to_datadog",
@@ -82,9 +377,9 @@ var (
 		prometheus_metrics.CounterOpts{
 			Namespace: "prometheus_to_datadog",
 			Name:      "failed_queries_total",
-			Help:      "Number of failed queries to Prometheus",
+			Help:      "Number of failed queries to Prometheus by error class",
 		},
-		[]string{"query"},
+		[]string{"query", "error_class"},
 	)
 	failedPushedMetrics = prometheus_metrics.NewCounterVec(
 		prometheus_metrics.CounterOpts{
@@ -94,104 +389,1276 @@ var (
 		},
 		[]string{"reason"},
 	)
+	pushedBytes = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "pushed_bytes_total",
+			Help:      "Estimated number of dogstatsd payload bytes pushed",
+		},
+		[]string{"query_name"},
+	)
+	pushedDatagrams = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "pushed_datagrams_total",
+			Help:      "Number of dogstatsd datagrams pushed",
+		},
+		[]string{"query_name"},
+	)
+	emptyQueryResults = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "empty_query_results_total",
+			Help:      "Number of queries which returned no series",
+		},
+		[]string{"query_name"},
+	)
+	droppedSamples = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "dropped_samples_total",
+			Help:      "Number of samples deliberately not pushed",
+		},
+		[]string{"query_name", "reason"},
+	)
+	overlappingRuns = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "overlapping_runs_total",
+			Help:      "Number of query runs due while a previous run of the query was still in progress, by action (skipped or queued)",
+		},
+		[]string{"query_name", "action"},
+	)
+	queryTimeouts = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "query_timeouts_total",
+			Help:      "Number of query runs which ran out of their time budget while processing results",
+		},
+		[]string{"query_name", "policy"},
+	)
+	federateBatches = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "federate_batches_total",
+			Help:      "Number of /federate requests of federate queries, by result (success, retried or failure)",
+		},
+		[]string{"query_name", "result"},
+	)
+	tagSampledSeries = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "tag_sampled_series_total",
+			Help:      "Number of series aggregated without their tags by tag_sampling",
+		},
+		[]string{"query_name"},
+	)
+	zeroFilledSeries = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "zero_filled_series_total",
+			Help:      "Number of disappeared series pushed as a final zero",
+		},
+		[]string{"query_name"},
+	)
+	suppressedLogMessages = prometheus_metrics.NewCounter(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "suppressed_log_messages_total",
+			Help:      "Number of repeated log messages suppressed by throttling",
+		},
+	)
+	apiBatches = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "api_batches_total",
+			Help:      "Number of batches submitted to the Datadog API",
+		},
+		[]string{"result"},
+	)
+	apiBatchPoints = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "api_batch_points_total",
+			Help:      "Number of points in batches submitted to the Datadog API",
+		},
+		[]string{"result"},
+	)
+	apiBatchRetries = prometheus_metrics.NewCounter(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "api_batch_retries_total",
+			Help:      "Number of retried Datadog API batch submissions",
+		},
+	)
+	logsSubmissions = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "logs_submissions_total",
+			Help:      "Number of requests to the Datadog Logs intake by result",
+		},
+		[]string{"result"},
+	)
+	comparisonDifferences = prometheus_metrics.NewGaugeVec(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "comparison_differences",
+			Help:      "Differences between the running queries and -compare-query-file in the last cycle, by kind",
+		},
+		[]string{"kind"},
+	)
+	tenantQuotaExceeded = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "tenant_quota_exceeded_total",
+			Help:      "Number of samples dropped because a tenant exceeded a quota",
+		},
+		[]string{"tenant", "quota"},
+	)
+	missedRuns = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "missed_runs_total",
+			Help:      "Number of watchdog checks which found a query hadn't run for more than twice its interval",
+		},
+		[]string{"query_name"},
+	)
+	shedQueries = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "shed_queries_total",
+			Help:      "Number of runs of low priority queries skipped because the cycle took longer than the interval",
+		},
+		[]string{"query_name"},
+	)
+	keepaliveSamples = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "keepalive_samples_total",
+			Help:      "Number of gauge samples re-pushed between query runs",
+		},
+		[]string{"query_name"},
+	)
+	counterResets = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "counter_resets_total",
+			Help:      "Number of counter resets (a total lower than in the previous run) seen by cumulative queries",
+		},
+		[]string{"query_name"},
+	)
+	negativeValues = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "negative_values_total",
+			Help:      "Number of negative values handled by a negative value policy",
+		},
+		[]string{"query_name", "policy"},
+	)
+	maxSamplesExceeded = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "max_samples_exceeded_total",
+			Help:      "Number of query results with more series than the query's max_samples, by what was done with them",
+		},
+		[]string{"query_name", "action"},
+	)
+	assertionFailures = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "assertion_failures_total",
+			Help:      "Number of samples outside their query's expected range",
+		},
+		[]string{"query_name", "bound"},
+	)
+	lossyCountConversions = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "lossy_count_conversions_total",
+			Help:      "Number of fractional count values converted to integers by -count-coercion",
+		},
+		[]string{"query_name", "policy"},
+	)
+	routedSamples = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "routed_samples_total",
+			Help:      "Number of samples sent to a -route destination instead of -sink",
+		},
+		[]string{"destination"},
+	)
+	lastCycleDuration = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "last_cycle_duration_seconds",
+			Help:      "How long the last cycle took, including splay waits",
+		},
+	)
+	lastCycleLag = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "last_cycle_lag_seconds",
+			Help:      "How long after its tick the last cycle started, e.g. because the cycle before overran",
+		},
+	)
+	schedulerUtilization = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "scheduler_utilization",
+			Help:      "Fraction of the last cycle's interval spent running queries, excluding splay waits; queries can be added while it's well below 1",
+		},
+	)
+	queryNextRun = prometheus_metrics.NewGaugeVec(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "query_next_run_timestamp_seconds",
+			Help:      "When each query is next due to run, as a Unix timestamp",
+		},
+		[]string{"query_name"},
+	)
+	queryInterval = prometheus_metrics.NewGaugeVec(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "query_interval_seconds",
+			Help:      "How often each query runs: its own interval or the (adaptive) cycle interval",
+		},
+		[]string{"query_name"},
+	)
+	inFlightQueries = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "in_flight_queries",
+			Help:      "Number of query runs in progress",
+		},
+	)
+	apiSubmitters = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "api_submitters",
+			Help:      "Number of concurrent Datadog API submitters (-api-submitters)",
+		},
+	)
+	apiSubmittersBusy = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "api_submitters_busy",
+			Help:      "Number of Datadog API submitters submitting a batch",
+		},
+	)
+	rejectedHTTPRequests = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "rejected_http_requests_total",
+			Help:      "Number of admin HTTP requests rejected for failing authentication",
+		},
+		[]string{"path"},
+	)
+	rejectedAdminCalls = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "rejected_admin_calls_total",
+			Help:      "Number of admin API calls rejected for failing authentication",
+		},
+		[]string{"method"},
+	)
+	backgroundGoroutines = prometheus_metrics.NewGaugeVec(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "background_goroutines",
+			Help:      "Number of long-running goroutines by name, more than one of a name is a leak",
+		},
+		[]string{"name"},
+	)
+	haLeader = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "ha_leader",
+			Help:      "1 while this bridge leads its HA pair",
+		},
+	)
+	haLeaderChanges = prometheus_metrics.NewCounter(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "ha_leader_changes_total",
+			Help:      "Number of times this bridge took the lead of its HA pair",
+		},
+	)
+	haCheckpoints = prometheus_metrics.NewCounter(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "ha_checkpoints_total",
+			Help:      "Number of counter total checkpoints saved to the HA state store",
+		},
+	)
+	remoteWriteRequests = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "remote_write_requests_total",
+			Help:      "Number of remote_write and Pushgateway requests received, by intake (remote_write or pushgateway) and result (success or invalid)",
+		},
+		[]string{"intake", "result"},
+	)
+	remoteWriteSamples = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "remote_write_samples_total",
+			Help:      "Number of remote_write and Pushgateway samples received, by intake (remote_write or pushgateway) and result (accepted, late, nan, inf, dropped or invalid)",
+		},
+		[]string{"intake", "result"},
+	)
+	remoteWriteRollups = prometheus_metrics.NewCounterVec(
+		prometheus_metrics.CounterOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "remote_write_rollups_total",
+			Help:      "Number of rolled up remote_write and Pushgateway samples pushed, by rollup",
+		},
+		[]string{"rollup"},
+	)
+	schedulerPaused = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "scheduler_paused",
+			Help:      "1 while cycles are paused with Admin.Pause",
+		},
+	)
+	lastCyclePushedBytes = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "last_cycle_pushed_bytes",
+			Help:      "Estimated number of dogstatsd payload bytes pushed in the last cycle",
+		},
+	)
+	lastCyclePushedDatagrams = prometheus_metrics.NewGauge(
+		prometheus_metrics.GaugeOpts{
+			Namespace: "prometheus_to_datadog",
+			Name:      "last_cycle_pushed_datagrams",
+			Help:      "Number of dogstatsd datagrams pushed in the last cycle",
+		},
+	)
 )
 
-func run_query(query Query, query_api prometheus.QueryAPI, when time.Time, statsd_client *statsd.Client) error {
+func push_sample(query Query, sample Sample, sink Sink) error {
+	sample.Query = query.Name
+	sample.Type = query.Type
+	sample.Namespace = query.Namespace
+	sample.Log = query.Logs
+	sample.DoubleWrite = query.DoubleWrite
+	sample.SampleRate = query.SampleRate
+	if query.Interval > time.Duration(interval) {
+		sample.Interval = query.Interval
+	}
+	switch query.Type {
+	case Gauge, Counter, Histogram, Set, Milliseconds, CountPerRun, Distribution, Rate:
+	default:
+		return fmt.Errorf("Can't handle %v", query.Type)
+	}
+
+	// NaN and infinities (e.g. from dividing by zero) would corrupt Datadog
+	// graphs, set members from set_label don't use the value
+	if reason := non_finite(sample.Value); reason != "" && query.SetLabel == "" {
+		droppedSamples.WithLabelValues(query.Name, reason).Inc()
+		return nil
+	}
+
+	if query.Cumulative && (query.Type == Counter || query.Type == Rate) {
+		delta, elapsed, ok := counter_delta(query, sample, sink)
+		if !ok {
+			return nil
+		}
+		sample.Value = delta
+		if query.Type == Rate {
+			if elapsed <= 0 {
+				// Evaluated at the same time as the previous run
+				return nil
+			}
+			sample.Value = delta / elapsed.Seconds()
+		}
+	}
+	sample.Value = transform_value(query, sample.Value)
+
+	if query.Expect != nil && !query.comparison && !check_expectation(query, sample, sink) {
+		droppedSamples.WithLabelValues(query.Name, "unexpected-value").Inc()
+		return nil
+	}
+
+	sample, ok := apply_negative_policy(sample)
+	if !ok {
+		droppedSamples.WithLabelValues(query.Name, "negative").Inc()
+		return nil
+	}
+	if sample.Type == Milliseconds && query.Timing != nil {
+		sample.Type = query.Timing.query_type()
+	}
+
+	for _, enrich := range enrichers {
+		var keep bool
+		if sample, keep = enrich(sample); !keep {
+			droppedSamples.WithLabelValues(query.Name, "enricher").Inc()
+			return nil
+		}
+	}
+
+	sample, ok, err := coerce_count(sample)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		droppedSamples.WithLabelValues(query.Name, "count-out-of-range").Inc()
+		log_throttle.Printf(query.Name+"/count-out-of-range", "Dropping count %v from %v, it can't be sent as a 64 bit integer", sample.Value, query.Name)
+		return nil
+	}
+
+	if sample.Type == CountPerRun && !query.comparison && !count_once(sample, count_once_interval(query)) {
+		droppedSamples.WithLabelValues(query.Name, "counted-this-interval").Inc()
+		return nil
+	}
+
+	if err := validate_metric_name(sample.Name); err != nil {
+		droppedSamples.WithLabelValues(query.Name, "invalid-name-characters").Inc()
+		log_throttle.Printf(query.Name+"/invalid-name", "Dropping sample from %v: %v", query.Name, err)
+		return nil
+	}
+
+	if query.comparison {
+		return sink.Push(sample)
+	}
+
+	if quota, notify := quota_tracker.Allow(query.Tenant, sample.Name); quota != "" {
+		droppedSamples.WithLabelValues(query.Name, "tenant-quota").Inc()
+		if notify {
+			log.Printf("Tenant %v exceeded its %v quota, dropping samples", tenant_name(query.Tenant), quota)
+			send_event(sink, quota_exceeded_event(query.Tenant, quota))
+		}
+		return nil
+	}
+
+	err = sink.Push(sample)
+	pushedMetrics.WithLabelValues(sample.Name, sample.Name, sample.Type.String()).Inc()
+	if err != nil {
+		failedPushedMetrics.WithLabelValues("failed-push").Inc()
+		return err
+	}
+	return nil
+}
+
+func handle_empty_result(query Query, when time.Time, sink Sink) error {
+	emptyQueryResults.WithLabelValues(query.Name).Inc()
+	switch query.OnEmpty {
+	case EmptyWarn:
+		log_throttle.Printf(query.Name+"/empty", "Query %v returned no series", query.Name)
+	case EmptyPushZero:
+		return push_sample(query, Sample{Name: query.Name, Value: 0, Timestamp: when}, sink)
+	case EmptyError:
+		err := fmt.Errorf("Query %v returned no series", query.Name)
+		count_failed_query(query, "empty_result", err)
+		return err
+	}
+	return nil
+}
+
+// series_name_and_tags works out the Datadog metric name and tags for a
+// series, keep is false if the series should be dropped.
+func series_name_and_tags(query Query, metric model.Metric) (name string, tags []string, keep bool, err error) {
+	if missing := missing_required_label(query, metric); missing != "" {
+		droppedSamples.WithLabelValues(query.Name, "missing-required-label").Inc()
+		log_throttle.Printf(query.Name+"/missing-required-label", "Dropping series of %v without required label %v: %v", query.Name, missing, metric)
+		return "", nil, false, nil
+	}
+	name = query.Name
+	name_labels := metric_name_labels(query.Name)
+	// Room for the computed tags and a trace_id appended by run_query
+	tags = make([]string, 0, len(metric)+len(query.Tags)+1)
+	for label, val := range metric {
+		switch {
+		case label == "__name__":
+			name = string(val)
+		case contains_label(name_labels, string(label)):
+			// Part of the metric name, filled in below
+		case query.ValueLabels != nil && string(label) == query.ValueLabels.Label:
+			// Picks the metric name below, not sent as a tag
+		case query.SetLabel != "" && string(label) == query.SetLabel:
+			// The set member, a tag would make every member its own set
+		case !keep_label(query, string(label)):
+			// Left out by include_labels or exclude_labels
+		default:
+			tags = append(tags, tagformat.Format(tag_key(query, string(label)), normalize_label_value(string(label), string(val))))
+		}
+	}
+	// Stable order regardless of map iteration, for -dogstatsd-output
+	sort.Strings(tags)
+
+	if query.ValueLabels != nil {
+		mapped, ok := query.ValueLabels.metric_name(metric)
+		if !ok {
+			droppedSamples.WithLabelValues(query.Name, "unmapped-value-label").Inc()
+			return "", nil, false, nil
+		}
+		name = mapped
+	}
+
+	if len(name_labels) > 0 {
+		rendered, ok := render_metric_name(query.Name, metric)
+		if !ok {
+			droppedSamples.WithLabelValues(query.Name, "missing-name-label").Inc()
+			return "", nil, false, nil
+		}
+		name = rendered
+	}
+
+	name = strings.TrimSpace(name)
+
+	if name == "" {
+		failedPushedMetrics.WithLabelValues("invalid-name").Inc()
+		return "", nil, false, fmt.Errorf("Invalid metric name from %v", query)
+	}
+	return name, tags, true, nil
+}
+
+func run_query(query Query, query_api prometheus.QueryAPI, when time.Time, sink Sink) error {
+	ctx := context.Background()
+	budget, policy := query_budget(query)
+	var pending *PendingSink
+	if budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+		if policy != TimeoutPushPartial {
+			pending = &PendingSink{sink: sink}
+			sink = pending
+		}
+	}
+
+	if query.Range > 0 {
+		err := run_range_query(ctx, query, query_api, when, sink, policy)
+		if err == nil && pending != nil {
+			err = pending.Commit()
+		}
+		return err
+	}
+	if len(query.Federate) > 0 {
+		err := run_federate(ctx, query, when, sink, policy)
+		if err == nil && pending != nil {
+			err = pending.Commit()
+		}
+		return err
+	}
+
 	var err error
-	results, err := query_api.Query(context.Background(), query.Query, when)
+	var results model.Value
+	if len(query.Regions) > 0 {
+		// Failures are counted per region
+		if results, err = query_regions(ctx, query, when); err != nil {
+			return err
+		}
+	} else if results, err = query_api.Query(ctx, query.Query, when); err != nil {
+		count_failed_query(query, query_error_class(err), err)
+		return err
+	}
+
+	vector, err := instant_vector(results)
+	if err != nil {
+		count_failed_query(query, query_error_class(err), err)
+		return err
+	}
+	if *use_external_labels && len(query.Regions) == 0 {
+		// Regional results get the labels of their own server
+		vector = add_external_labels(vector, *prometheus_addr)
+	}
+	debugf("Query %v returned %d series", query.Name, len(vector))
+	if vector, err = limit_vector(query, vector); err != nil {
+		return err
+	}
+
+	var exemplars []ExemplarSeries
+	if query.Exemplars != nil {
+		window := query.Exemplars.Window
+		if window == 0 {
+			window = query_interval(query, time.Duration(interval))
+		}
+		var exemplar_err error
+		if exemplars, exemplar_err = fetch_exemplars(*prometheus_addr, query.Query, when.Add(-window), when); exemplar_err != nil {
+			log_throttle.Printf(query.Name+"/exemplars", "Failed to fetch exemplars for %v: %v", query.Name, exemplar_err)
+		}
+		if query.Exemplars.Mode == "events" {
+			for _, event := range exemplar_events(query, exemplars) {
+				send_event(sink, event)
+			}
+		}
+	}
+
+	// Computed before tag_sampling aggregates any of the series
+	var summary []Sample
+	if query.Summary != nil {
+		summary = summarize(query, vector, when)
+	}
+
+	vector, aggregated, err := sample_tags(query, vector, when)
 	if err != nil {
-		failedQueries.WithLabelValues(query.Query).Inc()
 		return err
 	}
 
-	for _, sample := range results.(model.Vector) {
-		var tags []string
-		name := query.Name
-		for label, val := range sample.Metric {
-			switch label {
-			case "__name__":
-				name = string(val)
-			default:
-				tags = append(tags, fmt.Sprintf("%s:%s", label, val))
+	current_series := SeriesSet{}
+	var keepalive_samples []Sample
+	if len(vector) == 0 {
+		err = handle_empty_result(query, when, sink)
+	}
+
+	if query.Summary != nil {
+		if summary_err := push_summary(query, summary, sink); summary_err != nil {
+			return summary_err
+		}
+		if query.Summary.Only {
+			vector, aggregated = nil, nil
+		}
+	}
+
+	// The metrics of each label set are always pushed one after the other
+	vector, groups := group_series(query, vector)
+	series_sink := sink
+	var grouping *GroupingSink
+	if query.PushTogether {
+		grouping = &GroupingSink{sink: sink}
+		series_sink = grouping
+	}
+
+	for _, pushed := range aggregated {
+		if err = push_sample(query, pushed, sink); err != nil {
+			return err
+		}
+		current_series.Add(pushed.Name, pushed.Tags)
+		if query.KeepAlive > 0 {
+			keepalive_samples = append(keepalive_samples, pushed)
+		}
+	}
+
+	for i, sample := range vector {
+		if grouping != nil && i > 0 && groups[i] != groups[i-1] {
+			if err = grouping.Send(); err != nil {
+				return err
 			}
 		}
+		if ctx.Err() != nil {
+			// Series which weren't reached would be zero filled or
+			// reported as changed, so stop here
+			return budget_exceeded(ctx, query, policy, i, len(vector))
+		}
 
-		name = strings.TrimSpace(name)
+		name, tags, keep, name_err := series_name_and_tags(query, sample.Metric)
+		if name_err != nil {
+			return name_err
+		}
+		if !keep {
+			continue
+		}
 
-		if name == "" {
-			failedPushedMetrics.WithLabelValues("invalid-name").Inc()
-			return fmt.Errorf("Invalid metric name from %v", query)
+		computed, tag_err := render_tags(query, sample.Metric, float64(sample.Value))
+		if tag_err != nil {
+			return fmt.Errorf("Can't render tags for %v: %v", query.Name, tag_err)
 		}
+		tags = append(tags, computed...)
 
-		post_pushed_metric := func(metric_type string) {
-			pushedMetrics.WithLabelValues(name, name, metric_type).Inc()
+		if query.Exemplars != nil && query.Exemplars.Mode == "tags" {
+			if trace_id := latest_trace_id(query.Exemplars, exemplars, sample.Metric); trace_id != "" {
+				tags = append(tags, tagformat.Format("trace_id", trace_id))
+			}
 		}
 
-		switch query.Type {
-		case Gauge:
-			err = statsd_client.Gauge(name, float64(sample.Value), tags, 1)
-			post_pushed_metric("gauge")
-		case Counter:
-			err = statsd_client.Count(name, int64(sample.Value), tags, 1)
-			post_pushed_metric("counter")
-		case Histogram:
-			err = statsd_client.Histogram(name, float64(sample.Value), tags, 1)
-			post_pushed_metric("histogram")
-		case Milliseconds:
-			err = statsd_client.TimeInMilliseconds(name, float64(sample.Value), tags, 1)
-			post_pushed_metric("milliseconds")
-		default:
-			return fmt.Errorf("Can't handle %g", query.Type)
+		pushed := Sample{Name: name, Value: float64(sample.Value), Tags: tags, Timestamp: sample.Timestamp.Time()}
+		if query.SetLabel != "" {
+			member, ok := sample.Metric[model.LabelName(query.SetLabel)]
+			if !ok {
+				droppedSamples.WithLabelValues(query.Name, "missing-set-label").Inc()
+				continue
+			}
+			pushed.SetMember = string(member)
 		}
-		if err != nil {
-			failedPushedMetrics.WithLabelValues("failed-push").Inc()
+		if err = push_sample(query, pushed, series_sink); err != nil {
 			return err
 		}
+		current_series.Add(name, tags)
+		if query.KeepAlive > 0 {
+			keepalive_samples = append(keepalive_samples, pushed)
+		}
+	}
+	if grouping != nil {
+		if send_err := grouping.Send(); send_err != nil {
+			return send_err
+		}
+	}
+
+	if len(query.TimeShifts) > 0 {
+		if shift_err := push_time_shifts(ctx, query, query_api, when, sink); shift_err != nil {
+			return shift_err
+		}
+	}
+
+	if query.KeepAlive > 0 {
+		keepalive.Update(query, keepalive_samples, clock.Now())
+	}
+
+	if query.Cumulative {
+		forget_counter_totals(query, current_series)
+	}
+
+	if query.ChangeEvents != nil {
+		if event := series_change_event(query, current_series); event != nil {
+			send_event(sink, event)
+		}
+	}
+
+	if query.ZeroFill {
+		if fill_err := zero_fill_series(query, current_series, when, sink); fill_err != nil {
+			return fill_err
+		}
+	}
+
+	if pending != nil {
+		if commit_err := pending.Commit(); commit_err != nil {
+			return commit_err
+		}
 	}
 	return err
 }
 
-func start_querying(ticker *time.Ticker, queries Queries, query_api prometheus.QueryAPI, statsd_client *statsd.Client) {
+// run_cycle runs every query once for the cycle starting at now, returning
+// the cycle's snapshot and the interval until the next cycle (and whether it
+// changed).
+func run_cycle(now time.Time, adaptive *AdaptiveInterval, splay *Splay, query_set *QuerySet, query_api prometheus.QueryAPI, sink Sink, watchdog *ScheduleWatchdog) (*Snapshot, time.Duration, bool) {
+	pushed_back := false
+	// Time spent querying, excluding waiting for splay offsets
+	var busy time.Duration
+	quota_tracker.StartCycle()
+	snapshot := &SnapshotSink{}
+	cycle_sink := MultiSink{sink, snapshot}
+	interval := adaptive.Current()
+	// Splay offsets win over priorities, which then only decide shedding
+	for _, query := range splay.Order(by_priority(query_set.Queries())) {
+		splay.Wait(query.Name, now)
+		if query_set.Muted(query.Name, now) {
+			// Muted queries are skipped on purpose, not missed
+			watchdog.Ran(query.Name, clock.Now())
+			continue
+		}
+		if !query_set.Due(query, now, interval) {
+			continue
+		}
+		if shed(query, now, interval) {
+			shedQueries.WithLabelValues(query.Name).Inc()
+			log_throttle.Printf(query.Name+"/shed", "Shedding low priority query %v, the cycle has taken longer than %v", query.Name, interval)
+			// Shedding is on purpose too
+			watchdog.Ran(query.Name, clock.Now())
+			continue
+		}
+		started := clock.Now()
+		query_set.Ran(query, now)
+		queryInterval.WithLabelValues(query.Name).Set(query_interval(query, interval).Seconds())
+		queryNextRun.WithLabelValues(query.Name).Set(float64(next_run(query, now, interval).Unix()))
+		if err := run_query_once(query, query_api, now, cycle_sink); err == errOverlappingRun || err == errShuttingDown {
+			log_throttle.Printf(query.Name+"/overlap", "Skipping query %v: %v", query.Name, err)
+		} else if err != nil {
+			class := query_error_class(err)
+			log_throttle.Printf(query.Name+"/"+class, "Query %v failed (%v): %v", query.Name, class, err)
+			pushed_back = pushed_back || prometheus_pushed_back(err)
+		}
+		busy += clock.Now().Sub(started)
+		watchdog.Ran(query.Name, clock.Now())
+	}
+	if err := sink.Flush(); err != nil {
+		log_throttle.Printf("flush/"+error_class(err), "Failed to flush sink: %v", err)
+	}
+	cycle_snapshot := snapshot.Snapshot(now)
+	publish_snapshot(cycle_snapshot)
+	if comparison != nil {
+		comparison.Run(now, cycle_snapshot, query_api)
+	}
+	schedulerUtilization.Set(busy.Seconds() / interval.Seconds())
+	next, changed := adaptive.Observe(busy, pushed_back)
+	return cycle_snapshot, next, changed
+}
 
-	go func() {
-		for now := range ticker.C {
-			for _, query := range queries {
-				run_query(query, query_api, now, statsd_client)
-			}
+// run_once runs every query a single time, returning the exit status.
+func run_once(query_set *QuerySet, query_api prometheus.QueryAPI, sink Sink) int {
+	status := 0
+	now := time.Now()
+	for _, query := range by_priority(query_set.Queries()) {
+		if err := run_query(query, query_api, now, sink); err != nil {
+			log.Printf("Query %v failed: %v", query.Name, err)
+			status = 1
 		}
-	}()
+	}
+	if err := sink.Close(); err != nil {
+		log.Printf("Failed to close sink: %v", err)
+		status = 1
+	}
+	return status
 }
 
 func init() {
+	prometheus_metrics.MustRegister(httpClientRequests)
+	prometheus_metrics.MustRegister(httpClientDuration)
+	prometheus_metrics.MustRegister(effectiveInterval)
+	prometheus_metrics.MustRegister(configInfo)
+	prometheus_metrics.MustRegister(reloadsTotal)
 	prometheus_metrics.MustRegister(pushedMetrics)
 	prometheus_metrics.MustRegister(failedQueries)
 	prometheus_metrics.MustRegister(failedPushedMetrics)
+	prometheus_metrics.MustRegister(emptyQueryResults)
+	prometheus_metrics.MustRegister(droppedSamples)
+	prometheus_metrics.MustRegister(zeroFilledSeries)
+	prometheus_metrics.MustRegister(tagSampledSeries)
+	prometheus_metrics.MustRegister(queryTimeouts)
+	prometheus_metrics.MustRegister(federateBatches)
+	prometheus_metrics.MustRegister(overlappingRuns)
+	prometheus_metrics.MustRegister(pushedBytes)
+	prometheus_metrics.MustRegister(pushedDatagrams)
+	prometheus_metrics.MustRegister(suppressedLogMessages)
+	prometheus_metrics.MustRegister(apiBatches)
+	prometheus_metrics.MustRegister(apiBatchPoints)
+	prometheus_metrics.MustRegister(apiBatchRetries)
+	prometheus_metrics.MustRegister(tenantQuotaExceeded)
+	prometheus_metrics.MustRegister(comparisonDifferences)
+	prometheus_metrics.MustRegister(logsSubmissions)
+	prometheus_metrics.MustRegister(missedRuns)
+	prometheus_metrics.MustRegister(shedQueries)
+	prometheus_metrics.MustRegister(keepaliveSamples)
+	prometheus_metrics.MustRegister(counterResets)
+	prometheus_metrics.MustRegister(negativeValues)
+	prometheus_metrics.MustRegister(assertionFailures)
+	prometheus_metrics.MustRegister(maxSamplesExceeded)
+	prometheus_metrics.MustRegister(lossyCountConversions)
+	prometheus_metrics.MustRegister(routedSamples)
+	prometheus_metrics.MustRegister(lastCycleDuration)
+	prometheus_metrics.MustRegister(lastCycleLag)
+	prometheus_metrics.MustRegister(rejectedHTTPRequests)
+	prometheus_metrics.MustRegister(rejectedAdminCalls)
+	prometheus_metrics.MustRegister(backgroundGoroutines)
+	prometheus_metrics.MustRegister(schedulerPaused)
+	prometheus_metrics.MustRegister(haLeader)
+	prometheus_metrics.MustRegister(haLeaderChanges)
+	prometheus_metrics.MustRegister(haCheckpoints)
+	prometheus_metrics.MustRegister(remoteWriteRequests)
+	prometheus_metrics.MustRegister(remoteWriteSamples)
+	prometheus_metrics.MustRegister(remoteWriteRollups)
+	prometheus_metrics.MustRegister(schedulerUtilization)
+	prometheus_metrics.MustRegister(queryNextRun)
+	prometheus_metrics.MustRegister(queryInterval)
+	prometheus_metrics.MustRegister(inFlightQueries)
+	prometheus_metrics.MustRegister(apiSubmitters)
+	prometheus_metrics.MustRegister(apiSubmittersBusy)
+	prometheus_metrics.MustRegister(lastCyclePushedBytes)
+	prometheus_metrics.MustRegister(lastCyclePushedDatagrams)
+}
+
+// new_dogstatsd_sink returns a sink sending to the dogstatsd agent at
+// address.
+func new_dogstatsd_sink(address string) (*DogstatsdSink, error) {
+	statsd_client, err := statsd.New(address)
+	if err != nil {
+		return nil, err
+	}
+	// Lets the agent attribute metrics to the right container (origin
+	// detection), as the official clients do.
+	if entity_id := os.Getenv("DD_ENTITY_ID"); entity_id != "" {
+		statsd_client.Tags = append(statsd_client.Tags, "dd.internal.entity_id:"+entity_id)
+	}
+	dogstatsd_sink := NewDogstatsdSink(statsd_client, default_namespace, *hostname)
+	if dogstatsd_sink.conn, err = net.Dial("udp", address); err != nil {
+		return nil, err
+	}
+	return dogstatsd_sink, nil
+}
+
+// api_tls_config is the TLS configuration of the Datadog API and Logs
+// connections, from the -api-tls-* flags.
+func api_tls_config() (*tls.Config, error) {
+	return client_tls_config(TLSFiles{
+		CAFile:             *api_tls_ca_file,
+		CertFile:           *api_tls_cert_file,
+		KeyFile:            *api_tls_key_file,
+		InsecureSkipVerify: *api_tls_insecure,
+	})
+}
+
+// new_api_sink returns a sink submitting to the Datadog API at url with key,
+// using the -api-* settings. transport names it in the HTTP client metrics.
+func new_api_sink(url, key, transport string, interval time.Duration) (*APISink, error) {
+	tls_config, err := api_tls_config()
+	if err != nil {
+		return nil, err
+	}
+	if *api_compression != "none" && *api_compression != "gzip" {
+		return nil, fmt.Errorf("Unknown api compression %v (expected none or gzip)", *api_compression)
+	}
+	return NewAPISink(APISinkConfig{
+		URL:         url,
+		APIKey:      key,
+		Namespace:   default_namespace,
+		Hostname:    *hostname,
+		Interval:    interval,
+		MaxPoints:   *api_max_points,
+		MaxBytes:    *api_max_bytes,
+		Submitters:  *api_submitters,
+		MaxRetries:  *api_max_retries,
+		MaxQueued:   *api_max_queued,
+		Compression: *api_compression,
+		Client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: NewInstrumentedTransport(transport, &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tls_config}),
+		},
+		WaitWhenFull: pflag.Arg(0) == "backfill",
+	}), nil
+}
+
+// new_destination_sink returns the sink of a -route destination.
+func new_destination_sink(destination string, interval time.Duration) (Sink, error) {
+	kind := strings.SplitN(destination, ":", 2)
+	if kind[0] == "dogstatsd" {
+		return new_dogstatsd_sink(kind[1])
+	}
+	key := os.Getenv(kind[1])
+	if key == "" {
+		return nil, fmt.Errorf("%v isn't set", kind[1])
+	}
+	return new_api_sink(*api_url, key, "datadog-api", interval)
 }
 
 func main() {
-	flag.Var(&queries, "query", "Prometheus query (in form type:datadog_metric_name:prometheus_query). Can be specified multiple times.")
-	flag.Parse()
+	flag.Var(&interval, "interval", "How often to query Prometheus, as a duration (e.g. 30s or 2m) or a number of seconds.")
+	repeatable_var(&queries, "query", "Prometheus query (in form type:datadog_metric_name:prometheus_query). Can be specified multiple times.")
+	repeatable_var(only_queries, "only", "Only run these queries (comma separated names), e.g. while debugging one of them. Can be specified multiple times.")
+	repeatable_var(skip_queries, "skip", "Don't run these queries (comma separated names). Can be specified multiple times.")
+	repeatable_var(label_rules, "normalize-label", "Label value normalization (in form label:rule[,rule...], label can be * for all labels). Rules are lowercase, uppercase, trim and collapse-whitespace. Can be specified multiple times.")
+	flag.Var(&query_method, "prometheus-query-method", "HTTP method for sending queries to Prometheus: POST (default, expressions in the request body, needs Prometheus 2.1 or later) or GET (expressions in the URL).")
+	repeatable_var(label_map, "map-label", "Send a label as a differently named tag (in form label=tag, e.g. kubernetes_namespace=kube_namespace), queries' label_map takes precedence. Can be specified multiple times.")
+	repeatable_var(label_value_maps, "map-label-value", "Replace a specific label value after normalization (in form label:from=to, label can be * for all labels). Can be specified multiple times.")
+	flag.Var(&query_label_mode, "query-label-mode", "How queries are shown in the query label of the bridge's own metrics: raw, truncate (collapse whitespace and truncate), hash or name (the Datadog metric name).")
+	repeatable_var(&plugin_specs, "plugin", "Go plugin providing an extra sink and/or sample enricher (in form path.so or path.so=config). Can be specified multiple times.")
+	repeatable_var(prometheus_regions, "prometheus-region", "Prometheus server of a region (in form name=address), for queries with regions. Can be specified multiple times.")
+	repeatable_var(query_vars, "var", "Variable substituted into query expressions as {{.name}} (in form name=value), e.g. environment=prod. Can be specified multiple times.")
+	repeatable_var(&sink_routes, "route", "Send samples matching a tag or metric name to another destination than -sink (in form tag:<tag>=<destination> or name:<glob>=<destination>, destination is dogstatsd:<address> or api:<environment variable holding the API key>), e.g. tag:team:payments=api:PAYMENTS_DD_API_KEY. The first matching route wins. Can be specified multiple times.")
+	repeatable_var(tenant_quotas, "tenant-quota", "Limit the samples pushed per cycle and distinct metric names for the queries of a tenant (in form tenant:max_samples=N,max_names=N, tenant can be * for any tenant without its own quota, queries without a tenant are in the default tenant). Can be specified multiple times.")
+	repeatable_var(remote_write_rollups, "remote-write-metric-rollup", "Roll up a remote_write metric differently to -remote-write-rollup (in form metric:rollup, e.g. http_requests_total:last). Can be specified multiple times.")
+	repeatable_var(push_grouping_headers, "push-grouping-header", "Tag the samples pushed to -remote-write or -pushgateway with a request header, over the grouping key of the path (in form header:label, e.g. X-Scope-OrgID:tenant). Can be specified multiple times.")
+	repeatable_var(coercion_policies, "count-coercion", "How fractional values of a count type become integers (in form type:policy, type is counter or count_per_run, policy is truncate, round, floor or error to fail the query). Counters truncate and count_per_run rounds by default. Can be specified multiple times.")
+	repeatable_var(negative_policies, "negative-policy", "What to do with negative values of a metric type (in form type:policy, policy is allow, drop, clamp to zero or gauge to send as a gauge). Negative counters are dropped by default. Can be specified multiple times.")
+	repeatable_var(&discover_matchers, "discover", "Generate a query for every metric family matching this series selector (e.g. {job=\"node\"}), using the -discover-*-template flags. Can be specified multiple times.")
+	flag.Var(&overlap_policy, "on-overlap", "What to do with a query run due while a previous run of the query is still in progress (e.g. started by Admin.RunQueryOnce): skip (default) or queue (wait for it, at most one run waiting per query).")
+	flag.Var(&timeout_policy, "on-query-timeout", "What to do with the results of a query which runs out of its time budget part way through: discard (default) or push_partial. Can be overridden per query.")
+	flag.Var(&log_level, "log-level", "Log level: error, warn, info or debug. Send SIGUSR1 to raise or SIGUSR2 to lower it at runtime (which also logs the scheduler state).")
+	if err := parse_flags(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if pflag.Arg(0) == "init" {
+		os.Exit(run_init(pflag.Args()[1:]))
+	}
+	if pflag.Arg(0) == "format-tags" {
+		os.Exit(run_format_tags(os.Stdin, os.Stdout))
+	}
+
+	set_log_level(log_level)
+	log_throttle = NewLogThrottle(*log_interval)
+	namespace, err := parse_namespace(*namespace_flag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	default_namespace = namespace
+
+	prometheus_base_transport := prometheus.DefaultTransport
+	if query_method == QueryPost {
+		prometheus_base_transport = NewPostQueryTransport(prometheus_base_transport)
+	}
+	prometheus_transport := NewInstrumentedTransport("prometheus", prometheus_base_transport)
+	prometheus_http_client = &http.Client{Transport: prometheus_transport}
+	for region, address := range prometheus_regions {
+		region_client, err := prometheus.New(prometheus.Config{Address: address, Transport: prometheus_transport})
+		if err != nil {
+			log.Fatalf("Invalid address for region %v: %v", region, err)
+		}
+		regional_query_apis[region] = prometheus.NewQueryAPI(region_client)
+	}
+
+	if pflag.Arg(0) == "validate" {
+		problems := validate_config()
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
-	statsd_client, err := statsd.New(*dogstatsd_addr)
+	if len(discover_matchers) > 0 {
+		if discovery, err = NewDiscovery(discover_matchers, *discover_name, *discover_query, *discover_counter_query); err != nil {
+			log.Fatal(err)
+		}
+		if _, err = discovery.Discover(); err != nil {
+			log.Fatalf("Discovery failed: %v", err)
+		}
+	}
+
+	query_set := NewQuerySet(nil)
+	loaded, err := reload_queries(query_set)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	if *compare_query_file != "" {
+		if comparison, err = NewComparison(*compare_query_file, *compare_tolerance); err != nil {
+			log.Fatalf("Can't load -compare-query-file: %v", err)
+		}
+	}
+	for _, requirement := range timing_requirements(loaded) {
+		log.Printf("Timing aggregates: %v", requirement)
 	}
-	defer statsd_client.Close()
 
-	statsd_client.Namespace = "prometheus."
+	duration := time.Duration(interval)
 
-	prometheus_config := prometheus.Config{Address: *prometheus_addr}
-	prometheus_client, err := prometheus.New(prometheus_config)
+	var backfill BackfillOptions
+	var simulation SimulateOptions
+	switch pflag.Arg(0) {
+	case "", "once":
+	case "backfill":
+		if backfill, err = parse_backfill_args(pflag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		if *sink_type != "api" && !*dry_run {
+			log.Fatal("backfill needs -sink api, dogstatsd can't send timestamps")
+		}
+		// Counts cover one step rather than one interval
+		duration = backfill.Step
+	case "simulate":
+		if simulation, err = parse_simulate_args(pflag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(run_simulation(simulation, query_set, duration))
+	case "lint":
+		findings := lint_queries(loaded)
+		for _, finding := range findings {
+			fmt.Println(finding)
+		}
+		if len(findings) > 0 {
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command %v", pflag.Arg(0))
+	}
+
+	http_auth, err := NewHTTPAuth(*http_auth_token, *http_basic_auth, *http_tls_client_ca, *admin_insecure)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	server_tls, err := server_tls_config(TLSServerFiles{CertFile: *http_tls_cert_file, KeyFile: *http_tls_key_file, ClientCAFile: *http_tls_client_ca})
+	if err != nil {
+		log.Fatalf("Can't set up HTTPS: %v", err)
+	}
+
+	if *hostname == "" {
+		if *hostname, err = os.Hostname(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var sink Sink
+	sink_kind := *sink_type
+	if *dry_run {
+		sink_kind = "dry-run"
+	}
+	switch sink_kind {
+	case "dry-run":
+		sink = NewPrintSink(os.Stdout, default_namespace)
+	case "dogstatsd":
+		dogstatsd_sink, err := new_dogstatsd_sink(*dogstatsd_addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch *dogstatsd_output {
+		case "":
+		case "-":
+			dogstatsd_sink.output = os.Stdout
+		default:
+			if dogstatsd_sink.output, err = os.Create(*dogstatsd_output); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *dogstatsd_aggregation {
+			dogstatsd_sink.aggregator = NewDogstatsdAggregator(*dogstatsd_extended_agg)
+			start_dogstatsd_aggregation(dogstatsd_sink, *dogstatsd_agg_interval)
+		}
+		sink = dogstatsd_sink
+	case "api":
+		if *api_key == "" {
+			log.Fatal("The api sink needs -datadog-api-key")
+		}
+		if sink, err = new_api_sink(*api_url, *api_key, "datadog-api", duration); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown sink %v (expected dogstatsd or api)", *sink_type)
+	}
+	if len(sink_routes) > 0 && !*dry_run {
+		if sink, err = NewRoutingSink(sink_routes, sink, func(destination string) (Sink, error) {
+			return new_destination_sink(destination, duration)
+		}); err != nil {
+			log.Fatal(err)
+		}
+		for _, route := range sink_routes {
+			log.Printf("Routing %v", route)
+		}
+	}
+	for _, spec := range plugin_specs {
+		plugin_sink, enricher, err := load_plugin(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if plugin_sink != nil && !*dry_run {
+			sink = MultiSink{sink, plugin_sink}
+		}
+		if enricher != nil {
+			enrichers = append(enrichers, enricher)
+		}
+	}
+	if *secondary_api_key != "" && !*dry_run {
+		url := *secondary_api_url
+		if url == "" {
+			url = *api_url
+		}
+		secondary, err := new_api_sink(url, *secondary_api_key, "datadog-api-secondary", duration)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sink = DoubleWriteSink{primary: sink, secondary: secondary}
+	}
+	if *logs_url != "" && !*dry_run {
+		if *api_key == "" {
+			log.Fatal("-datadog-logs-url needs -datadog-api-key")
+		}
+		tls_config, err := api_tls_config()
+		if err != nil {
+			log.Fatal(err)
+		}
+		logs_sink := NewLogsSink(*logs_url, *api_key, default_namespace, *hostname, *api_compression, &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: NewInstrumentedTransport("datadog-logs", &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tls_config}),
+		})
+		sink = LogRoutingSink{metrics: sink, logs: logs_sink}
+	}
+	if *recent_metrics_size > 0 {
+		recent_metrics = NewRecentSink(*recent_metrics_size)
+		sink = MultiSink{sink, recent_metrics}
+	}
+
+	var prometheus_query_api prometheus.QueryAPI
+	if *replay_fixtures != "" {
+		if *record_fixtures != "" {
+			log.Fatal("-record-fixtures and -replay-fixtures can't be used together")
+		}
+		if prometheus_query_api, err = NewFixtureQueryAPI(*replay_fixtures); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		prometheus_config := prometheus.Config{Address: *prometheus_addr, Transport: prometheus_transport}
+		prometheus_client, err := prometheus.New(prometheus_config)
+		if err != nil {
+			panic(err)
+		}
+		prometheus_query_api = prometheus.NewQueryAPI(prometheus_client)
+	}
+	if *record_fixtures != "" {
+		prometheus_query_api = NewRecordingQueryAPI(prometheus_query_api, *record_fixtures)
 	}
 
-	prometheus_query_api := prometheus.NewQueryAPI(prometheus_client)
+	if pflag.Arg(0) == "once" {
+		os.Exit(run_once(query_set, prometheus_query_api, sink))
+	}
+	if pflag.Arg(0) == "backfill" {
+		os.Exit(run_backfill(backfill, query_set, prometheus_query_api, sink))
+	}
 
-	duration := time.Duration(*interval) * time.Second
-	ticker := time.NewTicker(duration)
-	start_querying(ticker, queries, prometheus_query_api, statsd_client)
+	adaptive := NewAdaptiveInterval(duration, *max_interval)
+	keepalive = NewKeepAlive(adaptive)
+	start_keepalive(keepalive, query_set, sink)
+
+	watchdog := NewScheduleWatchdog(time.Now())
+	var splay *Splay
+	if *splay_enabled {
+		if splay, err = NewSplay(*splay_state_file, duration); err != nil {
+			log.Fatalf("Can't load splay state: %v", err)
+		}
+	}
+	scheduler := NewScheduler(adaptive, splay, query_set, prometheus_query_api, sink, watchdog)
+	if *ha_state_store != "" {
+		store, err := new_state_store(*ha_state_store)
+		if err != nil {
+			log.Fatal(err)
+		}
+		id := *ha_id
+		if id == "" {
+			id = *hostname
+		}
+		scheduler.election = NewLeaderElection(store, id, *ha_lease_duration)
+		if leading, err := scheduler.election.Campaign(time.Now()); err != nil {
+			log.Printf("Failed to campaign for the HA lease: %v", err)
+		} else if !leading {
+			log.Printf("Standing by as %v, the other bridge of the HA pair leads", id)
+		}
+		start_leader_election(scheduler.election)
+	}
+	cycles_done := scheduler.Run(stopping_context())
+	start_watchdog(watchdog, query_set, adaptive)
+	handle_verbosity_signals(query_set, watchdog)
+	handle_reload_signal(query_set)
+	if discovery != nil {
+		start_discovery(discovery, query_set, *discover_interval)
+	}
+
+	if *admin_addr != "" {
+		admin := &Admin{query_set: query_set, query_api: prometheus_query_api, sink: sink, scheduler: scheduler}
+		if err := serve_admin(*admin_addr, admin, server_tls, http_auth); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	http.Handle("/metrics", prometheus_metrics.Handler())
-	http.ListenAndServe(*listen_addr, nil)
+	if *remote_write || *pushgateway {
+		if !http_auth.enabled() && !http_auth.Insecure {
+			log.Fatal("-remote-write and -pushgateway need -http-auth-token, -http-basic-auth or -http-tls-client-ca-file, or -admin-insecure")
+		}
+		rollup, err := parse_rollup(*remote_write_rollup)
+		if err != nil {
+			log.Fatal(err)
+		}
+		receiver := NewRemoteWriteRollup(*remote_write_bucket, *remote_write_delay, rollup, remote_write_rollups, sink)
+		start_remote_write_rollup(receiver)
+		if *remote_write {
+			// With a grouping key after it too
+			http.Handle("/api/v1/write", http_auth.Wrap(receiver))
+			http.Handle("/api/v1/write/", http_auth.Wrap(receiver))
+		}
+		if *pushgateway {
+			http.Handle("/metrics/job/", http_auth.Wrap(http.HandlerFunc(receiver.ServePush)))
+		}
+	}
+	http.Handle("/snapshot", http_auth.Wrap(http.HandlerFunc(serve_snapshot)))
+	http.Handle("/reloads", http_auth.Wrap(http.HandlerFunc(serve_reloads)))
+	http.Handle("/debug", http_auth.Wrap(http.HandlerFunc(serve_debug)))
+	if recent_metrics != nil {
+		http.Handle("/recent_metrics", http_auth.Wrap(http.HandlerFunc(serve_recent_metrics)))
+	}
+	if comparison != nil {
+		http.Handle("/compare", http_auth.Wrap(http.HandlerFunc(serve_comparison)))
+		http.Handle("/shadow/diff", http_auth.Wrap(http.HandlerFunc(serve_comparison)))
+	}
+	server := &http.Server{Addr: *listen_addr, TLSConfig: server_tls}
+	shutdown := handle_shutdown_signal(cycles_done, sink, server, *shutdown_timeout)
+	if server_tls != nil {
+		// The certificate is in the TLS configuration
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdown
 }
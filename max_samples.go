@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// MaxSamplesPolicy decides what happens to a result with more series than
+// the query's max_samples, e.g. from a bad expression which would flood
+// dogstatsd.
+type MaxSamplesPolicy string
+
+const (
+	// MaxSamplesSkip pushes nothing and fails the query.
+	MaxSamplesSkip MaxSamplesPolicy = "skip"
+	// MaxSamplesTruncate pushes the first max_samples series, in label
+	// order so the same series are kept from run to run.
+	MaxSamplesTruncate MaxSamplesPolicy = "truncate"
+)
+
+func (policy *MaxSamplesPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	switch MaxSamplesPolicy(value) {
+	case "", MaxSamplesSkip, MaxSamplesTruncate:
+		*policy = MaxSamplesPolicy(value)
+		return nil
+	}
+	return fmt.Errorf("Can't handle on_max_samples %v (expected skip or truncate)", value)
+}
+
+// MaxSamplesError is a result skipped for having more series than the
+// query's max_samples.
+type MaxSamplesError struct {
+	Query    string
+	Returned int
+	Max      int
+}
+
+func (err *MaxSamplesError) Error() string {
+	return fmt.Sprintf("Query %v returned %d series, over its max_samples of %d", err.Query, err.Returned, err.Max)
+}
+
+// limit_series applies a query's max_samples to the number of series it
+// returned, returning how many to keep or a MaxSamplesError if the result
+// is skipped.
+func limit_series(query Query, returned int) (int, error) {
+	if query.MaxSamples <= 0 || returned <= query.MaxSamples {
+		return returned, nil
+	}
+	policy := query.OnMaxSamples
+	if policy == "" {
+		policy = MaxSamplesSkip
+	}
+	maxSamplesExceeded.WithLabelValues(query.Name, string(policy)).Inc()
+	if policy == MaxSamplesTruncate {
+		log_throttle.Printf(query.Name+"/max-samples", "Query %v returned %d series, pushing the first %d (max_samples)", query.Name, returned, query.MaxSamples)
+		return query.MaxSamples, nil
+	}
+	err := &MaxSamplesError{Query: query.Name, Returned: returned, Max: query.MaxSamples}
+	count_failed_query(query, "max_samples", err)
+	return 0, err
+}
+
+// limit_vector applies a query's max_samples to an instant result.
+func limit_vector(query Query, vector model.Vector) (model.Vector, error) {
+	keep, err := limit_series(query, len(vector))
+	if err != nil || keep == len(vector) {
+		return vector, err
+	}
+	sort.Slice(vector, func(i, j int) bool {
+		return vector[i].Metric.Before(vector[j].Metric)
+	})
+	return vector[:keep], nil
+}
+
+// limit_matrix applies a query's max_samples to the series of a range
+// result, whatever their number of points.
+func limit_matrix(query Query, matrix model.Matrix) (model.Matrix, error) {
+	keep, err := limit_series(query, len(matrix))
+	if err != nil || keep == len(matrix) {
+		return matrix, err
+	}
+	sort.Slice(matrix, func(i, j int) bool {
+		return matrix[i].Metric.Before(matrix[j].Metric)
+	})
+	return matrix[:keep], nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// name_placeholder matches the {label} placeholders of a templated metric
+// name, e.g. http.requests.{method}.{code}.
+var name_placeholder = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// invalid_name_part matches what Datadog doesn't keep in metric names, label
+// values become underscores there rather than being changed by Datadog.
+var invalid_name_part = regexp.MustCompile(`[^a-zA-Z0-9_.]`)
+
+// metric_name_labels returns the labels a metric name interpolates, none for
+// plain names.
+func metric_name_labels(name string) []string {
+	if !strings.Contains(name, "{") {
+		return nil
+	}
+	var labels []string
+	for _, match := range name_placeholder.FindAllStringSubmatch(name, -1) {
+		labels = append(labels, match[1])
+	}
+	return labels
+}
+
+// render_metric_name fills in a templated metric name from a series' label
+// values, false if one of them is missing or empty.
+func render_metric_name(name string, metric model.Metric) (string, bool) {
+	ok := true
+	rendered := name_placeholder.ReplaceAllStringFunc(name, func(placeholder string) string {
+		label := placeholder[1 : len(placeholder)-1]
+		value := normalize_label_value(label, string(metric[model.LabelName(label)]))
+		if value == "" {
+			ok = false
+		}
+		return invalid_name_part.ReplaceAllString(value, "_")
+	})
+	return rendered, ok
+}
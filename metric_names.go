@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// invalid_name_characters corrupt the dogstatsd datagram: | and : separate
+// the fields, @ marks the sample rate and a newline ends the datagram.
+const invalid_name_characters = "|:@\n"
+
+func validate_metric_name(name string) error {
+	if i := strings.IndexAny(name, invalid_name_characters); i >= 0 {
+		return fmt.Errorf("Metric name %q contains %q, which isn't allowed in dogstatsd names", name, name[i])
+	}
+	return nil
+}
+
+// validate_query_names checks the names known when queries are loaded,
+// names which come from __name__ or plugins are checked when pushed.
+func validate_query_names(loaded Queries) error {
+	for _, query := range loaded {
+		if err := validate_metric_name(query.Name); err != nil {
+			return fmt.Errorf("Query %v: %v", query.Name, err)
+		}
+		if query.ValueLabels != nil {
+			for _, name := range query.ValueLabels.Names {
+				if err := validate_metric_name(name); err != nil {
+					return fmt.Errorf("Query %v value_labels: %v", query.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
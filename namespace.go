@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var valid_namespace = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*(\.[a-zA-Z0-9_]+)*$`)
+
+// parse_namespace validates a metric namespace, accepting the old trailing
+// dot form ("prometheus.") for compatibility. An empty namespace is valid and
+// leaves metric names as they are.
+func parse_namespace(namespace string) (string, error) {
+	namespace = strings.TrimSuffix(namespace, ".")
+	if namespace != "" && !valid_namespace.MatchString(namespace) {
+		return "", fmt.Errorf("Invalid namespace %q (expected dot separated words starting with a letter)", namespace)
+	}
+	return namespace, nil
+}
+
+// namespaced joins a namespace and a metric name.
+func namespaced(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// metric_name is the name a sample is sent to Datadog as, using the query's
+// namespace if it overrides the sink's.
+func (sample Sample) metric_name(namespace string) string {
+	if sample.Namespace != nil {
+		namespace = *sample.Namespace
+	}
+	return namespaced(namespace, sample.Name)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NegativePolicy decides what happens to negative values of a metric type.
+type NegativePolicy string
+
+const (
+	NegativeAllow NegativePolicy = "allow"
+	NegativeDrop  NegativePolicy = "drop"
+	NegativeClamp NegativePolicy = "clamp"
+	NegativeGauge NegativePolicy = "gauge"
+)
+
+// NegativePolicies maps metric types to their negative value policy. Counts
+// can't be negative so counters default to dropping them.
+type NegativePolicies map[QueryType]NegativePolicy
+
+func (flags NegativePolicies) String() string {
+	return "NegativePolicies"
+}
+
+func (flags NegativePolicies) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Negative value policy must be in the form type:policy (%v)", value)
+	}
+	query_type, err := parse_query_type(parts[0])
+	if err != nil {
+		return fmt.Errorf("%v (%v)", err, value)
+	}
+	switch policy := NegativePolicy(parts[1]); policy {
+	case NegativeAllow, NegativeDrop, NegativeClamp, NegativeGauge:
+		flags[query_type] = policy
+		return nil
+	}
+	return fmt.Errorf("Can't handle negative value policy %v (expected allow, drop, clamp or gauge)", parts[1])
+}
+
+// apply_negative_policy returns the sample to push, or false if it should be
+// dropped.
+func apply_negative_policy(sample Sample) (Sample, bool) {
+	if sample.Value >= 0 {
+		return sample, true
+	}
+	policy, ok := negative_policies[sample.Type]
+	if !ok || policy == NegativeAllow {
+		return sample, true
+	}
+	negativeValues.WithLabelValues(sample.Query, string(policy)).Inc()
+	switch policy {
+	case NegativeDrop:
+		return sample, false
+	case NegativeClamp:
+		sample.Value = 0
+	case NegativeGauge:
+		sample.Type = Gauge
+	}
+	return sample, true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// OpenMetricsConfig is the part of a Datadog agent OpenMetrics check
+// configuration the bridge understands, either the whole conf.yaml or a
+// single instance.
+type OpenMetricsConfig struct {
+	Instances           []OpenMetricsInstance `yaml:"instances"`
+	OpenMetricsInstance `yaml:",inline"`
+}
+
+type OpenMetricsInstance struct {
+	Namespace string        `yaml:"namespace"`
+	Metrics   []interface{} `yaml:"metrics"`
+}
+
+var openmetrics_plain_name = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// load_openmetrics_file translates the metrics: entries of an OpenMetrics
+// check configuration into queries, following what the agent would send:
+//
+//   - go_goroutines sends the metric as is
+//   - process_cpu_seconds_total: process.cpu renames it
+//   - process_cpu_seconds_total: {name: process.cpu, type: gauge} renames it
+//     and overrides the type
+//   - node_.* sends every matching metric under its own name
+//
+// Counters (*_total) become monotonic counts of the increase over the query
+// interval, named with a .count suffix like the agent's.
+func load_openmetrics_file(path string) (Queries, error) {
+	data, err := read_query_file(path)
+	if err != nil {
+		return nil, err
+	}
+	var config OpenMetricsConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Can't parse OpenMetrics file %v: %v", path, err)
+	}
+	instances := config.Instances
+	if len(config.Metrics) > 0 {
+		instances = append(instances, config.OpenMetricsInstance)
+	}
+
+	var translated Queries
+	for _, instance := range instances {
+		var namespace *string
+		if instance.Namespace != "" {
+			parsed, err := parse_namespace(instance.Namespace)
+			if err != nil {
+				return nil, fmt.Errorf("OpenMetrics file %v: %v", path, err)
+			}
+			namespace = &parsed
+		}
+		for _, entry := range instance.Metrics {
+			entry_queries, err := openmetrics_queries(entry)
+			if err != nil {
+				return nil, fmt.Errorf("OpenMetrics file %v: %v", path, err)
+			}
+			for _, query := range entry_queries {
+				query.Namespace = namespace
+				translated = append(translated, query)
+			}
+		}
+	}
+	return translated, nil
+}
+
+func openmetrics_queries(entry interface{}) (Queries, error) {
+	switch entry := entry.(type) {
+	case string:
+		if openmetrics_plain_name.MatchString(entry) {
+			return Queries{openmetrics_query(entry, entry, "")}, nil
+		}
+		if _, err := regexp.Compile(entry); err != nil {
+			return nil, fmt.Errorf("Invalid metric pattern %v: %v", entry, err)
+		}
+		// The metric name comes from each series' __name__
+		return Queries{{Type: Gauge, Name: entry, Query: fmt.Sprintf("{__name__=~%q}", entry)}}, nil
+	case map[interface{}]interface{}:
+		var prom_names []string
+		for prom_name := range entry {
+			prom_names = append(prom_names, fmt.Sprint(prom_name))
+		}
+		sort.Strings(prom_names)
+		var translated Queries
+		for _, prom_name := range prom_names {
+			switch target := entry[prom_name].(type) {
+			case string:
+				translated = append(translated, openmetrics_query(prom_name, target, ""))
+			case map[interface{}]interface{}:
+				name, _ := target["name"].(string)
+				if name == "" {
+					name = prom_name
+				}
+				metric_type, _ := target["type"].(string)
+				translated = append(translated, openmetrics_query(prom_name, name, metric_type))
+			default:
+				return nil, fmt.Errorf("Can't handle mapping for %v: %v", prom_name, target)
+			}
+		}
+		return translated, nil
+	}
+	return nil, fmt.Errorf("Can't handle metrics entry %v", entry)
+}
+
+func openmetrics_query(prom_name string, name string, metric_type string) Query {
+	if metric_type == "" && strings.HasSuffix(prom_name, "_total") {
+		metric_type = "counter"
+	}
+	switch metric_type {
+	case "counter", "monotonic_count":
+		return Query{
+			Type:  Counter,
+			Name:  strings.TrimSuffix(name, "_total") + ".count",
+			Query: fmt.Sprintf("increase(%v[%v])", prom_name, range_selector(time.Duration(interval))),
+		}
+	default:
+		if name == prom_name {
+			return Query{Type: Gauge, Name: name, Query: prom_name}
+		}
+		// The arithmetic drops __name__, which would otherwise win over
+		// the new name
+		return Query{Type: Gauge, Name: name, Query: prom_name + " + 0"}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+)
+
+// OverlapPolicy decides what happens when a query is due while a previous
+// run of it (e.g. an Admin.RunQueryOnce during a slow cycle) is still going.
+type OverlapPolicy string
+
+const (
+	// OverlapSkip drops the new run, the running one pushes the results.
+	OverlapSkip OverlapPolicy = "skip"
+	// OverlapQueue runs the new run once the running one is done. Only one
+	// run waits per query, any more are skipped.
+	OverlapQueue OverlapPolicy = "queue"
+)
+
+func (policy *OverlapPolicy) String() string {
+	return string(*policy)
+}
+
+func (policy *OverlapPolicy) Set(value string) error {
+	switch OverlapPolicy(value) {
+	case OverlapSkip, OverlapQueue:
+		*policy = OverlapPolicy(value)
+		return nil
+	}
+	return fmt.Errorf("Can't handle overlap policy %v (expected skip or queue)", value)
+}
+
+// in_flight is the state of one query in an InFlightGuard.
+type in_flight struct {
+	running bool
+	queued  bool
+}
+
+// InFlightGuard stops runs of the same query overlapping, so their results
+// aren't pushed twice.
+type InFlightGuard struct {
+	sync.Mutex
+	done    *sync.Cond
+	queries map[string]*in_flight
+	// closed refuses new runs while shutting down.
+	closed bool
+}
+
+func NewInFlightGuard() *InFlightGuard {
+	guard := &InFlightGuard{queries: map[string]*in_flight{}}
+	guard.done = sync.NewCond(&guard.Mutex)
+	return guard
+}
+
+// Start claims a run of the query, waiting for a running one to finish with
+// the queue policy. Returns errOverlappingRun or errShuttingDown if the run
+// should be skipped, otherwise Finish must be called once the run is done.
+func (guard *InFlightGuard) Start(name string, policy OverlapPolicy) error {
+	guard.Lock()
+	defer guard.Unlock()
+	if guard.closed {
+		return errShuttingDown
+	}
+	state, ok := guard.queries[name]
+	if !ok {
+		state = &in_flight{}
+		guard.queries[name] = state
+	}
+	if !state.running {
+		state.running = true
+		inFlightQueries.Inc()
+		return nil
+	}
+	if policy != OverlapQueue || state.queued {
+		overlappingRuns.WithLabelValues(name, "skipped").Inc()
+		return errOverlappingRun
+	}
+	overlappingRuns.WithLabelValues(name, "queued").Inc()
+	state.queued = true
+	for state.running {
+		guard.done.Wait()
+	}
+	state.queued = false
+	if guard.closed {
+		return errShuttingDown
+	}
+	state.running = true
+	inFlightQueries.Inc()
+	return nil
+}
+
+func (guard *InFlightGuard) Finish(name string) {
+	guard.Lock()
+	defer guard.Unlock()
+	if state, ok := guard.queries[name]; ok && state.running {
+		state.running = false
+		inFlightQueries.Dec()
+	}
+	guard.done.Broadcast()
+}
+
+// Forget drops the state of queries which no longer exist, unless a run is
+// still going.
+func (guard *InFlightGuard) Forget(names []string) {
+	guard.Lock()
+	defer guard.Unlock()
+	for _, name := range names {
+		if state, ok := guard.queries[name]; ok && !state.running && !state.queued {
+			delete(guard.queries, name)
+		}
+	}
+}
+
+// Close refuses any new runs and waits until the running ones finish,
+// returning false if they didn't by the deadline.
+func (guard *InFlightGuard) Close(deadline time.Time) bool {
+	idle := make(chan struct{})
+	go func() {
+		guard.Lock()
+		defer guard.Unlock()
+		guard.closed = true
+		for guard.running() {
+			guard.done.Wait()
+		}
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// running returns whether any query is running, the lock must be held.
+func (guard *InFlightGuard) running() bool {
+	for _, state := range guard.queries {
+		if state.running {
+			return true
+		}
+	}
+	return false
+}
+
+// in_flight_queries guards every run of a query, scheduled or not.
+var in_flight_queries = NewInFlightGuard()
+
+var (
+	// errOverlappingRun is returned for runs skipped by the overlap policy.
+	errOverlappingRun = fmt.Errorf("a previous run is still in progress")
+	// errShuttingDown is returned for runs started during shutdown.
+	errShuttingDown = fmt.Errorf("shutting down")
+)
+
+// run_query_once runs a query unless a run of it is already in progress,
+// following -on-overlap.
+func run_query_once(query Query, query_api prometheus.QueryAPI, when time.Time, sink Sink) error {
+	if err := in_flight_queries.Start(query.Name, overlap_policy); err != nil {
+		return err
+	}
+	defer in_flight_queries.Finish(query.Name)
+	return run_query(query, query_api, when, sink)
+}
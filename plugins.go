@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"plugin"
+	"strings"
+	"time"
+)
+
+// Plugins are Go plugins (built with -buildmode=plugin) loaded with
+// -plugin path.so[=config]. As a plugin can't import this package the
+// symbols only use built in types:
+//
+//	// Optional, called once with the text after "=".
+//	func Init(config string) error
+//
+//	// A sink exports Push and optionally Flush and Close.
+//	func Push(metric_type string, name string, value float64, tags []string, timestamp time.Time) error
+//	func Flush() error
+//	func Close() error
+//
+//	// An enricher rewrites samples before they're pushed, returning false
+//	// to drop the sample.
+//	func Enrich(name string, value float64, tags []string) (string, float64, []string, bool)
+
+// Enricher rewrites a sample before it is pushed, returning false to drop it.
+type Enricher func(sample Sample) (Sample, bool)
+
+type PluginSpecs []string
+
+func (flags *PluginSpecs) String() string {
+	return "PluginSpecs"
+}
+
+func (flags *PluginSpecs) Set(value string) error {
+	*flags = append(*flags, value)
+	return nil
+}
+
+// PluginSink pushes samples to a plugin's Push function.
+type PluginSink struct {
+	path  string
+	push  func(string, string, float64, []string, time.Time) error
+	flush func() error
+	close func() error
+}
+
+func (sink *PluginSink) Push(sample Sample) error {
+	return sink.push(sample.Type.String(), sample.Name, sample.Value, sample.Tags, sample.Timestamp)
+}
+
+func (sink *PluginSink) Flush() error {
+	if sink.flush == nil {
+		return nil
+	}
+	return sink.flush()
+}
+
+func (sink *PluginSink) Close() error {
+	if sink.close == nil {
+		return nil
+	}
+	return sink.close()
+}
+
+// load_plugin opens a plugin and returns the sink and/or enricher it
+// provides.
+func load_plugin(spec string) (Sink, Enricher, error) {
+	path := spec
+	config := ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		path, config = spec[:i], spec[i+1:]
+	}
+
+	loaded, err := plugin.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if symbol, err := loaded.Lookup("Init"); err == nil {
+		init_plugin, ok := symbol.(func(string) error)
+		if !ok {
+			return nil, nil, fmt.Errorf("Plugin %v: Init has the wrong signature", path)
+		}
+		if err := init_plugin(config); err != nil {
+			return nil, nil, fmt.Errorf("Plugin %v: %v", path, err)
+		}
+	}
+
+	var sink Sink
+	if symbol, err := loaded.Lookup("Push"); err == nil {
+		push, ok := symbol.(func(string, string, float64, []string, time.Time) error)
+		if !ok {
+			return nil, nil, fmt.Errorf("Plugin %v: Push has the wrong signature", path)
+		}
+		plugin_sink := &PluginSink{path: path, push: push}
+		if symbol, err := loaded.Lookup("Flush"); err == nil {
+			if plugin_sink.flush, ok = symbol.(func() error); !ok {
+				return nil, nil, fmt.Errorf("Plugin %v: Flush has the wrong signature", path)
+			}
+		}
+		if symbol, err := loaded.Lookup("Close"); err == nil {
+			if plugin_sink.close, ok = symbol.(func() error); !ok {
+				return nil, nil, fmt.Errorf("Plugin %v: Close has the wrong signature", path)
+			}
+		}
+		sink = plugin_sink
+	}
+
+	var enricher Enricher
+	if symbol, err := loaded.Lookup("Enrich"); err == nil {
+		enrich, ok := symbol.(func(string, float64, []string) (string, float64, []string, bool))
+		if !ok {
+			return nil, nil, fmt.Errorf("Plugin %v: Enrich has the wrong signature", path)
+		}
+		enricher = func(sample Sample) (Sample, bool) {
+			var keep bool
+			sample.Name, sample.Value, sample.Tags, keep = enrich(sample.Name, sample.Value, sample.Tags)
+			return sample, keep
+		}
+	}
+
+	if sink == nil && enricher == nil {
+		return nil, nil, fmt.Errorf("Plugin %v exports neither Push nor Enrich", path)
+	}
+	return sink, enricher, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// QueryPriority decides which queries run first in a cycle and which give
+// way when a cycle runs late, e.g. SLO and paging metrics are high and
+// exploratory queries low.
+type QueryPriority string
+
+const (
+	// PriorityHigh queries run first and are never shed.
+	PriorityHigh QueryPriority = "high"
+	// PriorityNormal is the default.
+	PriorityNormal QueryPriority = "normal"
+	// PriorityLow queries run last and are shed once the cycle has taken
+	// longer than the interval.
+	PriorityLow QueryPriority = "low"
+)
+
+func (priority *QueryPriority) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	switch QueryPriority(value) {
+	case "", PriorityHigh, PriorityNormal, PriorityLow:
+		*priority = QueryPriority(value)
+		return nil
+	}
+	return fmt.Errorf("Can't handle priority %v (expected high, normal or low)", value)
+}
+
+// rank orders priorities, lower runs first.
+func (priority QueryPriority) rank() int {
+	switch priority {
+	case PriorityHigh:
+		return 0
+	case PriorityLow:
+		return 2
+	}
+	return 1
+}
+
+// by_priority returns the queries with high priority ones first and low
+// priority ones last, otherwise in their configured order.
+func by_priority(queries Queries) Queries {
+	ordered := append(Queries{}, queries...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Priority.rank() < ordered[j].Priority.rank() })
+	return ordered
+}
+
+// shed is true for a low priority query reached after the cycle started at
+// cycle_start has run for longer than the interval, i.e. once the next cycle
+// is already due.
+func shed(query Query, cycle_start time.Time, interval time.Duration) bool {
+	return query.Priority == PriorityLow && clock.Now().Sub(cycle_start) >= interval
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// PushStats accumulates the estimated dogstatsd output of a single cycle.
+type PushStats struct {
+	Bytes     int
+	Datagrams int
+}
+
+// Add records a single pushed datagram of the given size.
+func (stats *PushStats) Add(size int) {
+	if stats == nil {
+		return
+	}
+	stats.Bytes += size
+	stats.Datagrams++
+}
+
+// datagram_size estimates the serialized size of a dogstatsd metric, mirroring
+// the format used by the statsd client: namespace, name, value, sample rate
+// and the global plus per metric tags.
+func datagram_size(statsd_client *statsd.Client, name string, stat_length int, tags []string, rate float64) int {
+	size := len(statsd_client.Namespace) + len(name) + len(":") + stat_length
+	if rate < 1 {
+		size += len("|@") + len(strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	tag_count := len(statsd_client.Tags) + len(tags)
+	if tag_count > 0 {
+		size += len("|#") + tag_count - 1
+		for _, tag := range statsd_client.Tags {
+			size += len(tag)
+		}
+		for _, tag := range tags {
+			size += len(tag)
+		}
+	}
+	return size
+}
+
+// format_datagram formats a dogstatsd metric exactly as the statsd client
+// would send it, for -dogstatsd-output.
+func format_datagram(statsd_client *statsd.Client, name string, stat string, rate float64, tags []string) string {
+	datagram := statsd_client.Namespace + name + ":" + stat
+	if rate < 1 {
+		datagram += "|@" + strconv.FormatFloat(rate, 'f', -1, 64)
+	}
+	all_tags := append(append([]string{}, statsd_client.Tags...), tags...)
+	if len(all_tags) > 0 {
+		datagram += "|#" + strings.Join(all_tags, ",")
+	}
+	return datagram
+}
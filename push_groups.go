@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/prometheus/common/model"
+)
+
+// GroupSink is implemented by sinks which can send several samples in one
+// go (one dogstatsd packet or api batch), so Datadog's per flush aggregation
+// never sees part of a set of related metrics.
+type GroupSink interface {
+	PushGroup(samples []Sample) error
+}
+
+// push_group sends samples together if the sink supports it, one after the
+// other otherwise.
+func push_group(sink Sink, samples []Sample) error {
+	if group_sink, ok := sink.(GroupSink); ok {
+		return group_sink.PushGroup(samples)
+	}
+	var first error
+	for _, sample := range samples {
+		if err := sink.Push(sample); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// group_series orders a query's results so the metrics of each label set
+// (the series value_labels splits into several metrics) are pushed one after
+// the other, in the order each label set first appeared. Returns the group of
+// each sample.
+func group_series(query Query, vector model.Vector) (model.Vector, []int) {
+	groups := make([]int, len(vector))
+	if query.ValueLabels == nil {
+		for i := range groups {
+			groups[i] = i
+		}
+		return vector, groups
+	}
+
+	first_seen := map[model.Fingerprint]int{}
+	for i, sample := range vector {
+		label_set := sample.Metric.Clone()
+		delete(label_set, model.LabelName(query.ValueLabels.Label))
+		key := label_set.Fingerprint()
+		if _, ok := first_seen[key]; !ok {
+			first_seen[key] = len(first_seen)
+		}
+		groups[i] = first_seen[key]
+	}
+	ordered := append(model.Vector{}, vector...)
+	order := make([]int, len(vector))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return groups[order[i]] < groups[order[j]] })
+	ordered_groups := make([]int, len(vector))
+	for i, original := range order {
+		ordered[i] = vector[original]
+		ordered_groups[i] = groups[original]
+	}
+	return ordered, ordered_groups
+}
+
+// GroupingSink collects the samples pushed for one label set, for queries
+// with push_together. Events aren't held back.
+type GroupingSink struct {
+	sink Sink
+
+	sync.Mutex
+	samples []Sample
+}
+
+func (grouping *GroupingSink) Push(sample Sample) error {
+	grouping.Lock()
+	defer grouping.Unlock()
+	grouping.samples = append(grouping.samples, sample)
+	return nil
+}
+
+// Flush is a no-op, samples are only sent by Send.
+func (grouping *GroupingSink) Flush() error {
+	return nil
+}
+
+func (grouping *GroupingSink) Close() error {
+	return nil
+}
+
+func (grouping *GroupingSink) staged_total(query_key string, series string) (counter_total, bool) {
+	if stager, ok := grouping.sink.(total_stager); ok {
+		return stager.staged_total(query_key, series)
+	}
+	return counter_total{}, false
+}
+
+// stage_total passes the total on to a PendingSink underneath, otherwise
+// it's recorded straight away as without push_together.
+func (grouping *GroupingSink) stage_total(query_key string, series string, total counter_total) {
+	if stager, ok := grouping.sink.(total_stager); ok {
+		stager.stage_total(query_key, series, total)
+		return
+	}
+	counter_totals.Lock()
+	store_counter_total(query_key, series, total)
+	counter_totals.Unlock()
+}
+
+func (grouping *GroupingSink) Event(event *statsd.Event) error {
+	return send_event(grouping.sink, event)
+}
+
+// Send pushes the collected samples to the underlying sink together.
+func (grouping *GroupingSink) Send() error {
+	grouping.Lock()
+	defer grouping.Unlock()
+	if len(grouping.samples) == 0 {
+		return nil
+	}
+	// Not reused, the underlying sink may hold on to the samples
+	samples := grouping.samples
+	grouping.samples = nil
+	if err := push_group(grouping.sink, samples); err != nil {
+		failedPushedMetrics.WithLabelValues("failed-push").Inc()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// GroupingHeaders maps request headers to the labels they set on pushed
+// samples, over -push-grouping-header.
+type GroupingHeaders map[string]model.LabelName
+
+func (flags GroupingHeaders) String() string {
+	return "GroupingHeaders"
+}
+
+func (flags GroupingHeaders) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || !model.LabelName(parts[1]).IsValid() {
+		return fmt.Errorf("Grouping header must be in the form header:label (%v)", value)
+	}
+	flags[http.CanonicalHeaderKey(parts[0])] = model.LabelName(parts[1])
+	return nil
+}
+
+// grouping_key reads the grouping key of a push: the label/value pairs of
+// the path after prefix, a value base64 encoded (URL safe) if its label
+// ends in @base64 like with the Pushgateway, then the -push-grouping-header
+// headers, which the path can't override.
+func grouping_key(r *http.Request, prefix string) (model.LabelSet, error) {
+	key := model.LabelSet{}
+	path := strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), prefix), "/")
+	if path != "" {
+		parts := strings.Split(path, "/")
+		if len(parts)%2 != 0 {
+			return nil, fmt.Errorf("grouping key %v needs a value for every label", path)
+		}
+		for i := 0; i < len(parts); i += 2 {
+			label, err := url.PathUnescape(parts[i])
+			if err != nil {
+				return nil, fmt.Errorf("can't unescape grouping key label %v: %v", parts[i], err)
+			}
+			value, err := url.PathUnescape(parts[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("can't unescape the grouping key value of %v: %v", label, err)
+			}
+			if strings.HasSuffix(label, "@base64") {
+				label = strings.TrimSuffix(label, "@base64")
+				decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+				if err != nil {
+					return nil, fmt.Errorf("can't decode the base64 grouping key value of %v: %v", label, err)
+				}
+				value = string(decoded)
+			}
+			if !model.LabelName(label).IsValid() || label == model.MetricNameLabel {
+				return nil, fmt.Errorf("invalid grouping key label %q", label)
+			}
+			key[model.LabelName(label)] = model.LabelValue(value)
+		}
+	}
+	for header, label := range push_grouping_headers {
+		if value := r.Header.Get(header); value != "" {
+			key[label] = model.LabelValue(value)
+		}
+	}
+	return key, nil
+}
+
+// intake_results counts the samples of a push by result, for
+// prometheus_to_datadog_remote_write_samples_total.
+type intake_results struct {
+	intake string
+	counts map[string]float64
+	// err is the first sample which couldn't be rolled up.
+	err error
+}
+
+// add rolls a pushed sample up with the push's grouping key, which replaces
+// the sample's own labels of the same name like with the Pushgateway.
+func (results *intake_results) add(rollup *RemoteWriteRollup, key model.LabelSet, metric model.Metric, value float64, at time.Time) {
+	for label, label_value := range key {
+		metric[label] = label_value
+	}
+	result, err := rollup.Add(metric, value, at)
+	if results.counts == nil {
+		results.counts = map[string]float64{}
+	}
+	results.counts[result]++
+	if err != nil && results.err == nil {
+		results.err = err
+	}
+}
+
+func (results *intake_results) record() {
+	for result, count := range results.counts {
+		remoteWriteSamples.WithLabelValues(results.intake, result).Add(count)
+	}
+	if results.err != nil {
+		log_throttle.Printf(results.intake+"/invalid", "Dropped %v samples: %v", results.intake, results.err)
+	}
+}
+
+// ServePush accepts a Pushgateway push of the text format on
+// /metrics/job/<job>{/<label>/<value>}, parsed with expfmt. Every push is rolled up as samples
+// at the time of the push (or their own timestamps), rather than kept as
+// the group's state like by the Pushgateway, so a DELETE has nothing to do.
+func (rollup *RemoteWriteRollup) ServePush(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "PUT", "POST":
+	case "DELETE":
+		w.WriteHeader(http.StatusAccepted)
+		return
+	default:
+		http.Error(w, "pushes need a PUT or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case <-stopping:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/vnd.google.protobuf") {
+		http.Error(w, "only the text format is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	key, err := grouping_key(r, "/metrics")
+	if err == nil && key["job"] == "" {
+		err = fmt.Errorf("pushes need a job, to /metrics/job/<job>")
+	}
+	if err != nil {
+		remoteWriteRequests.WithLabelValues("pushgateway", "invalid").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, remote_write_max_body+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > remote_write_max_body {
+		http.Error(w, fmt.Sprintf("push over %d bytes", remote_write_max_body), http.StatusRequestEntityTooLarge)
+		return
+	}
+	// The whole push is parsed before any of it is rolled up
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	if err != nil {
+		remoteWriteRequests.WithLabelValues("pushgateway", "invalid").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Histograms and summaries become their _bucket, _sum and _count series
+	options := &expfmt.DecodeOptions{Timestamp: model.TimeFromUnixNano(time.Now().UnixNano())}
+	results := intake_results{intake: "pushgateway"}
+	for _, family := range families {
+		for _, sample := range expfmt.ExtractSamples(options, family) {
+			results.add(rollup, key, sample.Metric, float64(sample.Value), sample.Timestamp.Time())
+		}
+	}
+	results.record()
+	remoteWriteRequests.WithLabelValues("pushgateway", "success").Inc()
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestGroupingKey(t *testing.T) {
+	push_grouping_headers["X-Scope-Orgid"] = "tenant"
+	defer delete(push_grouping_headers, "X-Scope-Orgid")
+
+	r := httptest.NewRequest("PUT", "/metrics/job/backup/instance@base64/aG9zdC8x/zone/eu%2Fwest/empty@base64/=", nil)
+	r.Header.Set("X-Scope-OrgID", "payments")
+	key, err := grouping_key(r, "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := model.LabelSet{"job": "backup", "instance": "host/1", "zone": "eu/west", "empty": "", "tenant": "payments"}
+	if !reflect.DeepEqual(key, expected) {
+		t.Errorf("Grouping key %v, expected %v", key, expected)
+	}
+
+	// The header wins over the path
+	r = httptest.NewRequest("POST", "/api/v1/write/tenant/other", nil)
+	r.Header.Set("X-Scope-OrgID", "payments")
+	if key, err := grouping_key(r, "/api/v1/write"); err != nil || key["tenant"] != "payments" {
+		t.Errorf("Grouping key %v (%v), expected the tenant from the header", key, err)
+	}
+
+	for _, path := range []string{"/metrics/job", "/metrics/job/a/zone", "/metrics/job/a/__name__/b", "/metrics/job/a/in-valid/b", "/metrics/job/a/zone@base64/!!"} {
+		if key, err := grouping_key(httptest.NewRequest("PUT", path, nil), "/metrics"); err == nil {
+			t.Errorf("Expected %v to be rejected, got %v", path, key)
+		}
+	}
+}
+
+func TestPushgatewayIntake(t *testing.T) {
+	sink := &recording_sink{}
+	rollup := NewRemoteWriteRollup(time.Minute, 0, RollupLast, Rollups{}, sink)
+	push := func(method, path, body string) int {
+		response := httptest.NewRecorder()
+		rollup.ServePush(response, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return response.Code
+	}
+
+	body := `# TYPE backup_last_success_timestamp gauge
+backup_last_success_timestamp{job="ignored",db="orders"} 1234
+backup_duration_seconds{db="orders"} 56 946684800000
+`
+	if code := push("PUT", "/metrics/job/backup/instance/db1", body); code != http.StatusOK {
+		t.Fatalf("Push returned %d", code)
+	}
+	if code := push("PUT", "/metrics/job/backup/instance/db2", "backup_duration_seconds{db=\"orders\"} 78 946684800000\n"); code != http.StatusOK {
+		t.Fatalf("Push returned %d", code)
+	}
+	if _, err := rollup.Flush(time.Now().Add(time.Hour), true); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, sample := range sink.take() {
+		got = append(got, fmt.Sprintf("%v %v %v", sample.Name, sample.Value, sample.Tags))
+	}
+	expected := []string{
+		"backup_duration_seconds 56 [db:orders instance:db1 job:backup]",
+		"backup_duration_seconds 78 [db:orders instance:db2 job:backup]",
+		"backup_last_success_timestamp 1234 [db:orders instance:db1 job:backup]",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Pushed %q, expected %q", got, expected)
+	}
+
+	for _, bad := range []struct{ method, path, body string }{
+		{"PUT", "/metrics/instance/db1", "up 1\n"},
+		{"PUT", "/metrics/job/backup", "up{db=\"orders\" 1\n"},
+		{"GET", "/metrics/job/backup", ""},
+		{"PUT", "/metrics/job/backup", "up{1a=\"b\"} 1\n"},
+		{"PUT", "/metrics/job/backup", "# TYPE up gauge\n# TYPE up counter\nup 1\n"},
+	} {
+		if code := push(bad.method, bad.path, bad.body); code < 400 {
+			t.Errorf("%v %v %q returned %d, expected it to be rejected", bad.method, bad.path, bad.body, code)
+		}
+	}
+	// Not cut off at the limit, which could still parse
+	oversized := strings.Repeat("#\n", remote_write_max_body/2) + "up 1234\n"
+	if code := push("PUT", "/metrics/job/backup", oversized); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("An oversized push returned %d, expected 413", code)
+	}
+	// A summary becomes its _sum and _count series, in a rollup which
+	// hasn't been shut down by the last flush
+	rollup = NewRemoteWriteRollup(time.Minute, 0, RollupLast, Rollups{}, sink)
+	summary := "# TYPE backup_seconds summary\nbackup_seconds_sum 12 946684800000\nbackup_seconds_count 3 946684800000\n"
+	if code := push("POST", "/metrics/job/backup", summary); code != http.StatusOK {
+		t.Fatalf("Push returned %d", code)
+	}
+	if _, err := rollup.Flush(time.Now().Add(time.Hour), true); err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, sample := range sink.take() {
+		got = append(got, fmt.Sprintf("%v %v", sample.Name, sample.Value))
+	}
+	if expected := []string{"backup_seconds_count 3", "backup_seconds_sum 12"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Pushed %q, expected %q", got, expected)
+	}
+	if code := push("DELETE", "/metrics/job/backup", ""); code != http.StatusAccepted {
+		t.Errorf("DELETE returned %d, expected 202", code)
+	}
+}
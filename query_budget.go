@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// TimeoutPolicy decides what happens to the samples already processed when
+// a query runs out of its time budget part way through its results.
+type TimeoutPolicy string
+
+const (
+	// TimeoutDiscard drops the whole run, so monitors never see a truncated
+	// set of series (e.g. a distribution missing its slow buckets).
+	TimeoutDiscard TimeoutPolicy = "discard"
+	// TimeoutPushPartial keeps whatever was pushed before the budget ran
+	// out.
+	TimeoutPushPartial TimeoutPolicy = "push_partial"
+)
+
+func parse_timeout_policy(value string) (TimeoutPolicy, error) {
+	switch TimeoutPolicy(value) {
+	case "", TimeoutDiscard, TimeoutPushPartial:
+		return TimeoutPolicy(value), nil
+	}
+	return "", fmt.Errorf("Can't handle timeout policy %v (expected discard or push_partial)", value)
+}
+
+func (policy *TimeoutPolicy) String() string {
+	return string(*policy)
+}
+
+func (policy *TimeoutPolicy) Set(value string) error {
+	parsed, err := parse_timeout_policy(value)
+	if err != nil {
+		return err
+	}
+	*policy = parsed
+	return nil
+}
+
+func (policy *TimeoutPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return policy.Set(value)
+}
+
+// query_budget returns the query's time budget and timeout policy, falling
+// back to -query-timeout and -on-query-timeout.
+func query_budget(query Query) (time.Duration, TimeoutPolicy) {
+	budget, policy := query.Timeout, query.OnTimeout
+	if budget == 0 {
+		budget = *query_timeout
+	}
+	if policy == "" {
+		policy = timeout_policy
+	}
+	return budget, policy
+}
+
+// budget_exceeded records a query running out of its budget part way through
+// its results.
+func budget_exceeded(ctx context.Context, query Query, policy TimeoutPolicy, processed int, total int) error {
+	queryTimeouts.WithLabelValues(query.Name, string(policy)).Inc()
+	action := "discarding the run"
+	if policy == TimeoutPushPartial {
+		action = "keeping the samples already pushed"
+	}
+	return fmt.Errorf("Query %v ran out of its time budget after %d of %d series, %v: %v", query.Name, processed, total, action, ctx.Err())
+}
+
+// PendingSink holds a query's samples until the run completes within its
+// budget, for the discard timeout policy. Events aren't held back. The
+// totals of cumulative queries are held back with the samples, and only
+// recorded once they're all sent.
+type PendingSink struct {
+	sink Sink
+
+	sync.Mutex
+	// groups keeps samples pushed together (push_together) together.
+	groups [][]Sample
+	// totals are the staged counter totals, by counter_totals_key and
+	// series_key.
+	totals map[string]map[string]counter_total
+}
+
+func (pending *PendingSink) staged_total(query_key string, series string) (counter_total, bool) {
+	pending.Lock()
+	defer pending.Unlock()
+	total, ok := pending.totals[query_key][series]
+	return total, ok
+}
+
+func (pending *PendingSink) stage_total(query_key string, series string, total counter_total) {
+	pending.Lock()
+	defer pending.Unlock()
+	if pending.totals == nil {
+		pending.totals = map[string]map[string]counter_total{}
+	}
+	if pending.totals[query_key] == nil {
+		pending.totals[query_key] = map[string]counter_total{}
+	}
+	pending.totals[query_key][series] = total
+}
+
+func (pending *PendingSink) Push(sample Sample) error {
+	pending.Lock()
+	defer pending.Unlock()
+	pending.groups = append(pending.groups, []Sample{sample})
+	return nil
+}
+
+func (pending *PendingSink) PushGroup(samples []Sample) error {
+	pending.Lock()
+	defer pending.Unlock()
+	pending.groups = append(pending.groups, samples)
+	return nil
+}
+
+// Flush is a no-op, samples are only sent by Commit.
+func (pending *PendingSink) Flush() error {
+	return nil
+}
+
+func (pending *PendingSink) Close() error {
+	return nil
+}
+
+func (pending *PendingSink) Event(event *statsd.Event) error {
+	return send_event(pending.sink, event)
+}
+
+// Commit sends the held samples to the underlying sink.
+func (pending *PendingSink) Commit() error {
+	pending.Lock()
+	defer pending.Unlock()
+	var first error
+	for _, group := range pending.groups {
+		var err error
+		if len(group) == 1 {
+			err = pending.sink.Push(group[0])
+		} else {
+			err = push_group(pending.sink, group)
+		}
+		if err != nil {
+			failedPushedMetrics.WithLabelValues("failed-push").Inc()
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	pending.groups = nil
+	if first == nil {
+		counter_totals.Lock()
+		for query_key, totals := range pending.totals {
+			for series, total := range totals {
+				store_counter_total(query_key, series, total)
+			}
+		}
+		counter_totals.Unlock()
+	}
+	pending.totals = nil
+	return first
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+// ResultTypeError is a query returning a string or range vector, which
+// can't be pushed as samples.
+type ResultTypeError struct {
+	Type model.ValueType
+}
+
+func (err *ResultTypeError) Error() string {
+	return fmt.Sprintf("expected an instant vector or scalar, got a %v", err.Type)
+}
+
+// instant_vector returns the series of a query's result. A scalar (e.g.
+// scalar(sum(up))) is a single series without labels, pushed under the
+// query's name.
+func instant_vector(results model.Value) (model.Vector, error) {
+	switch result := results.(type) {
+	case model.Vector:
+		return result, nil
+	case *model.Scalar:
+		return model.Vector{&model.Sample{Metric: model.Metric{}, Value: result.Value, Timestamp: result.Timestamp}}, nil
+	}
+	return nil, &ResultTypeError{Type: results.Type()}
+}
+
+// query_error_class classifies a failed query for the error_class label of
+// failed_queries_total, so alerts can tell Prometheus being down (timeout,
+// connection_refused, connection_error, server_error) from a query being
+// wrong (bad_expression).
+func query_error_class(err error) string {
+	var max_samples_err *MaxSamplesError
+	if errors.As(err, &max_samples_err) {
+		return "max_samples"
+	}
+	var result_err *ResultTypeError
+	// The client can't decode string results at all
+	if errors.As(err, &result_err) || strings.HasPrefix(err.Error(), "unexpected value type") {
+		return "result_type"
+	}
+	var api_err *prometheus.Error
+	if errors.As(err, &api_err) {
+		switch api_err.Type {
+		case prometheus.ErrTimeout:
+			return "timeout"
+		case prometheus.ErrBadData:
+			// 422, or 400 from newer Prometheus versions (below)
+			return "bad_expression"
+		case prometheus.ErrCanceled:
+			return "canceled"
+		case prometheus.ErrExec:
+			return "execution"
+		case prometheus.ErrBadResponse:
+			switch {
+			case strings.HasPrefix(api_err.Msg, "bad response code 5"):
+				return "server_error"
+			case api_err.Msg == "bad response code 400":
+				return "bad_expression"
+			case strings.HasPrefix(api_err.Msg, "bad response code 4"):
+				return "client_error"
+			}
+			return "bad_response"
+		}
+		return "other"
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "connection_refused"
+	}
+	var net_err net.Error
+	if errors.As(err, &net_err) {
+		if net_err.Timeout() {
+			return "timeout"
+		}
+		return "connection_error"
+	}
+	return "other"
+}
+
+// QueryFailures is a query's failure history for /debug.
+type QueryFailures struct {
+	LastTime  time.Time      `json:"last_time"`
+	LastClass string         `json:"last_error_class"`
+	LastError string         `json:"last_error"`
+	ByClass   map[string]int `json:"failures_by_class"`
+}
+
+var query_failures = struct {
+	sync.Mutex
+	by_query map[string]*QueryFailures
+}{by_query: map[string]*QueryFailures{}}
+
+// count_failed_query records a failed query in failed_queries_total and for
+// /debug, returning its error class.
+func count_failed_query(query Query, class string, err error) string {
+	failedQueries.WithLabelValues(query_label(query), class).Inc()
+
+	query_failures.Lock()
+	defer query_failures.Unlock()
+	failures, ok := query_failures.by_query[query.Name]
+	if !ok {
+		failures = &QueryFailures{ByClass: map[string]int{}}
+		query_failures.by_query[query.Name] = failures
+	}
+	failures.LastTime = time.Now()
+	failures.LastClass = class
+	failures.LastError = err.Error()
+	failures.ByClass[class]++
+	return class
+}
+
+// serve_debug lists the failures of every query which has failed, by name.
+func serve_debug(w http.ResponseWriter, r *http.Request) {
+	query_failures.Lock()
+	names := make([]string, 0, len(query_failures.by_query))
+	for name := range query_failures.by_query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	type named_failures struct {
+		Query string `json:"query"`
+		QueryFailures
+	}
+	failures := make([]named_failures, 0, len(names))
+	for _, name := range names {
+		entry := *query_failures.by_query[name]
+		by_class := make(map[string]int, len(entry.ByClass))
+		for class, count := range entry.ByClass {
+			by_class[class] = count
+		}
+		entry.ByClass = by_class
+		failures = append(failures, named_failures{Query: name, QueryFailures: entry})
+	}
+	query_failures.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(map[string]interface{}{"failed_queries": failures})
+}
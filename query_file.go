@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/micktwomey/prometheus_to_datadog/tagformat"
+	"gopkg.in/yaml.v2"
+)
+
+// EmptyResultPolicy decides what happens when a query returns no series.
+type EmptyResultPolicy string
+
+const (
+	EmptyIgnore   EmptyResultPolicy = "ignore"
+	EmptyWarn     EmptyResultPolicy = "warn"
+	EmptyPushZero EmptyResultPolicy = "push_zero"
+	EmptyError    EmptyResultPolicy = "error"
+)
+
+func (policy *EmptyResultPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	switch EmptyResultPolicy(value) {
+	case "", EmptyIgnore, EmptyWarn, EmptyPushZero, EmptyError:
+		*policy = EmptyResultPolicy(value)
+		return nil
+	}
+	return fmt.Errorf("Can't handle on_empty %v (expected ignore, warn, push_zero or error)", value)
+}
+
+// load_query_file reads a YAML (or JSON) list of queries, e.g.
+//
+//   - name: http.requests
+//     type: gauge
+//     query: sum(rate(http_requests_total[1m]))
+//     on_empty: push_zero
+//
+// A path of "-" reads the queries from stdin. Every problem in the file is
+// reported, not just the first.
+func load_query_file(path string) (Queries, error) {
+	file_queries, problems := decode_query_file(path)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%v", strings.Join(problems, "\n"))
+	}
+	return file_queries, nil
+}
+
+// yaml_error_line is the position yaml prefixes errors with, which is
+// relative to the re-encoded entry rather than the file.
+var yaml_error_line = regexp.MustCompile(`(?m)^\s*line \d+: `)
+
+// decode_query_file strictly decodes each query in a query file on its own,
+// so one broken query (e.g. a typo in its type) doesn't hide problems in the
+// rest. Unknown keys (e.g. tpe: gauge) are errors. Returns the valid queries
+// and the problems found, located by line in YAML files.
+func decode_query_file(path string) (Queries, []string) {
+	data, err := read_query_file(path)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	lines_known := detect_query_file_format(path) == "yaml"
+	if data, err = query_file_yaml(path, data); err != nil {
+		return nil, []string{err.Error()}
+	}
+	return decode_queries(path, data, lines_known)
+}
+
+// decode_queries decodes a YAML list of queries from path, see
+// decode_query_file. Problems are located by line if lines_known.
+func decode_queries(path string, data []byte, lines_known bool) (Queries, []string) {
+	var entries []interface{}
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, []string{fmt.Sprintf("Can't parse query file %v: %v", path, err)}
+	}
+	var lines []int
+	if lines_known {
+		lines = query_entry_lines(data, len(entries))
+	}
+	locate := func(i int, name string) string {
+		if name == "" {
+			name = strconv.Itoa(i + 1)
+		}
+		if lines != nil {
+			return fmt.Sprintf("Query %v in %v line %d", name, path, lines[i])
+		}
+		return fmt.Sprintf("Query %v in %v", name, path)
+	}
+
+	var valid Queries
+	var problems []string
+	for i, entry := range entries {
+		encoded, err := yaml.Marshal(entry)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", locate(i, ""), err))
+			continue
+		}
+		var query Query
+		if err := yaml.UnmarshalStrict(encoded, &query); err != nil {
+			message := yaml_error_line.ReplaceAllString(strings.TrimPrefix(err.Error(), "yaml: unmarshal errors:\n"), "")
+			problems = append(problems, fmt.Sprintf("%v: %v", locate(i, ""), strings.Replace(message, "\n", "; ", -1)))
+			continue
+		}
+		if query.Name == "" || (query.Query == "" && len(query.Federate) == 0) {
+			problems = append(problems, fmt.Sprintf("%v needs both a name and a query (or federate)", locate(i, query.Name)))
+			continue
+		}
+		if err := check_file_query(&query); err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", locate(i, query.Name), err))
+			continue
+		}
+		valid = append(valid, query)
+	}
+	return valid, problems
+}
+
+// query_entry_lines finds the line each entry of a YAML list starts on, from
+// the lines starting with a dash at the list's indentation. Returns nil if
+// that doesn't find count entries, e.g. for a flow style list.
+func query_entry_lines(data []byte, count int) []int {
+	var lines []int
+	indent := -1
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed != "-" && !strings.HasPrefix(trimmed, "- ") {
+			continue
+		}
+		if indent == -1 {
+			indent = len(line) - len(trimmed)
+		}
+		if len(line)-len(trimmed) == indent {
+			lines = append(lines, i+1)
+		}
+	}
+	if len(lines) != count {
+		return nil
+	}
+	return lines
+}
+
+// query_file_paths expands -query-file into the query files to read: every
+// .yaml, .yml, .json and .toml file in a directory, the matches of a glob
+// pattern or just the path itself, in lexical order.
+func query_file_paths(path string) ([]string, error) {
+	if path == "-" {
+		return []string{path}, nil
+	}
+	var paths []string
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && info.IsDir():
+		for _, extension := range []string{"*.yaml", "*.yml", "*.json", "*.toml"} {
+			matches, err := filepath.Glob(filepath.Join(path, extension))
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, matches...)
+		}
+	case err != nil && strings.ContainsAny(path, "*?["):
+		if paths, err = filepath.Glob(path); err != nil {
+			return nil, fmt.Errorf("Invalid query file pattern %v: %v", path, err)
+		}
+	default:
+		return []string{path}, nil
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No query files in %v", path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// load_query_files reads the queries of every file in -query-file. Query
+// names may repeat within a file (e.g. one metric from two queries with
+// different tags) but a name in two files is most likely two teams picking
+// the same one, so it's an error.
+func load_query_files(path string) (Queries, error) {
+	paths, err := query_file_paths(path)
+	if err != nil {
+		return nil, err
+	}
+	var loaded Queries
+	files := map[string]string{}
+	for _, file := range paths {
+		file_queries, err := load_query_file(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := check_duplicate_names(files, file, file_queries); err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, file_queries...)
+	}
+	return loaded, nil
+}
+
+// check_duplicate_names records the file of each query name in files,
+// returning an error for names already used by another file.
+func check_duplicate_names(files map[string]string, file string, file_queries Queries) error {
+	for _, query := range file_queries {
+		if previous, ok := files[query.Name]; ok && previous != file {
+			return fmt.Errorf("Query %v is in both %v and %v", query.Name, previous, file)
+		}
+		files[query.Name] = file
+	}
+	return nil
+}
+
+// check_file_query checks the options of a query from a query file,
+// normalizing its namespace.
+func check_file_query(query *Query) error {
+	if query.SampleRate < 0 || query.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	if query.SampleRate > 0 && query.SampleRate < 1 && *sink_type == "api" && !*dry_run {
+		return fmt.Errorf("sample_rate needs -sink dogstatsd, the api sink can't scale sampled counts back up")
+	}
+	if query.SetLabel != "" && query.Type != Set {
+		return fmt.Errorf("set_label is only supported for set")
+	}
+	if query.Type == Set && *sink_type == "api" && !*dry_run {
+		return fmt.Errorf("set needs -sink dogstatsd, the Datadog API has no set type")
+	}
+	if (query.Type == Distribution || (query.Timing != nil && query.Timing.query_type() == Distribution)) && *sink_type == "api" && !*dry_run {
+		return fmt.Errorf("distribution needs -sink dogstatsd, the api sink only sends series")
+	}
+	if query.ZeroFill && query.Type != Gauge {
+		return fmt.Errorf("zero_fill is only supported for gauges")
+	}
+	if query.KeepAlive > 0 && query.Type != Gauge {
+		return fmt.Errorf("keepalive is only supported for gauges")
+	}
+	if query.Exemplars != nil && query.Exemplars.Mode != "tags" && query.Exemplars.Mode != "events" {
+		return fmt.Errorf("exemplars mode must be tags or events")
+	}
+	if query.Namespace != nil {
+		namespace, err := parse_namespace(*query.Namespace)
+		if err != nil {
+			return err
+		}
+		query.Namespace = &namespace
+	}
+	if query.ChangeEvents != nil && query.ChangeEvents.Threshold < 0 {
+		return fmt.Errorf("change_events threshold can't be negative")
+	}
+	if query.TagSampling != nil && (query.TagSampling.Keep < 0 || !valid_tag_sampling_aggregate(query.TagSampling.Aggregate)) {
+		return fmt.Errorf("tag_sampling needs a keep of zero or more and an aggregate of sum, avg, min or max")
+	}
+	for _, tag := range query.Tags {
+		if _, err := parse_tag_template(tag); err != nil {
+			return fmt.Errorf("invalid tag template %q: %v", tag, err)
+		}
+		if !strings.Contains(tag, "{{") && tagformat.Sanitize(tag) != tag {
+			return fmt.Errorf("invalid tag %q: tags can't contain , | or newlines, must be valid UTF-8 and at most %d characters", tag, tagformat.MaxLength)
+		}
+	}
+	if err := validate_label_filter(*query); err != nil {
+		return err
+	}
+	for label, key := range query.LabelMap {
+		if label == "" || key == "" {
+			return fmt.Errorf("label_map needs a label and a tag key for every entry")
+		}
+	}
+	if len(metric_name_labels(query.Name)) > 0 {
+		// These push the query's name itself, which has no labels to fill in
+		switch {
+		case query.ValueLabels != nil:
+			return fmt.Errorf("a templated name can't be used with value_labels")
+		case query.Summary != nil:
+			return fmt.Errorf("a templated name can't be used with summary")
+		case query.OnEmpty == EmptyPushZero:
+			return fmt.Errorf("a templated name can't be used with on_empty push_zero")
+		}
+	}
+	if query.MaxSamples < 0 {
+		return fmt.Errorf("max_samples can't be negative")
+	}
+	if query.OnMaxSamples != "" && query.MaxSamples == 0 {
+		return fmt.Errorf("on_max_samples needs max_samples")
+	}
+	if err := validate_value_transform(*query); err != nil {
+		return err
+	}
+	if query.Expect != nil {
+		if err := query.Expect.validate(); err != nil {
+			return err
+		}
+	}
+	for _, value_tag := range query.ValueTags {
+		if err := value_tag.validate(); err != nil {
+			return err
+		}
+	}
+	if len(query.ValueTags) > 0 && query.Cumulative {
+		// The band of a total would split it into a series per band
+		return fmt.Errorf("value_tags can't be used with cumulative")
+	}
+	for _, region := range query.Regions {
+		if _, ok := prometheus_regions[region]; !ok {
+			return fmt.Errorf("unknown region %v (add it with -prometheus-region)", region)
+		}
+	}
+	if query.RegionDedup && len(query.Regions) == 0 {
+		return fmt.Errorf("region_dedup needs regions")
+	}
+	if query.Timing != nil {
+		if query.Type != Milliseconds {
+			return fmt.Errorf("timing is only supported for milliseconds")
+		}
+		if err := query.Timing.validate(); err != nil {
+			return err
+		}
+	}
+	if query.Logs && *logs_url == "" && !*dry_run {
+		return fmt.Errorf("logs needs -datadog-logs-url")
+	}
+	if query.DoubleWrite && *secondary_api_key == "" && !*dry_run {
+		return fmt.Errorf("double_write needs -secondary-datadog-api-key")
+	}
+	if query.Interval < 0 || (query.Interval > 0 && query.Interval < time.Duration(interval)) {
+		return fmt.Errorf("interval can't be shorter than -interval (%v), queries run at most once a cycle", time.Duration(interval))
+	}
+	if query.Cumulative && query.Type != Counter && query.Type != Rate {
+		return fmt.Errorf("cumulative is only supported for counter and rate")
+	}
+	if err := validate_range(*query); err != nil {
+		return err
+	}
+	if err := validate_federate(*query); err != nil {
+		return err
+	}
+	if err := validate_time_shifts(query.TimeShifts); err != nil {
+		return err
+	}
+	if query.Summary != nil {
+		if err := query.Summary.validate(); err != nil {
+			return err
+		}
+		if query.Summary.Only && (query.ZeroFill || query.ChangeEvents != nil) {
+			return fmt.Errorf("summary only can't be used with zero_fill or change_events, which track the series")
+		}
+	}
+	if query.PushTogether && query.ValueLabels == nil {
+		return fmt.Errorf("push_together needs value_labels")
+	}
+	if query.ValueLabels != nil && (query.ValueLabels.Label == "" || len(query.ValueLabels.Names) == 0) {
+		return fmt.Errorf("value_labels needs a label and at least one name")
+	}
+	return nil
+}
+
+// detect_query_file_format is the format of a query file: the
+// -query-file-format flag if given and the file is -query-file itself
+// (stdin or a file given by name), otherwise guessed from its extension, so
+// the files of a directory or glob can mix formats.
+func detect_query_file_format(path string) string {
+	if *query_file_format != "" && path == *query_file {
+		return *query_file_format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	}
+	return "yaml"
+}
+
+// query_file_yaml returns a query file's contents as YAML, which the queries
+// are decoded from whatever the file's format. JSON is mostly valid YAML
+// already but converting it copes with tab indentation and gives JSON syntax
+// errors. TOML is converted the same way.
+func query_file_yaml(path string, data []byte) ([]byte, error) {
+	switch format := detect_query_file_format(path); format {
+	case "yaml":
+		return data, nil
+	case "json":
+		var decoded interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return nil, fmt.Errorf("Can't parse JSON query file %v: %v", path, err)
+		}
+		return yaml.Marshal(decoded)
+	case "toml":
+		// TOML documents are tables, the list is an array of tables:
+		// [[queries]]
+		var decoded struct {
+			Queries []map[string]interface{} `toml:"queries"`
+		}
+		if _, err := toml.Decode(string(data), &decoded); err != nil {
+			return nil, fmt.Errorf("Can't parse TOML query file %v: %v", path, err)
+		}
+		return yaml.Marshal(decoded.Queries)
+	default:
+		return nil, fmt.Errorf("Unknown query file format %v (expected yaml, json or toml)", format)
+	}
+}
+
+var stdin_queries = struct {
+	sync.Once
+	data []byte
+	err  error
+}{}
+
+// read_query_file reads a query file, or stdin for "-". Stdin can only be
+// read once so its contents are kept for reloads.
+func read_query_file(path string) ([]byte, error) {
+	if path != "-" {
+		return ioutil.ReadFile(path)
+	}
+	stdin_queries.Do(func() {
+		stdin_queries.data, stdin_queries.err = ioutil.ReadAll(os.Stdin)
+	})
+	return stdin_queries.data, stdin_queries.err
+}
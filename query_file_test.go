@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestQueryFileFormats loads the same queries as YAML, JSON and TOML.
+func TestQueryFileFormats(t *testing.T) {
+	files := map[string]string{
+		"queries.yaml": "- name: http.requests\n  type: gauge\n  query: sum(rate(http_requests_total[1m]))\n  interval: 5m\n  tags: [team:payments]\n",
+		"queries.json": `[{"name": "http.requests", "type": "gauge", "query": "sum(rate(http_requests_total[1m]))", "interval": "5m", "tags": ["team:payments"]}]`,
+		"queries.toml": "[[queries]]\nname = \"http.requests\"\ntype = \"gauge\"\nquery = \"sum(rate(http_requests_total[1m]))\"\ninterval = \"5m\"\ntags = [\"team:payments\"]\n",
+	}
+	dir := t.TempDir()
+	loaded := map[string]Queries{}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		queries, err := load_query_file(path)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		loaded[name] = queries
+	}
+	if len(loaded["queries.yaml"]) != 1 {
+		t.Fatalf("loaded %+v from YAML, expected one query", loaded["queries.yaml"])
+	}
+	for _, name := range []string{"queries.json", "queries.toml"} {
+		if !reflect.DeepEqual(loaded[name], loaded["queries.yaml"]) {
+			t.Errorf("%v gave %+v, expected %+v as from YAML", name, loaded[name], loaded["queries.yaml"])
+		}
+	}
+
+	broken := filepath.Join(dir, "broken.toml")
+	if err := ioutil.WriteFile(broken, []byte("[[queries]\nname = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load_query_file(broken); err == nil {
+		t.Error("broken TOML accepted")
+	}
+}
+
+// TestQueryFileFormatOverride only forces the format of a file given by
+// name, the files of a directory keep their own.
+func TestQueryFileFormatOverride(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.yaml": "- name: a\n  type: gauge\n  query: up\n",
+		"b.json": `[{"name": "b", "type": "gauge", "query": "up"}]`,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	real_file, real_format := *query_file, *query_file_format
+	defer func() { *query_file, *query_file_format = real_file, real_format }()
+	*query_file_format = "json"
+
+	*query_file = dir
+	loaded, err := load_query_files(dir)
+	if err != nil || len(loaded) != 2 {
+		t.Errorf("loaded %+v (%v) from the directory, expected a and b", loaded, err)
+	}
+	*query_file = filepath.Join(dir, "queries.conf")
+	if format := detect_query_file_format(*query_file); format != "json" {
+		t.Errorf("-query-file detected as %v, expected the -query-file-format", format)
+	}
+	if format := detect_query_file_format(filepath.Join(dir, "a.yaml")); format != "yaml" {
+		t.Errorf("a.yaml of another -query-file detected as %v", format)
+	}
+}
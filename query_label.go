@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// QueryLabelMode controls how a PromQL expression is turned into the query
+// label on the bridge's own metrics.
+type QueryLabelMode string
+
+const (
+	QueryLabelRaw      QueryLabelMode = "raw"
+	QueryLabelTruncate QueryLabelMode = "truncate"
+	QueryLabelHash     QueryLabelMode = "hash"
+	QueryLabelName     QueryLabelMode = "name"
+)
+
+func (mode *QueryLabelMode) String() string {
+	return string(*mode)
+}
+
+func (mode *QueryLabelMode) Set(value string) error {
+	switch QueryLabelMode(value) {
+	case QueryLabelRaw, QueryLabelTruncate, QueryLabelHash, QueryLabelName:
+		*mode = QueryLabelMode(value)
+		return nil
+	}
+	return fmt.Errorf("Can't handle query label mode %v (expected raw, truncate, hash or name)", value)
+}
+
+// query_label sanitizes a query for use as a label value. Multi-line
+// expressions are collapsed onto one line before truncating.
+func query_label(query Query) string {
+	switch query_label_mode {
+	case QueryLabelRaw:
+		return query.Query
+	case QueryLabelHash:
+		sum := sha256.Sum256([]byte(query.Query))
+		return hex.EncodeToString(sum[:6])
+	case QueryLabelName:
+		return query.Name
+	}
+	label := strings.Join(strings.Fields(query.Query), " ")
+	if len(label) > *query_label_max_length {
+		label = label[:*query_label_max_length] + "..."
+	}
+	return label
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// QueryMethod is the HTTP method queries are sent to Prometheus with.
+type QueryMethod string
+
+const (
+	// QueryPost sends the expression in a form body, so generated
+	// expressions aren't limited by the URL length proxies accept.
+	QueryPost QueryMethod = "POST"
+	// QueryGet sends it in the URL, for proxies only letting GET through.
+	QueryGet QueryMethod = "GET"
+)
+
+func (method *QueryMethod) String() string {
+	return string(*method)
+}
+
+func (method *QueryMethod) Set(value string) error {
+	switch QueryMethod(strings.ToUpper(value)) {
+	case QueryPost, QueryGet:
+		*method = QueryMethod(strings.ToUpper(value))
+		return nil
+	}
+	return fmt.Errorf("Can't handle query method %v (expected POST or GET)", value)
+}
+
+// PostQueryTransport turns the GET requests the Prometheus client makes to
+// /api/v1/query and /api/v1/query_range into form encoded POSTs with the
+// same parameters, which Prometheus accepts since 2.1. Other requests (e.g.
+// the configuration read for external labels) are passed on untouched.
+type PostQueryTransport struct {
+	next http.RoundTripper
+}
+
+func NewPostQueryTransport(next http.RoundTripper) *PostQueryTransport {
+	return &PostQueryTransport{next: next}
+}
+
+func (transport *PostQueryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || !is_query_path(req.URL.Path) {
+		return transport.next.RoundTrip(req)
+	}
+	post := req.Clone(req.Context())
+	form := post.URL.RawQuery
+	post.Method = http.MethodPost
+	post.URL.RawQuery = ""
+	post.Body = io.NopCloser(strings.NewReader(form))
+	post.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(form)), nil
+	}
+	post.ContentLength = int64(len(form))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return transport.next.RoundTrip(post)
+}
+
+// CancelRequest lets the Prometheus client cancel requests through the
+// wrapper, the requests themselves are canceled through their context.
+func (transport *PostQueryTransport) CancelRequest(req *http.Request) {
+	if canceler, ok := transport.next.(interface {
+		CancelRequest(*http.Request)
+	}); ok {
+		canceler.CancelRequest(req)
+	}
+}
+
+func is_query_path(path string) bool {
+	return strings.HasSuffix(path, "/api/v1/query") || strings.HasSuffix(path, "/api/v1/query_range")
+}
+
+// check_query_lengths rejects expressions (after -var expansion) longer than
+// -max-query-length, when set.
+func check_query_lengths(loaded Queries) error {
+	if *max_query_length <= 0 {
+		return nil
+	}
+	for _, query := range loaded {
+		if len(query.Query) > *max_query_length {
+			return fmt.Errorf("Query %v: expression is %d bytes, over -max-query-length %d", query.Name, len(query.Query), *max_query_length)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuerySet holds the active queries, which can be swapped while the bridge
+// is running.
+type QuerySet struct {
+	sync.RWMutex
+	queries Queries
+	muted   map[string]time.Time
+	// last_run is when queries with their own interval last ran.
+	last_run map[string]time.Time
+	// load reads the queries again for a reload, load_queries unless a
+	// test replaces it.
+	load func() (Queries, error)
+}
+
+func NewQuerySet(queries Queries) *QuerySet {
+	return &QuerySet{queries: queries, muted: map[string]time.Time{}, last_run: map[string]time.Time{}, load: load_queries}
+}
+
+func (set *QuerySet) Queries() Queries {
+	set.RLock()
+	defer set.RUnlock()
+	return set.queries
+}
+
+func (set *QuerySet) Replace(queries Queries) {
+	set.Lock()
+	defer set.Unlock()
+	set.queries = queries
+	// Mutes are kept, a removed query may come back while it's muted
+	known := make(map[string]bool, len(queries))
+	for _, query := range queries {
+		known[query.Name] = true
+	}
+	for name := range set.last_run {
+		if !known[name] {
+			delete(set.last_run, name)
+		}
+	}
+}
+
+func (set *QuerySet) Find(name string) (Query, bool) {
+	for _, query := range set.Queries() {
+		if query.Name == name {
+			return query, true
+		}
+	}
+	return Query{}, false
+}
+
+// Mute stops a query from running until the given time.
+func (set *QuerySet) Mute(name string, until time.Time) {
+	set.Lock()
+	defer set.Unlock()
+	if until.IsZero() {
+		delete(set.muted, name)
+		return
+	}
+	set.muted[name] = until
+}
+
+func (set *QuerySet) Muted(name string, now time.Time) bool {
+	set.RLock()
+	defer set.RUnlock()
+	until, ok := set.muted[name]
+	return ok && now.Before(until)
+}
+
+// query_interval is how often a query runs: its own interval if it has one
+// longer than the cycle interval, otherwise every cycle.
+func query_interval(query Query, cycle time.Duration) time.Duration {
+	if query.Interval > cycle {
+		return query.Interval
+	}
+	return cycle
+}
+
+// Due is true if a query should run in the cycle at now, given the cycle
+// interval. Queries with their own interval are due once it has passed since
+// they last ran, less half a cycle for scheduling jitter.
+func (set *QuerySet) Due(query Query, now time.Time, cycle time.Duration) bool {
+	every := query_interval(query, cycle)
+	if every == cycle {
+		return true
+	}
+	set.RLock()
+	defer set.RUnlock()
+	last, ok := set.last_run[query.Name]
+	return !ok || now.Sub(last) >= every-cycle/2
+}
+
+// next_run is the tick a query which ran in the cycle at now is next due at,
+// following Due.
+func next_run(query Query, now time.Time, cycle time.Duration) time.Time {
+	every := query_interval(query, cycle)
+	cycles := (every - cycle/2 + cycle - 1) / cycle
+	if cycles < 1 {
+		cycles = 1
+	}
+	return now.Add(cycles * cycle)
+}
+
+// Ran records the cycle a query with its own interval ran in.
+func (set *QuerySet) Ran(query Query, now time.Time) {
+	if query.Interval == 0 {
+		return
+	}
+	set.Lock()
+	defer set.Unlock()
+	set.last_run[query.Name] = now
+}
+
+// load_queries combines the queries given with -query, the ones in
+// -query-file (or else the -config file) and -openmetrics-file, the ones generated by -discover and the
+// -canary.
+func load_queries() (Queries, error) {
+	loaded := append(Queries{}, queries...)
+	loaded = append(loaded, discovery.Queries()...)
+	if *query_file != "" {
+		file_queries, err := load_query_files(*query_file)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, file_queries...)
+	} else if *config_path != "" {
+		config_queries, problems := load_config_queries(*config_path)
+		if len(problems) > 0 {
+			return nil, fmt.Errorf("%v", strings.Join(problems, "\n"))
+		}
+		loaded = append(loaded, config_queries...)
+	}
+	if *openmetrics_file != "" {
+		openmetrics_queries, err := load_openmetrics_file(*openmetrics_file)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, openmetrics_queries...)
+	}
+	if err := validate_query_names(loaded); err != nil {
+		return nil, err
+	}
+	loaded, err := expand_query_vars(loaded, query_vars)
+	if err != nil {
+		return nil, err
+	}
+	if err := check_query_lengths(loaded); err != nil {
+		return nil, err
+	}
+	if err := check_cumulative_names(loaded); err != nil {
+		return nil, err
+	}
+	if loaded, err = filter_queries(loaded, only_queries, skip_queries); err != nil {
+		return nil, err
+	}
+	// After -only and -skip, which name the configured queries
+	canaries, err := canary_queries(loaded)
+	if err != nil {
+		return nil, err
+	}
+	return append(loaded, canaries...), nil
+}
+
+// QueryNames is a set of query names given as a comma separated list, for
+// -only and -skip.
+type QueryNames map[string]bool
+
+func (flags QueryNames) String() string {
+	return "QueryNames"
+}
+
+func (flags QueryNames) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			flags[name] = true
+		}
+	}
+	return nil
+}
+
+// filter_queries keeps the queries in only (all of them if it's empty) which
+// aren't in skip. Names which don't match any query are an error, so a typo
+// doesn't silently run nothing.
+func filter_queries(loaded Queries, only QueryNames, skip QueryNames) (Queries, error) {
+	known := make(map[string]bool, len(loaded))
+	for _, query := range loaded {
+		known[query.Name] = true
+	}
+	for _, names := range []QueryNames{only, skip} {
+		for name := range names {
+			if !known[name] {
+				return nil, fmt.Errorf("No query named %v", name)
+			}
+		}
+	}
+
+	var filtered Queries
+	for _, query := range loaded {
+		if (len(only) == 0 || only[query.Name]) && !skip[query.Name] {
+			filtered = append(filtered, query)
+		}
+	}
+	return filtered, nil
+}
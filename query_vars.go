@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// QueryVars are the -var variables substituted into query expressions, so
+// one query file can serve several environments, e.g. with -var
+// environment=prod:
+//
+//	query: sum(rate(http_requests_total{env="{{.environment}}"}[1m]))
+type QueryVars map[string]string
+
+func (flags QueryVars) String() string {
+	return "QueryVars"
+}
+
+func (flags QueryVars) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Variable must be in the form name=value (%v)", value)
+	}
+	flags[parts[0]] = parts[1]
+	return nil
+}
+
+// expand_query_vars substitutes the variables into the expressions of the
+// queries containing {{. Using a variable which isn't set is an error rather
+// than an empty string, which would still be valid PromQL.
+func expand_query_vars(queries Queries, vars QueryVars) (Queries, error) {
+	expanded := make(Queries, len(queries))
+	for i, query := range queries {
+		expanded[i] = query
+		if !strings.Contains(query.Query, "{{") {
+			continue
+		}
+		parsed, err := template.New(query.Name).Option("missingkey=error").Parse(query.Query)
+		if err != nil {
+			return nil, fmt.Errorf("Query %v: %v", query.Name, err)
+		}
+		var rendered bytes.Buffer
+		if err := parsed.Execute(&rendered, map[string]string(vars)); err != nil {
+			return nil, fmt.Errorf("Query %v: %v (set it with -var)", query.Name, err)
+		}
+		expanded[i].Query = rendered.String()
+	}
+	return expanded, nil
+}
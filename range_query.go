@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+// range_max_points is Prometheus' limit of points per series in a range
+// query.
+const range_max_points = 11000
+
+// range_step is the resolution of a range query, the query's interval by
+// default.
+func range_step(query Query) time.Duration {
+	if query.Step > 0 {
+		return query.Step
+	}
+	return query_interval(query, time.Duration(interval))
+}
+
+// validate_range checks the range and step of a query, and that it doesn't
+// use options which work on the single value of each series.
+func validate_range(query Query) error {
+	if query.Range == 0 {
+		if query.Step != 0 {
+			return fmt.Errorf("step needs range")
+		}
+		return nil
+	}
+	if query.Range < 0 || query.Step < 0 {
+		return fmt.Errorf("range and step can't be negative")
+	}
+	if *sink_type != "api" && !*dry_run {
+		return fmt.Errorf("range needs -sink api, dogstatsd can't send timestamps")
+	}
+	if query.Range/range_step(query) >= range_max_points {
+		return fmt.Errorf("range of %v at a step of %v is more than Prometheus' %d points per series", query.Range, range_step(query), range_max_points)
+	}
+	switch {
+	case query.Type == CountPerRun:
+		return fmt.Errorf("range can't be used with count_per_run, whose points would be deduplicated, use counter")
+	case len(query.Regions) > 0, query.ZeroFill, query.KeepAlive > 0, query.Summary != nil, query.TagSampling != nil,
+		query.ChangeEvents != nil, query.Exemplars != nil, len(query.TimeShifts) > 0, query.Cumulative:
+		return fmt.Errorf("range can't be used with regions, zero_fill, keepalive, summary, tag_sampling, change_events, exemplars, time_shifts or cumulative")
+	}
+	return nil
+}
+
+// run_range_query runs a query with a range as a range query over the range
+// up to when, pushing every point of every series with its own timestamp.
+// Ranges longer than the interval send points again, which the Datadog API
+// replaces.
+func run_range_query(ctx context.Context, query Query, query_api prometheus.QueryAPI, when time.Time, sink Sink, policy TimeoutPolicy) error {
+	r := prometheus.Range{Start: when.Add(-query.Range), End: when, Step: range_step(query)}
+	results, err := query_api.QueryRange(ctx, query.Query, r)
+	if err != nil {
+		count_failed_query(query, query_error_class(err), err)
+		return err
+	}
+	matrix, ok := results.(model.Matrix)
+	if !ok {
+		return fmt.Errorf("Expected a range vector from %v, got %v", query.Name, results.Type())
+	}
+	if *use_external_labels {
+		metrics := make(model.Vector, len(matrix))
+		for i, series := range matrix {
+			metrics[i] = &model.Sample{Metric: series.Metric}
+		}
+		for i, labelled := range add_external_labels(metrics, *prometheus_addr) {
+			matrix[i].Metric = labelled.Metric
+		}
+	}
+	debugf("Range query %v returned %d series", query.Name, len(matrix))
+	if matrix, err = limit_matrix(query, matrix); err != nil {
+		return err
+	}
+	if len(matrix) == 0 {
+		return handle_empty_result(query, when, sink)
+	}
+
+	for i, series := range matrix {
+		if ctx.Err() != nil {
+			return budget_exceeded(ctx, query, policy, i, len(matrix))
+		}
+		name, tags, keep, err := series_name_and_tags(query, series.Metric)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+		for _, point := range series.Values {
+			computed, err := render_tags(query, series.Metric, float64(point.Value))
+			if err != nil {
+				return fmt.Errorf("Can't render tags for %v: %v", query.Name, err)
+			}
+			pushed := Sample{Name: name, Value: float64(point.Value), Tags: append(tags[:len(tags):len(tags)], computed...), Timestamp: point.Timestamp.Time()}
+			if err := push_sample(query, pushed, sink); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
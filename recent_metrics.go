@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// recent_sample is a pushed sample as held by RecentSink.
+type recent_sample struct {
+	name      string
+	tags      []string
+	value     float64
+	timestamp time.Time
+}
+
+// RecentSink keeps the most recently pushed samples in a ring buffer, so a
+// Prometheus can scrape what the bridge actually sent (e.g. to check parity
+// with the source while migrating).
+type RecentSink struct {
+	sync.Mutex
+	samples []recent_sample
+	// next is where the next sample goes, the oldest sample once full.
+	next int
+	full bool
+}
+
+func NewRecentSink(size int) *RecentSink {
+	return &RecentSink{samples: make([]recent_sample, size)}
+}
+
+func (recent *RecentSink) Push(sample Sample) error {
+	timestamp := sample.Timestamp
+	if timestamp.IsZero() {
+		timestamp = clock.Now()
+	}
+	recent.Lock()
+	defer recent.Unlock()
+	recent.samples[recent.next] = recent_sample{
+		name:      sample.metric_name(default_namespace),
+		tags:      sample.Tags,
+		value:     sample.Value,
+		timestamp: timestamp,
+	}
+	recent.next = (recent.next + 1) % len(recent.samples)
+	recent.full = recent.full || recent.next == 0
+	return nil
+}
+
+func (recent *RecentSink) Flush() error {
+	return nil
+}
+
+func (recent *RecentSink) Close() error {
+	return nil
+}
+
+// held returns the samples in the buffer, oldest first.
+func (recent *RecentSink) held() []recent_sample {
+	recent.Lock()
+	defer recent.Unlock()
+	if !recent.full {
+		return append([]recent_sample{}, recent.samples[:recent.next]...)
+	}
+	return append(append([]recent_sample{}, recent.samples[recent.next:]...), recent.samples[:recent.next]...)
+}
+
+// exposition_name turns a Datadog metric or tag name into a valid Prometheus
+// one, replacing anything else than letters, digits and underscores (and
+// colons in metric names) with underscores.
+func exposition_name(name string, metric bool) string {
+	mapped := []byte(name)
+	for i, c := range mapped {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		case c == ':' && metric:
+		default:
+			mapped[i] = '_'
+		}
+	}
+	return string(mapped)
+}
+
+// exposition_labels turns Datadog tags into labels. Tags without a value get
+// the value true and the values of repeated tags are joined with commas.
+func exposition_labels(tags []string) []*dto.LabelPair {
+	values := map[string][]string{}
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, ":", 2)
+		value := "true"
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		name := exposition_name(parts[0], false)
+		values[name] = append(values[name], value)
+	}
+	labels := make([]*dto.LabelPair, 0, len(values))
+	for name, joined := range values {
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(strings.Join(joined, ","))})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	return labels
+}
+
+// Exposition renders the newest value of each series in the buffer in the
+// Prometheus text exposition format, with the time it was pushed. Everything
+// is untyped as Datadog types don't map onto Prometheus ones.
+func (recent *RecentSink) Exposition() []byte {
+	families := map[string]*dto.MetricFamily{}
+	latest := map[string]*dto.Metric{}
+	for _, sample := range recent.held() {
+		name := exposition_name(sample.name, true)
+		family, ok := families[name]
+		if !ok {
+			family = &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_UNTYPED.Enum()}
+			families[name] = family
+		}
+		metric := &dto.Metric{
+			Label:       exposition_labels(sample.tags),
+			Untyped:     &dto.Untyped{Value: proto.Float64(sample.value)},
+			TimestampMs: proto.Int64(sample.timestamp.UnixNano() / int64(time.Millisecond)),
+		}
+		key := name
+		for _, label := range metric.Label {
+			key += "\xff" + label.GetName() + "=" + label.GetValue()
+		}
+		if existing, ok := latest[key]; ok {
+			*existing = *metric
+			continue
+		}
+		latest[key] = metric
+		family.Metric = append(family.Metric, metric)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out bytes.Buffer
+	for _, name := range names {
+		expfmt.MetricFamilyToText(&out, families[name])
+	}
+	return out.Bytes()
+}
+
+// recent_metrics holds the samples served on /recent_metrics, nil if
+// -recent-metrics-size is zero.
+var recent_metrics *RecentSink
+
+func serve_recent_metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	w.Write(recent_metrics.Exposition())
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+// region_label is added to every series of a query run against several
+// regions, replacing any region label the series already had.
+const region_label = model.LabelName("region")
+
+// PrometheusRegions maps a region name to the address of its Prometheus
+// server, for queries fanned in from several regions.
+type PrometheusRegions map[string]string
+
+func (flags PrometheusRegions) String() string {
+	return "PrometheusRegions"
+}
+
+func (flags PrometheusRegions) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("Prometheus region must be in the form name=address (%v)", value)
+	}
+	flags[parts[0]] = parts[1]
+	return nil
+}
+
+// regional_query_apis holds a query API per -prometheus-region.
+var regional_query_apis = map[string]prometheus.QueryAPI{}
+
+// query_regions runs a query against each of its regions and merges the
+// results, tagging each series with its region. A region failing only drops
+// its own series, the query fails if every region does.
+func query_regions(ctx context.Context, query Query, when time.Time) (model.Vector, error) {
+	var merged model.Vector
+	var last_err error
+	succeeded := 0
+	for _, region := range query.Regions {
+		results, err := regional_query_apis[region].Query(ctx, query.Query, when)
+		if err != nil {
+			class := count_failed_query(query, query_error_class(err), fmt.Errorf("region %v: %v", region, err))
+			log_throttle.Printf(query.Name+"/"+region+"/"+class, "Query %v failed in region %v (%v): %v", query.Name, region, class, err)
+			last_err = err
+			continue
+		}
+		vector, err := instant_vector(results)
+		if err != nil {
+			class := count_failed_query(query, query_error_class(err), fmt.Errorf("region %v: %v", region, err))
+			log_throttle.Printf(query.Name+"/"+region+"/"+class, "Query %v failed in region %v (%v): %v", query.Name, region, class, err)
+			last_err = err
+			continue
+		}
+		succeeded++
+		if *use_external_labels {
+			vector = add_external_labels(vector, prometheus_regions[region])
+		}
+		for _, sample := range vector {
+			tagged := *sample
+			tagged.Metric = sample.Metric.Clone()
+			tagged.Metric[region_label] = model.LabelValue(region)
+			merged = append(merged, &tagged)
+		}
+	}
+	if succeeded == 0 && last_err != nil {
+		return nil, last_err
+	}
+	if query.RegionDedup {
+		merged = dedup_regions(merged)
+	}
+	return merged, nil
+}
+
+// dedup_regions keeps one copy of series returned by several regions, the
+// one with the newest timestamp. Ties (e.g. the evaluation time every
+// instant query returns for aggregations) go to the region listed first.
+func dedup_regions(vector model.Vector) model.Vector {
+	index := map[model.Fingerprint]int{}
+	var deduped model.Vector
+	for _, sample := range vector {
+		without_region := sample.Metric.Clone()
+		delete(without_region, region_label)
+		key := without_region.Fingerprint()
+		if i, ok := index[key]; ok {
+			if sample.Timestamp.After(deduped[i].Timestamp) {
+				deduped[i] = sample
+			}
+			continue
+		}
+		index[key] = len(deduped)
+		deduped = append(deduped, sample)
+	}
+	return deduped
+}
+
+// query_regions_range is query_regions for range queries, e.g. backfills.
+// With region_dedup series returned by several regions are taken from the
+// region listed first.
+func query_regions_range(ctx context.Context, query Query, r prometheus.Range) (model.Matrix, error) {
+	var merged model.Matrix
+	var last_err error
+	succeeded := 0
+	seen := map[model.Fingerprint]bool{}
+	for _, region := range query.Regions {
+		results, err := regional_query_apis[region].QueryRange(ctx, query.Query, r)
+		if err == nil {
+			if _, ok := results.(model.Matrix); !ok {
+				err = fmt.Errorf("Expected a range vector, got %v", results.Type())
+			}
+		}
+		if err != nil {
+			class := count_failed_query(query, query_error_class(err), fmt.Errorf("region %v: %v", region, err))
+			log_throttle.Printf(query.Name+"/"+region+"/"+class, "Query %v failed in region %v (%v): %v", query.Name, region, class, err)
+			last_err = err
+			continue
+		}
+		succeeded++
+		matrix := results.(model.Matrix)
+		if *use_external_labels {
+			metrics := make(model.Vector, len(matrix))
+			for i, series := range matrix {
+				metrics[i] = &model.Sample{Metric: series.Metric}
+			}
+			for i, labelled := range add_external_labels(metrics, prometheus_regions[region]) {
+				matrix[i].Metric = labelled.Metric
+			}
+		}
+		for _, series := range matrix {
+			if query.RegionDedup {
+				without_region := series.Metric.Clone()
+				delete(without_region, region_label)
+				key := without_region.Fingerprint()
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			tagged := *series
+			tagged.Metric = series.Metric.Clone()
+			tagged.Metric[region_label] = model.LabelValue(region)
+			merged = append(merged, &tagged)
+		}
+	}
+	if succeeded == 0 && last_err != nil {
+		return nil, last_err
+	}
+	return merged, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// max_reload_history is how many reloads are kept for /reloads.
+const max_reload_history = 20
+
+// ConfigHashes identifies the configuration a bridge is running.
+type ConfigHashes struct {
+	// QueryFile is the SHA256 of the raw query file, empty without one.
+	QueryFile string `json:"query_file_sha256"`
+	// Queries is the SHA256 of every loaded query, including -query flags.
+	Queries string `json:"queries_sha256"`
+}
+
+// Reload is one entry in the reload history.
+type Reload struct {
+	Time    time.Time    `json:"time"`
+	Result  string       `json:"result"`
+	Error   string       `json:"error,omitempty"`
+	Hashes  ConfigHashes `json:"hashes"`
+	Added   []string     `json:"added,omitempty"`
+	Removed []string     `json:"removed,omitempty"`
+	Changed []string     `json:"changed,omitempty"`
+	// Goroutines is how many goroutines were running after the reload,
+	// steadily growing across reloads is a leak.
+	Goroutines int `json:"goroutines,omitempty"`
+}
+
+var reload_history = struct {
+	sync.Mutex
+	reloads []Reload
+}{}
+
+func config_hashes(loaded Queries) (ConfigHashes, error) {
+	var hashes ConfigHashes
+	if *query_file != "" {
+		paths, err := query_file_paths(*query_file)
+		if err != nil {
+			return hashes, err
+		}
+		// Several files are hashed as if concatenated in lexical order
+		hash := sha256.New()
+		for _, path := range paths {
+			data, err := read_query_file(path)
+			if err != nil {
+				return hashes, err
+			}
+			hash.Write(data)
+		}
+		hashes.QueryFile = hex.EncodeToString(hash.Sum(nil))
+	}
+	encoded, err := json.Marshal(loaded)
+	if err != nil {
+		return hashes, err
+	}
+	sum := sha256.Sum256(encoded)
+	hashes.Queries = hex.EncodeToString(sum[:])
+	return hashes, nil
+}
+
+// diff_queries compares two sets of queries by name.
+func diff_queries(old, new Queries) (added, removed, changed []string) {
+	previous := map[string]Query{}
+	for _, query := range old {
+		previous[query.Name] = query
+	}
+	for _, query := range new {
+		before, ok := previous[query.Name]
+		switch {
+		case !ok:
+			added = append(added, query.Name)
+		case !reflect.DeepEqual(before, query):
+			changed = append(changed, query.Name)
+		}
+		delete(previous, query.Name)
+	}
+	for name := range previous {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	return added, removed, changed
+}
+
+// record_reload adds a reload to the history and updates the config info
+// metric on success.
+func record_reload(reload Reload) {
+	if reload.Result == "success" {
+		configInfo.Reset()
+		configInfo.WithLabelValues(reload.Hashes.QueryFile, reload.Hashes.Queries).Set(1)
+	}
+	reloadsTotal.WithLabelValues(reload.Result).Inc()
+
+	reload_history.Lock()
+	defer reload_history.Unlock()
+	reload_history.reloads = append(reload_history.reloads, reload)
+	if len(reload_history.reloads) > max_reload_history {
+		reload_history.reloads = reload_history.reloads[len(reload_history.reloads)-max_reload_history:]
+	}
+}
+
+// reload_queries re-reads the queries and swaps them into the query set,
+// recording the outcome in the reload history.
+func reload_queries(query_set *QuerySet) (Queries, error) {
+	reload := Reload{Time: time.Now(), Result: "failure"}
+	loaded, err := query_set.load()
+	if err == nil {
+		reload.Hashes, err = config_hashes(loaded)
+	}
+	if err != nil {
+		reload.Error = err.Error()
+		record_reload(reload)
+		return nil, err
+	}
+	reload.Result = "success"
+	reload.Added, reload.Removed, reload.Changed = diff_queries(query_set.Queries(), loaded)
+	query_set.Replace(loaded)
+	forget_removed_queries(reload.Removed)
+	if comparison != nil {
+		if err := comparison.Reload(); err != nil {
+			log.Printf("Failed to reload -compare-query-file, keeping the compared queries: %v", err)
+		}
+	}
+	for _, query := range loaded {
+		for _, mismatch := range range_mismatches(query, time.Duration(interval)) {
+			if log_enabled(LevelWarn) {
+				log.Printf("Query %v: %v", query.Name, mismatch)
+			}
+		}
+	}
+	reload.Goroutines = runtime.NumGoroutine()
+	record_reload(reload)
+	return loaded, nil
+}
+
+// handle_reload_signal reloads the queries on SIGHUP. A query file which
+// fails to load is logged and the running queries are kept.
+func handle_reload_signal(query_set *QuerySet) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go_background("reload_signal", func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-stopping:
+				return
+			case <-signals:
+			}
+			loaded, err := reload_queries(query_set)
+			if err != nil {
+				log.Printf("Reload failed, keeping the running queries: %v", err)
+				continue
+			}
+			log.Printf("Reloaded %d queries", len(loaded))
+		}
+	})
+}
+
+// serve_reloads lists the recent reloads, newest first.
+func serve_reloads(w http.ResponseWriter, r *http.Request) {
+	reload_history.Lock()
+	reloads := make([]Reload, len(reload_history.reloads))
+	for i, reload := range reload_history.reloads {
+		reloads[len(reloads)-1-i] = reload
+	}
+	reload_history.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(reloads)
+}
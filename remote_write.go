@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Largest remote_write request accepted, compressed and decompressed
+const (
+	remote_write_max_body    = 32 * 1024 * 1024
+	remote_write_max_decoded = 8 * remote_write_max_body
+)
+
+// Rollup is how the samples of a series within a bucket are combined.
+type Rollup string
+
+const (
+	RollupSum  Rollup = "sum"
+	RollupLast Rollup = "last"
+	RollupAvg  Rollup = "avg"
+)
+
+func parse_rollup(value string) (Rollup, error) {
+	switch rollup := Rollup(value); rollup {
+	case RollupSum, RollupLast, RollupAvg:
+		return rollup, nil
+	}
+	return "", fmt.Errorf("Can't handle rollup %v (expected sum, last or avg)", value)
+}
+
+// Rollups maps metric names to their rollup, over -remote-write-rollup.
+type Rollups map[string]Rollup
+
+func (flags Rollups) String() string {
+	return "Rollups"
+}
+
+func (flags Rollups) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Metric rollup must be in the form metric:rollup (%v)", value)
+	}
+	rollup, err := parse_rollup(parts[1])
+	if err != nil {
+		return fmt.Errorf("%v (%v)", err, value)
+	}
+	flags[parts[0]] = rollup
+	return nil
+}
+
+// RemoteWriteRollup receives samples from Prometheus' remote_write (every
+// scrape, typically every 15s or less) and rolls them up into buckets of
+// the bucket length per series before pushing them, so Datadog gets one
+// point per series per bucket rather than every raw scrape. A bucket is
+// pushed, timestamped at its start, once it ended delay ago, leaving
+// remote_write time to send its samples late. Samples for a bucket already
+// pushed are dropped.
+type RemoteWriteRollup struct {
+	bucket  time.Duration
+	delay   time.Duration
+	rollup  Rollup
+	rollups Rollups
+	sink    Sink
+	// query names and tags the series like the series of a query.
+	query Query
+
+	sync.Mutex
+	// buckets are the series of each bucket, by its start.
+	buckets map[time.Time]map[string]*rollup_series
+	// flushed is the start of the latest bucket pushed.
+	flushed time.Time
+	// closed is set by the last flush when shutting down.
+	closed bool
+}
+
+type rollup_series struct {
+	name   string
+	tags   []string
+	rollup Rollup
+	sum    float64
+	count  int
+	last   float64
+	at     time.Time
+}
+
+func (series *rollup_series) value() float64 {
+	switch series.rollup {
+	case RollupSum:
+		return series.sum
+	case RollupAvg:
+		return series.sum / float64(series.count)
+	}
+	return series.last
+}
+
+func NewRemoteWriteRollup(bucket, delay time.Duration, rollup Rollup, rollups Rollups, sink Sink) *RemoteWriteRollup {
+	return &RemoteWriteRollup{
+		bucket:  bucket,
+		delay:   delay,
+		rollup:  rollup,
+		rollups: rollups,
+		sink:    sink,
+		query:   Query{Type: Gauge, Name: "remote_write"},
+		buckets: map[time.Time]map[string]*rollup_series{},
+	}
+}
+
+// Add rolls a sample up into its bucket. Returns the result it's counted
+// under in prometheus_to_datadog_remote_write_samples_total.
+func (rollup *RemoteWriteRollup) Add(metric model.Metric, value float64, at time.Time) (string, error) {
+	if reason := non_finite(value); reason != "" {
+		// Including the staleness markers of series which disappeared
+		return reason, nil
+	}
+	name, tags, keep, err := series_name_and_tags(rollup.query, metric)
+	if err != nil {
+		return "invalid", err
+	}
+	if !keep {
+		return "dropped", nil
+	}
+	computed, err := render_tags(rollup.query, metric, value)
+	if err != nil {
+		return "invalid", err
+	}
+	tags = append(tags, computed...)
+
+	start := at.Truncate(rollup.bucket)
+	key := name + "|" + strings.Join(tags, ",")
+	rollup.Lock()
+	defer rollup.Unlock()
+	if rollup.closed || !start.After(rollup.flushed) {
+		return "late", nil
+	}
+	series_by_key, ok := rollup.buckets[start]
+	if !ok {
+		series_by_key = map[string]*rollup_series{}
+		rollup.buckets[start] = series_by_key
+	}
+	series, ok := series_by_key[key]
+	if !ok {
+		series = &rollup_series{name: name, tags: tags, rollup: rollup.rollup}
+		if metric_rollup, ok := rollup.rollups[string(metric[model.MetricNameLabel])]; ok {
+			series.rollup = metric_rollup
+		}
+		series_by_key[key] = series
+	}
+	series.sum += value
+	series.count++
+	// Samples of a request aren't necessarily in order
+	if !at.Before(series.at) {
+		series.last, series.at = value, at
+	}
+	return "accepted", nil
+}
+
+// Flush pushes the buckets which ended delay before now, or every bucket
+// when shutting down. Returns the number of rolled up samples pushed.
+func (rollup *RemoteWriteRollup) Flush(now time.Time, all bool) (int, error) {
+	rollup.Lock()
+	var due []time.Time
+	for start := range rollup.buckets {
+		if all || !start.Add(rollup.bucket+rollup.delay).After(now) {
+			due = append(due, start)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Before(due[j]) })
+	rollup.closed = rollup.closed || all
+	buckets := make([]map[string]*rollup_series, len(due))
+	for i, start := range due {
+		buckets[i] = rollup.buckets[start]
+		delete(rollup.buckets, start)
+		if start.After(rollup.flushed) {
+			rollup.flushed = start
+		}
+	}
+	rollup.Unlock()
+
+	var pushed int
+	for i, start := range due {
+		keys := make([]string, 0, len(buckets[i]))
+		for key := range buckets[i] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			series := buckets[i][key]
+			sample := Sample{Name: series.name, Value: series.value(), Tags: series.tags, Timestamp: start}
+			if err := push_sample(rollup.query, sample, rollup.sink); err != nil {
+				return pushed, err
+			}
+			pushed++
+			remoteWriteRollups.WithLabelValues(string(series.rollup)).Inc()
+		}
+	}
+	if pushed == 0 {
+		return 0, nil
+	}
+	return pushed, rollup.sink.Flush()
+}
+
+// ServeHTTP accepts a remote_write request, a snappy compressed protobuf
+// WriteRequest, on /api/v1/write with an optional grouping key after it.
+func (rollup *RemoteWriteRollup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "remote_write needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case <-stopping:
+		// Prometheus retries, hopefully with the other bridge
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	key, err := grouping_key(r, "/api/v1/write")
+	if err != nil {
+		remoteWriteRequests.WithLabelValues("remote_write", "invalid").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	compressed, err := ioutil.ReadAll(io.LimitReader(r.Body, remote_write_max_body+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(compressed) > remote_write_max_body {
+		http.Error(w, fmt.Sprintf("request over %d bytes", remote_write_max_body), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if decoded, err := snappy.DecodedLen(compressed); err == nil && decoded > remote_write_max_decoded {
+		http.Error(w, fmt.Sprintf("request over %d bytes decompressed", remote_write_max_decoded), http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		remoteWriteRequests.WithLabelValues("remote_write", "invalid").Inc()
+		http.Error(w, fmt.Sprintf("can't decompress: %v", err), http.StatusBadRequest)
+		return
+	}
+	results := intake_results{intake: "remote_write"}
+	err = decode_write_request(data, func(metric model.Metric, value float64, at time.Time) {
+		results.add(rollup, key, metric, value, at)
+	})
+	results.record()
+	if err != nil {
+		// Retrying a malformed request won't help, Prometheus drops it on a 400
+		remoteWriteRequests.WithLabelValues("remote_write", "invalid").Inc()
+		http.Error(w, fmt.Sprintf("can't decode: %v", err), http.StatusBadRequest)
+		return
+	}
+	remoteWriteRequests.WithLabelValues("remote_write", "success").Inc()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decode_write_request decodes a remote_write WriteRequest, calling add with
+// every sample of every series.
+func decode_write_request(data []byte, add func(metric model.Metric, value float64, at time.Time)) error {
+	return proto_fields(data, func(number protowire.Number, encoded []byte, _ uint64) error {
+		if number != 1 {
+			// Metadata
+			return nil
+		}
+		metric := model.Metric{}
+		var values []float64
+		var times []int64
+		err := proto_fields(encoded, func(number protowire.Number, encoded []byte, _ uint64) error {
+			switch number {
+			case 1:
+				var name, value string
+				err := proto_fields(encoded, func(number protowire.Number, encoded []byte, _ uint64) error {
+					switch number {
+					case 1:
+						name = string(encoded)
+					case 2:
+						value = string(encoded)
+					}
+					return nil
+				})
+				metric[model.LabelName(name)] = model.LabelValue(value)
+				return err
+			case 2:
+				var value float64
+				var millis int64
+				err := proto_fields(encoded, func(number protowire.Number, _ []byte, bits uint64) error {
+					switch number {
+					case 1:
+						value = math.Float64frombits(bits)
+					case 2:
+						millis = int64(bits)
+					}
+					return nil
+				})
+				values, times = append(values, value), append(times, millis)
+				return err
+			}
+			// Exemplars and native histograms
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, ok := metric[model.MetricNameLabel]; !ok {
+			return fmt.Errorf("series without a name: %v", metric)
+		}
+		for i, value := range values {
+			add(metric, value, time.Unix(0, times[i]*int64(time.Millisecond)))
+		}
+		return nil
+	})
+}
+
+// proto_fields calls field with every field of a protobuf message, with the
+// bytes of length delimited fields and the bits of the others.
+func proto_fields(data []byte, field func(number protowire.Number, encoded []byte, bits uint64) error) error {
+	for len(data) > 0 {
+		number, wire_type, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		var encoded []byte
+		var bits uint64
+		switch wire_type {
+		case protowire.BytesType:
+			encoded, n = protowire.ConsumeBytes(data)
+		case protowire.VarintType:
+			bits, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			bits, n = protowire.ConsumeFixed64(data)
+		case protowire.Fixed32Type:
+			var bits32 uint32
+			bits32, n = protowire.ConsumeFixed32(data)
+			bits = uint64(bits32)
+		default:
+			n = protowire.ConsumeFieldValue(number, wire_type, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := field(number, encoded, bits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start_remote_write_rollup pushes the buckets which are due every second,
+// and what's left when stopping.
+func start_remote_write_rollup(rollup *RemoteWriteRollup) {
+	go_background("remote_write_rollup", func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			all := false
+			now := time.Now()
+			select {
+			case <-stopping:
+				all = true
+			case now = <-ticker.C:
+			}
+			if _, err := rollup.Flush(now, all); err != nil {
+				log_throttle.Printf("remote_write/"+error_class(err), "Failed to push rolled up remote_write samples: %v", err)
+			}
+			if all {
+				return
+			}
+		}
+	})
+}
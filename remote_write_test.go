@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type write_sample struct {
+	labels []string
+	value  float64
+	millis int64
+}
+
+// write_request encodes a remote_write request, each sample its own series
+// with labels given as name, value pairs.
+func write_request(samples ...write_sample) []byte {
+	var request []byte
+	for _, sample := range samples {
+		var series []byte
+		for i := 0; i < len(sample.labels); i += 2 {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, sample.labels[i])
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, sample.labels[i+1])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var point []byte
+		point = protowire.AppendTag(point, 1, protowire.Fixed64Type)
+		point = protowire.AppendFixed64(point, math.Float64bits(sample.value))
+		point = protowire.AppendTag(point, 2, protowire.VarintType)
+		point = protowire.AppendVarint(point, uint64(sample.millis))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, point)
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+	return snappy.Encode(nil, request)
+}
+
+func TestRemoteWriteRollup(t *testing.T) {
+	sink := &recording_sink{}
+	rollup := NewRemoteWriteRollup(time.Minute, 10*time.Second, RollupAvg, Rollups{"requests_total": RollupLast, "errors": RollupSum}, sink)
+	// 2000-01-01T00:00:00Z in milliseconds
+	const start = 946684800000
+	post := func(body []byte) int {
+		response := httptest.NewRecorder()
+		rollup.ServeHTTP(response, httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(body)))
+		return response.Code
+	}
+
+	code := post(write_request(
+		write_sample{[]string{"__name__", "cpu", "host", "a"}, 1, start},
+		write_sample{[]string{"__name__", "cpu", "host", "a"}, 3, start + 15000},
+		write_sample{[]string{"__name__", "cpu", "host", "b"}, 10, start + 15000},
+		write_sample{[]string{"__name__", "requests_total", "host", "a"}, 7, start + 30000},
+		write_sample{[]string{"__name__", "requests_total", "host", "a"}, 5, start + 15000},
+		write_sample{[]string{"__name__", "errors", "host", "a"}, 2, start},
+		write_sample{[]string{"__name__", "errors", "host", "a"}, 2, start + 30000},
+		// A staleness marker
+		write_sample{[]string{"__name__", "cpu", "host", "c"}, math.NaN(), start},
+		// The next bucket
+		write_sample{[]string{"__name__", "cpu", "host", "a"}, 8, start + 60000},
+	))
+	if code != http.StatusNoContent {
+		t.Fatalf("remote_write returned %d", code)
+	}
+
+	// The first bucket is due once it ended 10s ago
+	at := time.Unix(start/1000, 0)
+	if pushed, err := rollup.Flush(at.Add(69*time.Second), false); pushed != 0 || err != nil {
+		t.Fatalf("Pushed %d (%v) before the first bucket was due", pushed, err)
+	}
+	if pushed, err := rollup.Flush(at.Add(70*time.Second), false); pushed != 4 || err != nil {
+		t.Fatalf("Pushed %d (%v), expected the 4 series of the first bucket", pushed, err)
+	}
+	var got []string
+	for _, sample := range sink.take() {
+		got = append(got, fmt.Sprintf("%v %v %v %v", sample.Name, sample.Value, sample.Tags, sample.Timestamp.Sub(at)))
+	}
+	expected := []string{
+		"cpu 2 [host:a] 0s",
+		"cpu 10 [host:b] 0s",
+		"errors 4 [host:a] 0s",
+		"requests_total 7 [host:a] 0s",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Pushed %q, expected %q", got, expected)
+	}
+
+	// Too late for the first bucket, but not the second
+	if code := post(write_request(
+		write_sample{[]string{"__name__", "cpu", "host", "b"}, 20, start + 45000},
+		write_sample{[]string{"__name__", "cpu", "host", "a"}, 10, start + 75000},
+	)); code != http.StatusNoContent {
+		t.Fatalf("remote_write returned %d", code)
+	}
+	if pushed, err := rollup.Flush(at.Add(70*time.Second), true); pushed != 1 || err != nil {
+		t.Fatalf("Pushed %d (%v), expected the one series of the second bucket", pushed, err)
+	}
+	if samples := sink.take(); len(samples) != 1 || samples[0].Value != 9 || !samples[0].Timestamp.Equal(at.Add(time.Minute)) {
+		t.Errorf("Pushed %+v, expected cpu 9 at the start of the second bucket", samples)
+	}
+
+	if code := post([]byte("not snappy")); code != http.StatusBadRequest {
+		t.Errorf("A malformed request returned %d, expected 400", code)
+	}
+}
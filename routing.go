@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// SinkRoute sends the samples it matches to another destination than the
+// -sink one, e.g. a team's own Datadog org:
+//
+//	-route tag:team:payments=api:PAYMENTS_DD_API_KEY
+type SinkRoute struct {
+	// Tag matches samples with this tag, Name samples whose full metric
+	// name matches this glob. Exactly one is set.
+	Tag  string
+	Name string
+	// Destination is dogstatsd:<address> or api:<environment variable
+	// holding the API key>.
+	Destination string
+}
+
+func (route SinkRoute) String() string {
+	if route.Tag != "" {
+		return "tag:" + route.Tag + "=" + route.Destination
+	}
+	return "name:" + route.Name + "=" + route.Destination
+}
+
+// Matches is true if the sample should go to the route's destination.
+func (route SinkRoute) Matches(sample Sample) bool {
+	if route.Tag != "" {
+		for _, tag := range sample.Tags {
+			if tag == route.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	matched, _ := path.Match(route.Name, sample.metric_name(default_namespace))
+	return matched
+}
+
+// SinkRoutes are the -route flags, in the order given.
+type SinkRoutes []SinkRoute
+
+func (flags *SinkRoutes) String() string {
+	return "SinkRoutes"
+}
+
+func (flags *SinkRoutes) Set(value string) error {
+	split := strings.LastIndex(value, "=")
+	if split < 0 {
+		return fmt.Errorf("Route must be in the form tag:<tag>=<destination> or name:<glob>=<destination> (%v)", value)
+	}
+	matcher, destination := value[:split], value[split+1:]
+	var route SinkRoute
+	switch {
+	case strings.HasPrefix(matcher, "tag:") && len(matcher) > len("tag:"):
+		route.Tag = strings.TrimPrefix(matcher, "tag:")
+	case strings.HasPrefix(matcher, "name:") && len(matcher) > len("name:"):
+		route.Name = strings.TrimPrefix(matcher, "name:")
+		if _, err := path.Match(route.Name, ""); err != nil {
+			return fmt.Errorf("Invalid route name pattern %v (%v)", route.Name, value)
+		}
+	default:
+		return fmt.Errorf("Route must match tag:<tag> or name:<glob> (%v)", value)
+	}
+	kind := strings.SplitN(destination, ":", 2)
+	if len(kind) != 2 || kind[1] == "" || (kind[0] != "dogstatsd" && kind[0] != "api") {
+		return fmt.Errorf("Route destination must be dogstatsd:<address> or api:<API key environment variable> (%v)", value)
+	}
+	route.Destination = destination
+	*flags = append(*flags, route)
+	return nil
+}
+
+// routed_sink is a route and the sink of its destination.
+type routed_sink struct {
+	route SinkRoute
+	sink  Sink
+}
+
+// RoutingSink sends each sample to the sink of the first route matching it,
+// or to the fallback sink if none do. Events always go to the fallback.
+type RoutingSink struct {
+	routes   []routed_sink
+	fallback Sink
+}
+
+// NewRoutingSink builds the destination sinks of the routes with
+// new_destination, routes to the same destination share a sink.
+func NewRoutingSink(routes SinkRoutes, fallback Sink, new_destination func(destination string) (Sink, error)) (*RoutingSink, error) {
+	sinks := map[string]Sink{}
+	router := &RoutingSink{fallback: fallback}
+	for _, route := range routes {
+		sink, ok := sinks[route.Destination]
+		if !ok {
+			var err error
+			if sink, err = new_destination(route.Destination); err != nil {
+				return nil, fmt.Errorf("Route %v: %v", route, err)
+			}
+			sinks[route.Destination] = sink
+		}
+		router.routes = append(router.routes, routed_sink{route: route, sink: sink})
+	}
+	return router, nil
+}
+
+// route_for returns the index of the route a sample goes by, -1 for the
+// fallback.
+func (router *RoutingSink) route_for(sample Sample) int {
+	for i, routed := range router.routes {
+		if routed.route.Matches(sample) {
+			routedSamples.WithLabelValues(routed.route.Destination).Inc()
+			return i
+		}
+	}
+	return -1
+}
+
+func (router *RoutingSink) sink(route int) Sink {
+	if route < 0 {
+		return router.fallback
+	}
+	return router.routes[route].sink
+}
+
+// sinks returns every sink once, the fallback first.
+func (router *RoutingSink) sinks() []Sink {
+	sinks := []Sink{router.fallback}
+	seen := map[string]bool{}
+	for _, routed := range router.routes {
+		if !seen[routed.route.Destination] {
+			seen[routed.route.Destination] = true
+			sinks = append(sinks, routed.sink)
+		}
+	}
+	return sinks
+}
+
+func (router *RoutingSink) Push(sample Sample) error {
+	return router.sink(router.route_for(sample)).Push(sample)
+}
+
+// PushGroup keeps the samples of a group going to the same destination
+// together.
+func (router *RoutingSink) PushGroup(samples []Sample) error {
+	var order []string
+	destinations := map[string]Sink{}
+	groups := map[string][]Sample{}
+	for _, sample := range samples {
+		route := router.route_for(sample)
+		destination := ""
+		if route >= 0 {
+			destination = router.routes[route].route.Destination
+		}
+		if _, ok := groups[destination]; !ok {
+			order = append(order, destination)
+			destinations[destination] = router.sink(route)
+		}
+		groups[destination] = append(groups[destination], sample)
+	}
+	var first error
+	for _, destination := range order {
+		if err := push_group(destinations[destination], groups[destination]); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (router *RoutingSink) Flush() error {
+	var first error
+	for _, sink := range router.sinks() {
+		if err := sink.Flush(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (router *RoutingSink) Close() error {
+	var first error
+	for _, sink := range router.sinks() {
+		if err := sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (router *RoutingSink) Event(event *statsd.Event) error {
+	return send_event(router.fallback, event)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+)
+
+// TickStats describes the most recent tick of the scheduler.
+type TickStats struct {
+	// Time is when the tick was due.
+	Time time.Time
+	// Lag is how long after being due the cycle started, e.g. because the
+	// previous cycle overran.
+	Lag time.Duration
+	// Took is how long the cycle took, including splay waits.
+	Took time.Duration
+	// Samples is the number of samples the cycle pushed.
+	Samples int
+	// Interval is the interval until the next tick.
+	Interval time.Duration
+	// Paused is true for ticks skipped while the scheduler was paused.
+	Paused bool
+	// Standby is true for ticks skipped while the other bridge of an HA
+	// pair leads.
+	Standby bool
+}
+
+// Scheduler runs a query cycle on every tick of the (adaptive) interval until
+// its context is done. It can be paused, skipping whole cycles, e.g. to mute
+// every query during Prometheus maintenance. With an election, only the
+// leader of the HA pair runs cycles.
+type Scheduler struct {
+	ticker    *time.Ticker
+	adaptive  *AdaptiveInterval
+	splay     *Splay
+	query_set *QuerySet
+	query_api prometheus.QueryAPI
+	sink      Sink
+	watchdog  *ScheduleWatchdog
+	election  *LeaderElection
+
+	sync.Mutex
+	paused bool
+	stats  TickStats
+}
+
+func NewScheduler(adaptive *AdaptiveInterval, splay *Splay, query_set *QuerySet, query_api prometheus.QueryAPI, sink Sink, watchdog *ScheduleWatchdog) *Scheduler {
+	return &Scheduler{
+		ticker:    time.NewTicker(adaptive.Current()),
+		adaptive:  adaptive,
+		splay:     splay,
+		query_set: query_set,
+		query_api: query_api,
+		sink:      sink,
+		watchdog:  watchdog,
+	}
+}
+
+// Run runs cycles until ctx is done, returning a channel closed once the
+// last cycle has finished. A running cycle isn't interrupted.
+func (scheduler *Scheduler) Run(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go_background("scheduler", func() {
+		defer close(done)
+		defer scheduler.ticker.Stop()
+		if scheduler.election != nil {
+			defer scheduler.election.Release()
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-scheduler.ticker.C:
+				// A tick which was due while the previous cycle ran
+				// mustn't start another one once stopping
+				if ctx.Err() != nil {
+					return
+				}
+				scheduler.tick(now)
+			}
+		}
+	})
+	return done
+}
+
+// tick runs the cycle due at now, unless paused or standing by.
+func (scheduler *Scheduler) tick(now time.Time) {
+	started := clock.Now()
+	stats := TickStats{Time: now, Lag: started.Sub(now), Interval: scheduler.adaptive.Current(), Paused: scheduler.Paused()}
+	if scheduler.election != nil && !stats.Paused {
+		stats.Standby = !scheduler.election.Leading(started)
+		if !stats.Standby {
+			// Without the checkpoint the deltas would start over from
+			// this bridge's own, possibly stale, totals
+			if err := scheduler.election.Restore(); err != nil {
+				log_throttle.Printf("ha/"+error_class(err), "Failed to restore the HA checkpoint, skipping the cycle: %v", err)
+				stats.Standby = true
+			}
+		}
+	}
+	if stats.Paused || stats.Standby {
+		// Paused queries are skipped on purpose, like muted ones
+		for _, query := range scheduler.query_set.Queries() {
+			scheduler.watchdog.Ran(query.Name, started)
+		}
+	} else {
+		snapshot, next, changed := run_cycle(now, scheduler.adaptive, scheduler.splay, scheduler.query_set, scheduler.query_api, scheduler.sink, scheduler.watchdog)
+		if changed {
+			log.Printf("Query interval is now %v", next)
+			scheduler.ticker.Reset(next)
+		}
+		stats.Took = clock.Now().Sub(started)
+		stats.Samples = len(snapshot.Samples)
+		stats.Interval = next
+		if scheduler.election != nil {
+			if err := scheduler.election.Checkpoint(); err != nil {
+				log_throttle.Printf("ha/"+error_class(err), "Failed to checkpoint the counter totals: %v", err)
+			}
+		}
+	}
+
+	lastCycleLag.Set(stats.Lag.Seconds())
+	lastCycleDuration.Set(stats.Took.Seconds())
+	debugf("Tick at %v: lag %v, took %v, %d samples, paused %v, standby %v", now, stats.Lag, stats.Took, stats.Samples, stats.Paused, stats.Standby)
+	scheduler.Lock()
+	scheduler.stats = stats
+	scheduler.Unlock()
+}
+
+// Pause skips every cycle until Resume, a running cycle finishes.
+func (scheduler *Scheduler) Pause() {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	scheduler.paused = true
+	schedulerPaused.Set(1)
+}
+
+func (scheduler *Scheduler) Resume() {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	scheduler.paused = false
+	schedulerPaused.Set(0)
+}
+
+func (scheduler *Scheduler) Paused() bool {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	return scheduler.paused
+}
+
+// Stats returns the stats of the most recent tick.
+func (scheduler *Scheduler) Stats() TickStats {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	return scheduler.stats
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Scratch buffers for the per sample hot path, which would otherwise
+// allocate for every sample of every cycle (100k samples per cycle turns into
+// heavy GC). Only buffers which don't outlive the call using them are
+// pooled: tag slices handed to sinks are kept by them (e.g. the api sink's
+// batches) so they're never reused.
+var (
+	// tag_scratch holds *[]string, e.g. for sorting a copy of some tags.
+	tag_scratch = sync.Pool{New: func() interface{} { return new([]string) }}
+	// stat_scratch holds *[]byte for formatting dogstatsd values.
+	stat_scratch = sync.Pool{New: func() interface{} { return new([]byte) }}
+	// render_scratch holds *bytes.Buffer for rendering tag templates.
+	render_scratch = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+)
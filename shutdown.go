@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// stopping is closed when the bridge starts shutting down, ending the query
+// and keepalive loops.
+var stopping = make(chan struct{})
+
+// stopping_context returns a context cancelled once stopping is closed.
+func stopping_context() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopping
+		cancel()
+	}()
+	return ctx
+}
+
+// handle_shutdown_signal shuts down cleanly on SIGTERM or SIGINT: no new
+// cycle starts, the running cycle and any other running queries get until
+// the timeout to finish, then the sink is flushed and closed and the HTTP
+// server shut down. Returns a channel closed once done.
+//
+// If queries are still running at the deadline the sink is only flushed,
+// closing it under them could lose their samples or crash the api sink.
+func handle_shutdown_signal(cycles_done <-chan struct{}, sink Sink, server *http.Server, timeout time.Duration) <-chan struct{} {
+	finished := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		defer close(finished)
+		received := <-signals
+		log.Printf("Received %v, shutting down", received)
+		deadline := time.Now().Add(timeout)
+		close(stopping)
+
+		idle := true
+		select {
+		case <-cycles_done:
+		case <-time.After(time.Until(deadline)):
+			log.Printf("The running cycle didn't finish within %v", timeout)
+			idle = false
+		}
+		if !in_flight_queries.Close(deadline) && idle {
+			log.Printf("Queries still running after %v", timeout)
+			idle = false
+		}
+		// The keepalive loop pushes to the sink too
+		if !wait_background(deadline) && idle {
+			log.Printf("Background goroutines still running after %v", timeout)
+			idle = false
+		}
+
+		if err := sink.Flush(); err != nil {
+			log.Printf("Failed to flush sink: %v", err)
+		}
+		if idle {
+			if err := sink.Close(); err != nil {
+				log.Printf("Failed to close sink: %v", err)
+			}
+		}
+
+		// In-flight requests (e.g. a scrape) get a moment even when the
+		// deadline has passed
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shut down the HTTP server: %v", err)
+		}
+	}()
+	return finished
+}
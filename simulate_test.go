@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Set up by main() when running for real
+	log_throttle = NewLogThrottle(*log_interval)
+	os.Exit(m.Run())
+}
+
+// recording_sink keeps every pushed sample, with its timestamp.
+type recording_sink struct {
+	sync.Mutex
+	samples []Sample
+}
+
+func (sink *recording_sink) Push(sample Sample) error {
+	sink.Lock()
+	defer sink.Unlock()
+	sink.samples = append(sink.samples, sample)
+	return nil
+}
+
+func (sink *recording_sink) Flush() error {
+	return nil
+}
+
+func (sink *recording_sink) Close() error {
+	return nil
+}
+
+func (sink *recording_sink) take() []Sample {
+	sink.Lock()
+	defer sink.Unlock()
+	samples := sink.samples
+	sink.samples = nil
+	return samples
+}
+
+// with_sim_clock swaps in a simulated clock for the duration of a test.
+func with_sim_clock(t *testing.T, start time.Time) *SimClock {
+	sim_clock := NewSimClock(start)
+	real := clock
+	clock = sim_clock
+	t.Cleanup(func() { clock = real })
+	return sim_clock
+}
+
+func TestRunCycleSimulated(t *testing.T) {
+	query_api, err := NewFixtureQueryAPI("testdata/simulate_fixtures.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	sim_clock := with_sim_clock(t, start)
+
+	cycle := 10 * time.Second
+	query_set := NewQuerySet(Queries{
+		{Type: Gauge, Name: "up", Query: "up"},
+		{Type: Gauge, Name: "slow", Query: "slow_total", Interval: 3 * cycle},
+	})
+	adaptive := NewAdaptiveInterval(cycle, 0)
+	watchdog := NewScheduleWatchdog(start)
+	sink := &recording_sink{}
+
+	type pushed struct {
+		Name  string
+		Value float64
+		Tags  []string
+		At    time.Duration
+	}
+	expected := [][]pushed{
+		{{"up", 1, []string{"job:a"}, 0}, {"slow", 10, []string{"job:b"}, 0}},
+		{{"up", 2, []string{"job:a"}, 10 * time.Second}},
+		// The last recording repeats once they run out
+		{{"up", 2, []string{"job:a"}, 20 * time.Second}},
+		{{"up", 2, []string{"job:a"}, 30 * time.Second}, {"slow", 10, []string{"job:b"}, 30 * time.Second}},
+		{{"up", 2, []string{"job:a"}, 40 * time.Second}},
+	}
+
+	now := start
+	for i, want := range expected {
+		sim_clock.AdvanceTo(now)
+		snapshot, next, changed := run_cycle(now, adaptive, nil, query_set, query_api, sink, watchdog)
+		if changed || next != cycle {
+			t.Fatalf("cycle %d: next interval %v (changed %v), expected a steady %v", i, next, changed, cycle)
+		}
+		if !snapshot.Time.Equal(now) {
+			t.Errorf("cycle %d: snapshot at %v, expected %v", i, snapshot.Time, now)
+		}
+		if len(snapshot.Samples) != len(want) {
+			t.Errorf("cycle %d: snapshot has %d samples, expected %d", i, len(snapshot.Samples), len(want))
+		}
+
+		var got []pushed
+		for _, sample := range sink.take() {
+			got = append(got, pushed{sample.Name, sample.Value, sample.Tags, sample.Timestamp.Sub(start)})
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("cycle %d: pushed %+v, expected %+v", i, got, want)
+		}
+		now = now.Add(next)
+	}
+
+	if slow, _ := query_set.Find("slow"); !next_run(slow, start.Add(3*cycle), cycle).Equal(start.Add(6 * cycle)) {
+		t.Errorf("slow query next due at %v, expected %v", next_run(slow, start.Add(3*cycle), cycle), start.Add(6*cycle))
+	}
+}
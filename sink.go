@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// Sample is a single value ready to be sent to Datadog.
+type Sample struct {
+	// Query is the name of the query which produced the sample.
+	Query string
+	Type  QueryType
+	// Namespace overrides the sink's namespace when set, an empty
+	// namespace sends the bare name.
+	Namespace *string
+	Name      string
+	Value     float64
+	Tags      []string
+	Timestamp time.Time
+	// Log sends the sample to Datadog Logs instead of as a metric, for
+	// queries with logs: true.
+	Log bool
+	// DoubleWrite also sends the sample to the secondary Datadog org, for
+	// queries with double_write: true.
+	DoubleWrite bool
+	// Interval is the interval of the query's counts when it runs less
+	// often than every cycle.
+	Interval time.Duration
+	// SetMember is the value a set sample adds to the set, for queries
+	// with set_label.
+	SetMember string
+	// SampleRate sends only this fraction of the samples to dogstatsd,
+	// which scales counts and histograms back up. 0 sends them all.
+	SampleRate float64
+}
+
+func (sample Sample) sample_rate() float64 {
+	if sample.SampleRate <= 0 || sample.SampleRate > 1 {
+		return 1
+	}
+	return sample.SampleRate
+}
+
+// sampled_in decides whether a sample is sent under its sample rate,
+// counting the ones which aren't.
+func sampled_in(sample Sample) bool {
+	rate := sample.sample_rate()
+	if rate == 1 || rand.Float64() < rate {
+		return true
+	}
+	droppedSamples.WithLabelValues(sample.Query, "sampled").Inc()
+	return false
+}
+
+// set_member is the value a set sample adds: its SetMember, otherwise its
+// value.
+func (sample Sample) set_member() string {
+	if sample.SetMember != "" {
+		return sample.SetMember
+	}
+	return strconv.FormatFloat(sample.Value, 'g', -1, 64)
+}
+
+// Sink is somewhere samples are sent to.
+type Sink interface {
+	Push(sample Sample) error
+	// Flush is called at the end of every query cycle.
+	Flush() error
+	Close() error
+}
+
+// DogstatsdSink sends samples to a dogstatsd agent.
+type DogstatsdSink struct {
+	client *statsd.Client
+	// namespace is prefixed to metric names unless a sample overrides it.
+	namespace string
+	// hostname is used for events which don't set their own.
+	hostname string
+	// output receives the datagrams, one per line, instead of the agent
+	// if set (-dogstatsd-output).
+	output io.Writer
+	// conn sends groups of datagrams in a single packet, the statsd client
+	// sends one per packet.
+	conn net.Conn
+	// aggregator aggregates samples client-side until the next flush when
+	// set (-dogstatsd-aggregation).
+	aggregator *DogstatsdAggregator
+
+	sync.Mutex
+	cycle PushStats
+}
+
+func NewDogstatsdSink(client *statsd.Client, namespace string, hostname string) *DogstatsdSink {
+	return &DogstatsdSink{client: client, namespace: namespace, hostname: hostname}
+}
+
+func (sink *DogstatsdSink) Push(sample Sample) error {
+	if !sampled_in(sample) {
+		return nil
+	}
+	name := sample.metric_name(sink.namespace)
+	if sink.aggregator.accepts(sample) {
+		sink.aggregator.Add(name, sample)
+		return nil
+	}
+	scratch := stat_scratch.Get().(*[]byte)
+	defer stat_scratch.Put(scratch)
+	stat, err := append_stat((*scratch)[:0], sample)
+	*scratch = stat
+	if err != nil {
+		return err
+	}
+	if sink.output != nil {
+		err = sink.write(format_datagram(sink.client, name, string(stat), sample.sample_rate(), sample.Tags))
+	} else {
+		err = sink.send(name, sample)
+	}
+	if err != nil {
+		return err
+	}
+
+	sink.account(sample.Query, datagram_size(sink.client, name, len(stat), sample.Tags, sample.sample_rate()))
+	return nil
+}
+
+// PushGroup sends the samples in as few packets as possible, each at most
+// statsd.OptimalPayloadSize unless a single datagram is larger.
+func (sink *DogstatsdSink) PushGroup(samples []Sample) error {
+	if sink.output != nil || sink.conn == nil || sink.aggregator != nil {
+		// Written one after the other anyway, or aggregated and then sent
+		// together
+		for _, sample := range samples {
+			if err := sink.Push(sample); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	kept := make([]Sample, 0, len(samples))
+	for _, sample := range samples {
+		if sampled_in(sample) {
+			kept = append(kept, sample)
+		}
+	}
+	samples = kept
+	datagrams := make([]string, 0, len(samples))
+	for _, sample := range samples {
+		stat, err := append_stat(nil, sample)
+		if err != nil {
+			return err
+		}
+		datagrams = append(datagrams, format_datagram(sink.client, sample.metric_name(sink.namespace), string(stat), sample.sample_rate(), sample.Tags))
+	}
+	if err := sink.write_packets(datagrams); err != nil {
+		return err
+	}
+	for i, sample := range samples {
+		sink.account(sample.Query, len(datagrams[i]))
+	}
+	return nil
+}
+
+// write_packets sends datagrams in as few packets as possible, each at most
+// statsd.OptimalPayloadSize unless a single datagram is larger.
+func (sink *DogstatsdSink) write_packets(datagrams []string) error {
+	var packet []byte
+	for _, datagram := range datagrams {
+		if len(packet) > 0 && len(packet)+len("\n")+len(datagram) > statsd.OptimalPayloadSize {
+			if _, err := sink.conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, datagram...)
+	}
+	if len(packet) > 0 {
+		if _, err := sink.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush_aggregates sends what the aggregator holds, if aggregating.
+func (sink *DogstatsdSink) flush_aggregates() error {
+	if sink.aggregator == nil {
+		return nil
+	}
+	aggregated := sink.aggregator.Flush(sink.client)
+	if len(aggregated) == 0 {
+		return nil
+	}
+	datagrams := make([]string, len(aggregated))
+	for i, one := range aggregated {
+		datagrams[i] = one.datagram
+	}
+	var err error
+	switch {
+	case sink.output != nil:
+		for _, datagram := range datagrams {
+			if err = sink.write(datagram); err != nil {
+				break
+			}
+		}
+	case sink.conn != nil:
+		err = sink.write_packets(datagrams)
+	default:
+		err = fmt.Errorf("Can't send aggregated samples without a connection to the agent")
+	}
+	if err != nil {
+		return err
+	}
+	for _, one := range aggregated {
+		sink.account(one.query, len(one.datagram))
+	}
+	return nil
+}
+
+// account records a pushed datagram.
+func (sink *DogstatsdSink) account(query string, size int) {
+	pushedBytes.WithLabelValues(query).Add(float64(size))
+	pushedDatagrams.WithLabelValues(query).Inc()
+	sink.Lock()
+	sink.cycle.Add(size)
+	sink.Unlock()
+}
+
+// send sends a sample to the agent.
+func (sink *DogstatsdSink) send(name string, sample Sample) error {
+	// The statsd client predates distributions, and would sample again
+	// what Push already sampled
+	if sample.Type == Distribution || sample.sample_rate() < 1 {
+		return sink.send_datagram(name, sample)
+	}
+	switch sample.Type {
+	case Gauge, Rate:
+		// dogstatsd has no rate type, the per-second value is a gauge
+		return sink.client.Gauge(name, sample.Value, sample.Tags, 1)
+	case Counter:
+		return sink.client.Count(name, int64(sample.Value), sample.Tags, 1)
+	case CountPerRun:
+		return sink.client.Count(name, rounded_count(sample.Value), sample.Tags, 1)
+	case Histogram:
+		return sink.client.Histogram(name, sample.Value, sample.Tags, 1)
+	case Set:
+		return sink.client.Set(name, sample.set_member(), sample.Tags, 1)
+	case Milliseconds:
+		return sink.client.TimeInMilliseconds(name, sample.Value, sample.Tags, 1)
+	}
+	return fmt.Errorf("Can't handle %v", sample.Type)
+}
+
+// send_datagram sends a sample formatted by the bridge rather than the
+// statsd client.
+func (sink *DogstatsdSink) send_datagram(name string, sample Sample) error {
+	if sink.conn == nil {
+		return fmt.Errorf("Can't send %v %v without a connection to the agent", sample.Type, name)
+	}
+	stat, err := append_stat(nil, sample)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(sink.conn, format_datagram(sink.client, name, string(stat), sample.sample_rate(), sample.Tags))
+	return err
+}
+
+// append_stat appends a sample's value and dogstatsd type (e.g. 1.500000|g)
+// formatted as the statsd client does.
+func append_stat(stat []byte, sample Sample) ([]byte, error) {
+	switch sample.Type {
+	case Gauge, Rate:
+		return append(strconv.AppendFloat(stat, sample.Value, 'f', 6, 64), "|g"...), nil
+	case Counter:
+		return append(strconv.AppendInt(stat, int64(sample.Value), 10), "|c"...), nil
+	case CountPerRun:
+		return append(strconv.AppendInt(stat, rounded_count(sample.Value), 10), "|c"...), nil
+	case Histogram:
+		return append(strconv.AppendFloat(stat, sample.Value, 'f', 6, 64), "|h"...), nil
+	case Set:
+		return append(append(stat, sample.set_member()...), "|s"...), nil
+	case Milliseconds:
+		return append(strconv.AppendFloat(stat, sample.Value, 'f', 6, 64), "|ms"...), nil
+	case Distribution:
+		return append(strconv.AppendFloat(stat, sample.Value, 'f', 6, 64), "|d"...), nil
+	}
+	return stat, fmt.Errorf("Can't handle %v", sample.Type)
+}
+
+// rounded_count is the count sent for a count_per_run value, rounded rather
+// than truncated as an increase() of 2.9999 is 3.
+func rounded_count(value float64) int64 {
+	return int64(math.Round(value))
+}
+
+// write appends a datagram to the output as a line.
+func (sink *DogstatsdSink) write(datagram string) error {
+	sink.Lock()
+	defer sink.Unlock()
+	_, err := io.WriteString(sink.output, datagram+"\n")
+	return err
+}
+
+func (sink *DogstatsdSink) Flush() error {
+	err := sink.flush_aggregates()
+	sink.Lock()
+	defer sink.Unlock()
+	lastCyclePushedBytes.Set(float64(sink.cycle.Bytes))
+	lastCyclePushedDatagrams.Set(float64(sink.cycle.Datagrams))
+	sink.cycle = PushStats{}
+	return err
+}
+
+func (sink *DogstatsdSink) Close() error {
+	if err := sink.flush_aggregates(); err != nil {
+		log.Printf("Failed to flush aggregated dogstatsd samples: %v", err)
+	}
+	if closer, ok := sink.output.(io.Closer); ok && sink.output != io.Writer(os.Stdout) {
+		closer.Close()
+	}
+	if sink.conn != nil {
+		sink.conn.Close()
+	}
+	return sink.client.Close()
+}
+
+// MultiSink pushes every sample to several sinks.
+type MultiSink []Sink
+
+func (sinks MultiSink) Push(sample Sample) error {
+	var first error
+	for _, sink := range sinks {
+		if err := sink.Push(sample); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (sinks MultiSink) PushGroup(samples []Sample) error {
+	var first error
+	for _, sink := range sinks {
+		if err := push_group(sink, samples); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (sinks MultiSink) Flush() error {
+	var first error
+	for _, sink := range sinks {
+		if err := sink.Flush(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (sinks MultiSink) Close() error {
+	var first error
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// EventSink is implemented by sinks which can send Datadog events.
+type EventSink interface {
+	Event(event *statsd.Event) error
+}
+
+func (sink *DogstatsdSink) Event(event *statsd.Event) error {
+	if event.Hostname == "" {
+		event.Hostname = sink.hostname
+	}
+	if sink.output != nil {
+		datagram, err := event.Encode(sink.client.Tags...)
+		if err != nil {
+			return err
+		}
+		return sink.write(datagram)
+	}
+	return sink.client.Event(event)
+}
+
+func (sinks MultiSink) Event(event *statsd.Event) error {
+	var first error
+	for _, sink := range sinks {
+		if err := send_event(sink, event); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// send_event sends an event if the sink supports them.
+func send_event(sink Sink, event *statsd.Event) error {
+	if event_sink, ok := sink.(EventSink); ok {
+		return event_sink.Event(event)
+	}
+	return nil
+}
+
+// DoubleWriteSink sends every sample to the primary sink and the samples of
+// double_write queries to a second Datadog org as well, e.g. while merging
+// or migrating orgs. Events only go to the primary.
+type DoubleWriteSink struct {
+	primary   Sink
+	secondary Sink
+}
+
+func (sink DoubleWriteSink) Push(sample Sample) error {
+	err := sink.primary.Push(sample)
+	if sample.DoubleWrite {
+		if secondary_err := sink.secondary.Push(sample); err == nil {
+			err = secondary_err
+		}
+	}
+	return err
+}
+
+func (sink DoubleWriteSink) PushGroup(samples []Sample) error {
+	err := push_group(sink.primary, samples)
+	if len(samples) > 0 && samples[0].DoubleWrite {
+		if secondary_err := push_group(sink.secondary, samples); err == nil {
+			err = secondary_err
+		}
+	}
+	return err
+}
+
+func (sink DoubleWriteSink) Flush() error {
+	err := sink.primary.Flush()
+	if secondary_err := sink.secondary.Flush(); err == nil {
+		err = secondary_err
+	}
+	return err
+}
+
+func (sink DoubleWriteSink) Close() error {
+	err := sink.primary.Close()
+	if secondary_err := sink.secondary.Close(); err == nil {
+		err = secondary_err
+	}
+	return err
+}
+
+func (sink DoubleWriteSink) Event(event *statsd.Event) error {
+	return send_event(sink.primary, event)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SnapshotSample is a pushed sample in canonical form: sorted tags and no
+// timestamp, so snapshots from different deployments can be diffed.
+type SnapshotSample struct {
+	Query string   `json:"query"`
+	Name  string   `json:"name"`
+	Type  string   `json:"type"`
+	Value float64  `json:"value"`
+	Tags  []string `json:"tags"`
+}
+
+type Snapshot struct {
+	Time    time.Time        `json:"time"`
+	Samples []SnapshotSample `json:"samples"`
+}
+
+// SnapshotSink records everything pushed during one cycle.
+type SnapshotSink struct {
+	sync.Mutex
+	samples []SnapshotSample
+}
+
+func (sink *SnapshotSink) Push(sample Sample) error {
+	tags := append([]string{}, sample.Tags...)
+	sort.Strings(tags)
+	sink.Lock()
+	defer sink.Unlock()
+	sink.samples = append(sink.samples, SnapshotSample{
+		Query: sample.Query,
+		Name:  sample.metric_name(default_namespace),
+		Type:  sample.Type.String(),
+		Value: sample.Value,
+		Tags:  tags,
+	})
+	return nil
+}
+
+func (sink *SnapshotSink) Flush() error {
+	return nil
+}
+
+func (sink *SnapshotSink) Close() error {
+	return nil
+}
+
+// Snapshot returns the recorded samples sorted by name and tags.
+func (sink *SnapshotSink) Snapshot(now time.Time) *Snapshot {
+	sink.Lock()
+	defer sink.Unlock()
+	samples := append([]SnapshotSample{}, sink.samples...)
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Name != samples[j].Name {
+			return samples[i].Name < samples[j].Name
+		}
+		return strings.Join(samples[i].Tags, ",") < strings.Join(samples[j].Tags, ",")
+	})
+	return &Snapshot{Time: now, Samples: samples}
+}
+
+var latest_snapshot = struct {
+	sync.RWMutex
+	snapshot *Snapshot
+}{}
+
+func publish_snapshot(snapshot *Snapshot) {
+	latest_snapshot.Lock()
+	defer latest_snapshot.Unlock()
+	latest_snapshot.snapshot = snapshot
+}
+
+// serve_snapshot returns the output of the most recent complete cycle.
+func serve_snapshot(w http.ResponseWriter, r *http.Request) {
+	latest_snapshot.RLock()
+	snapshot := latest_snapshot.snapshot
+	latest_snapshot.RUnlock()
+	if snapshot == nil {
+		http.Error(w, "No cycle has completed yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(snapshot)
+}
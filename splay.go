@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Splay staggers queries across the interval with a random offset per
+// query, so a fleet of bridges doesn't hit Prometheus at the same moment.
+// Offsets are kept in a state file if one is given, so restarts (e.g. a
+// deploy restarting the whole fleet together) keep the same pattern. Offsets
+// are pinned to the interval they were computed for and recomputed if it
+// changes.
+type Splay struct {
+	sync.Mutex
+	path     string
+	interval time.Duration
+	offsets  map[string]time.Duration
+	random   *rand.Rand
+}
+
+type splay_state struct {
+	Interval time.Duration            `json:"interval"`
+	Offsets  map[string]time.Duration `json:"offsets"`
+}
+
+func NewSplay(path string, interval time.Duration) (*Splay, error) {
+	splay := &Splay{path: path, interval: interval, offsets: map[string]time.Duration{}, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if path == "" {
+		return splay, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return splay, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state splay_state
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Interval == interval && state.Offsets != nil {
+		splay.offsets = state.Offsets
+	}
+	return splay, nil
+}
+
+// Offset returns a query's offset into the interval, computing and saving
+// one for new queries.
+func (splay *Splay) Offset(name string) time.Duration {
+	splay.Lock()
+	defer splay.Unlock()
+	if offset, ok := splay.offsets[name]; ok {
+		return offset
+	}
+	offset := time.Duration(splay.random.Int63n(int64(splay.interval)))
+	splay.offsets[name] = offset
+	if err := splay.save(); err != nil {
+		log_throttle.Printf("splay/"+error_class(err), "Failed to save splay state to %v: %v", splay.path, err)
+	}
+	return offset
+}
+
+// save writes the offsets atomically. Lock must be held by caller.
+func (splay *Splay) save() error {
+	if splay.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(splay_state{Interval: splay.interval, Offsets: splay.offsets})
+	if err != nil {
+		return err
+	}
+	tmp := splay.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, splay.path)
+}
+
+// Order returns the queries sorted by offset, nil safe (returning them
+// unchanged).
+func (splay *Splay) Order(queries Queries) Queries {
+	if splay == nil {
+		return queries
+	}
+	ordered := append(Queries{}, queries...)
+	offsets := make(map[string]time.Duration, len(ordered))
+	for _, query := range ordered {
+		offsets[query.Name] = splay.Offset(query.Name)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool { return offsets[ordered[i].Name] < offsets[ordered[j].Name] })
+	return ordered
+}
+
+// Wait sleeps until a query's offset after the start of the cycle, nil
+// safe.
+func (splay *Splay) Wait(name string, cycle_start time.Time) {
+	if splay == nil {
+		return
+	}
+	if wait := cycle_start.Add(splay.Offset(name)).Sub(clock.Now()); wait > 0 {
+		clock.Sleep(wait)
+	}
+}
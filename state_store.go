@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// StateStore is the state shared by an HA pair of bridges (-ha-state-store):
+// versioned values whose writes are conditional on the version of a key,
+// e.g. the leader lease, so a bridge which lost its lease can't overwrite
+// what the new leader wrote.
+type StateStore interface {
+	// Get returns a key's value (JSON) and version, version 0 if it isn't
+	// set.
+	Get(key string) ([]byte, uint64, error)
+	// Put sets key to value if check is still at version (0 for not set),
+	// returning key's new version, or false if check has moved on.
+	Put(key string, value []byte, check string, version uint64) (uint64, bool, error)
+}
+
+// new_state_store returns the store of a -ha-state-store URL: file:///dir
+// for a directory on shared storage or http(s)://consul:8500/prefix for
+// Consul's KV store.
+func new_state_store(address string) (StateStore, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "file":
+		if parsed.Path == "" {
+			return nil, fmt.Errorf("-ha-state-store %v has no directory", address)
+		}
+		return NewFileStateStore(parsed.Path)
+	case "http", "https":
+		return NewConsulStateStore(address, os.Getenv("CONSUL_HTTP_TOKEN"), &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: NewInstrumentedTransport("consul", &http.Transport{Proxy: http.ProxyFromEnvironment}),
+		}), nil
+	}
+	return nil, fmt.Errorf("Unknown -ha-state-store %v (expected file:///dir or http(s)://consul:8500/prefix)", address)
+}
+
+// FileStateStore keeps each key in a file of a directory, e.g. on a volume
+// both bridges mount. Writes are serialized with an flock(2) of the
+// directory's .lock file, which needs a filesystem with working locks (NFS
+// v4, not v3 without lockd).
+type FileStateStore struct {
+	dir string
+}
+
+type file_state struct {
+	Version uint64          `json:"version"`
+	Value   json.RawMessage `json:"value"`
+}
+
+func NewFileStateStore(dir string) (*FileStateStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStateStore{dir: dir}, nil
+}
+
+func (store *FileStateStore) Get(key string) ([]byte, uint64, error) {
+	unlock, err := store.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+	state, err := store.read(key)
+	return []byte(state.Value), state.Version, err
+}
+
+func (store *FileStateStore) Put(key string, value []byte, check string, version uint64) (uint64, bool, error) {
+	unlock, err := store.lock(syscall.LOCK_EX)
+	if err != nil {
+		return 0, false, err
+	}
+	defer unlock()
+	checked, err := store.read(check)
+	if err != nil {
+		return 0, false, err
+	}
+	if checked.Version != version {
+		return 0, false, nil
+	}
+	current, err := store.read(key)
+	if err != nil {
+		return 0, false, err
+	}
+	state := file_state{Version: current.Version + 1, Value: value}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return 0, false, err
+	}
+	tmp := store.path(key) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return 0, false, err
+	}
+	if err := os.Rename(tmp, store.path(key)); err != nil {
+		return 0, false, err
+	}
+	return state.Version, true, nil
+}
+
+func (store *FileStateStore) path(key string) string {
+	return filepath.Join(store.dir, key+".json")
+}
+
+// read returns a key's state, a zero version if it isn't set.
+func (store *FileStateStore) read(key string) (file_state, error) {
+	var state file_state
+	data, err := ioutil.ReadFile(store.path(key))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("%v: %v", store.path(key), err)
+	}
+	return state, nil
+}
+
+func (store *FileStateStore) lock(how int) (func(), error) {
+	file, err := os.OpenFile(filepath.Join(store.dir, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// ConsulStateStore keeps each key under a prefix of Consul's KV store,
+// conditional writes are transactions checking the ModifyIndex of the
+// checked key. CONSUL_HTTP_TOKEN is sent as the ACL token.
+type ConsulStateStore struct {
+	url    string
+	prefix string
+	token  string
+	client *http.Client
+}
+
+type consul_kv struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+func NewConsulStateStore(address, token string, client *http.Client) *ConsulStateStore {
+	parsed, _ := url.Parse(address)
+	prefix := strings.Trim(parsed.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &ConsulStateStore{url: parsed.Scheme + "://" + parsed.Host, prefix: prefix, token: token, client: client}
+}
+
+func (store *ConsulStateStore) Get(key string) ([]byte, uint64, error) {
+	resp, err := store.do("GET", "/v1/kv/"+store.prefix+key, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, consul_error(resp)
+	}
+	var entries []consul_kv
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	if len(entries) == 0 {
+		return nil, 0, nil
+	}
+	return entries[0].Value, entries[0].ModifyIndex, nil
+}
+
+func (store *ConsulStateStore) Put(key string, value []byte, check string, version uint64) (uint64, bool, error) {
+	condition := map[string]interface{}{"Verb": "check-index", "Key": store.prefix + check, "Index": version}
+	if version == 0 {
+		condition = map[string]interface{}{"Verb": "check-not-exists", "Key": store.prefix + check}
+	}
+	operations := []map[string]interface{}{
+		{"KV": condition},
+		{"KV": map[string]interface{}{"Verb": "set", "Key": store.prefix + key, "Value": base64.StdEncoding.EncodeToString(value)}},
+	}
+	body, err := json.Marshal(operations)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := store.do("PUT", "/v1/txn", body)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	// A failed check rolls the transaction back with a 409
+	if resp.StatusCode == http.StatusConflict {
+		io.Copy(ioutil.Discard, resp.Body)
+		return 0, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, false, consul_error(resp)
+	}
+	var result struct {
+		Results []struct{ KV consul_kv }
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, false, err
+	}
+	// The set comes last, after any result of the check
+	for i := len(result.Results) - 1; i >= 0; i-- {
+		if result.Results[i].KV.Key == store.prefix+key {
+			return result.Results[i].KV.ModifyIndex, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("Consul returned no result for %v", store.prefix+key)
+}
+
+func (store *ConsulStateStore) do(method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, store.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if store.token != "" {
+		req.Header.Set("X-Consul-Token", store.token)
+	}
+	return store.client.Do(req)
+}
+
+func consul_error(resp *http.Response) error {
+	response, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("Consul returned %d: %s", resp.StatusCode, bytes.TrimSpace(response))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// ResultSummary also pushes statistics computed across every series a query
+// returns, as <name>.min, <name>.max, <name>.avg and <name>.count gauges, e.g.
+//
+//	summary:
+//	  stats: [max, count]
+//	  only: true
+type ResultSummary struct {
+	// Stats are the statistics pushed, all four by default.
+	Stats []string `yaml:"stats"`
+	// Only pushes just the statistics, not the series themselves.
+	Only bool `yaml:"only"`
+}
+
+func (summary *ResultSummary) validate() error {
+	for _, stat := range summary.Stats {
+		switch stat {
+		case "min", "max", "avg", "count":
+		default:
+			return fmt.Errorf("unknown summary stat %v (expected min, max, avg or count)", stat)
+		}
+	}
+	return nil
+}
+
+// summarize computes the statistics of a query result. Only the count is
+// pushed for an empty result.
+func summarize(query Query, vector model.Vector, when time.Time) []Sample {
+	stats := query.Summary.Stats
+	if len(stats) == 0 {
+		stats = []string{"min", "max", "avg", "count"}
+	}
+
+	var min, max, sum float64
+	for i, sample := range vector {
+		value := float64(sample.Value)
+		if i == 0 {
+			min, max = value, value
+		}
+		min = math.Min(min, value)
+		max = math.Max(max, value)
+		sum += value
+	}
+
+	samples := make([]Sample, 0, len(stats))
+	for _, stat := range stats {
+		var value float64
+		switch stat {
+		case "count":
+			value = float64(len(vector))
+		case "min":
+			value = min
+		case "max":
+			value = max
+		case "avg":
+			value = sum / float64(len(vector))
+		}
+		if stat != "count" && len(vector) == 0 {
+			continue
+		}
+		samples = append(samples, Sample{Name: query.Name + "." + stat, Value: value, Timestamp: when})
+	}
+	return samples
+}
+
+// push_summary pushes a query's summary statistics as gauges, whatever the
+// query's own type.
+func push_summary(query Query, samples []Sample, sink Sink) error {
+	query.Type = Gauge
+	for _, sample := range samples {
+		stat_query := query
+		if strings.HasSuffix(sample.Name, ".count") {
+			// A number of series, not in the query's units
+			stat_query.MultiplyBy, stat_query.Add = nil, 0
+		}
+		if err := push_sample(stat_query, sample, sink); err != nil {
+			return err
+		}
+	}
+	return nil
+}
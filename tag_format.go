@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/micktwomey/prometheus_to_datadog/tagformat"
+)
+
+// format_tags_label is one line of format-tags input.
+type format_tags_label struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// run_format_tags reads one {"label": ..., "value": ...} JSON object per line
+// and prints the tag each becomes, one per line, e.g. to check the corpus in
+// tagformat/testdata. Labels are renamed with -map-label and normalized with
+// -normalize-label and -map-label-value as for queries.
+func run_format_tags(input io.Reader, output io.Writer) int {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var label format_tags_label
+		if err := json.Unmarshal(scanner.Bytes(), &label); err != nil {
+			fmt.Fprintf(os.Stderr, "Line %d: %v\n", line, err)
+			return 1
+		}
+		fmt.Fprintln(output, tagformat.Format(tag_key(Query{}, label.Label), normalize_label_value(label.Label, label.Value)))
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
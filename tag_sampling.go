@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// TagSampling bounds the custom metrics a query creates by keeping full tags
+// only for the series with the highest values and sending the rest as a
+// single aggregated, label-stripped value per metric name, e.g.
+//
+//	tag_sampling:
+//	  keep: 10
+//	  aggregate: sum
+//	  tag: series:other
+type TagSampling struct {
+	// Keep is the number of series which keep their tags.
+	Keep int `yaml:"keep"`
+	// Aggregate is how the remaining series are combined: sum (default),
+	// avg, min or max.
+	Aggregate string `yaml:"aggregate"`
+	// Tag is added to the aggregated values, so they can be told apart
+	// from a query which returned no labels.
+	Tag string `yaml:"tag"`
+}
+
+func valid_tag_sampling_aggregate(aggregate string) bool {
+	switch aggregate {
+	case "", "sum", "avg", "min", "max":
+		return true
+	}
+	return false
+}
+
+func (sampling *TagSampling) aggregate(values []float64) float64 {
+	result := values[0]
+	switch sampling.Aggregate {
+	case "min":
+		for _, value := range values[1:] {
+			result = math.Min(result, value)
+		}
+	case "max":
+		for _, value := range values[1:] {
+			result = math.Max(result, value)
+		}
+	default:
+		for _, value := range values[1:] {
+			result += value
+		}
+		if sampling.Aggregate == "avg" {
+			result /= float64(len(values))
+		}
+	}
+	return result
+}
+
+// sample_tags splits a query result into the series which keep their tags
+// and aggregated samples for the rest.
+func sample_tags(query Query, vector model.Vector, when time.Time) (model.Vector, []Sample, error) {
+	sampling := query.TagSampling
+	if sampling == nil || len(vector) <= sampling.Keep {
+		return vector, nil, nil
+	}
+
+	sorted := append(model.Vector{}, vector...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value > sorted[j].Value })
+
+	groups := map[string][]float64{}
+	var names []string
+	for _, sample := range sorted[sampling.Keep:] {
+		name, _, keep, err := series_name_and_tags(query, sample.Metric)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !keep {
+			continue
+		}
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], float64(sample.Value))
+	}
+
+	var tags []string
+	if sampling.Tag != "" {
+		tags = []string{sampling.Tag}
+	}
+	aggregated := make([]Sample, 0, len(names))
+	for _, name := range names {
+		aggregated = append(aggregated, Sample{Name: name, Value: sampling.aggregate(groups[name]), Tags: tags, Timestamp: when})
+	}
+	tagSampledSeries.WithLabelValues(query.Name).Add(float64(len(sorted) - sampling.Keep))
+	return sorted[:sampling.Keep], aggregated, nil
+}
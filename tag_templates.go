@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/micktwomey/prometheus_to_datadog/tagformat"
+	"github.com/prometheus/common/model"
+)
+
+// Tag templates compute extra tags per sample from its labels and value,
+// e.g.
+//
+//	tags:
+//	  - "shard:{{.labels.region}}-{{.labels.az}}"
+//	  - "slow:{{gt .value 1.0}}"
+//
+// Missing labels render as empty strings and tags which render empty are
+// left out.
+var tag_templates = struct {
+	sync.Mutex
+	parsed map[string]*template.Template
+}{parsed: map[string]*template.Template{}}
+
+// parse_tag_template parses a tag template, caching the result.
+func parse_tag_template(text string) (*template.Template, error) {
+	tag_templates.Lock()
+	defer tag_templates.Unlock()
+	if parsed, ok := tag_templates.parsed[text]; ok {
+		return parsed, nil
+	}
+	parsed, err := template.New("tag").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	tag_templates.parsed[text] = parsed
+	return parsed, nil
+}
+
+// render_tags renders a query's tag templates for a sample, followed by its
+// value tags. Static tags (e.g. team:payments) are added as they are. Both
+// go through tagformat.Sanitize like the tags from labels.
+func render_tags(query Query, metric model.Metric, value float64) ([]string, error) {
+	if len(query.Tags) == 0 {
+		return value_tags(query, value), nil
+	}
+	if !has_tag_templates(query) {
+		tags := make([]string, 0, len(query.Tags))
+		for _, tag := range query.Tags {
+			tags = append(tags, tagformat.Sanitize(tag))
+		}
+		return append(tags, value_tags(query, value)...), nil
+	}
+	labels := make(map[string]string, len(metric))
+	for label, val := range metric {
+		labels[string(label)] = string(val)
+	}
+	data := map[string]interface{}{"labels": labels, "value": value}
+
+	rendered := render_scratch.Get().(*bytes.Buffer)
+	defer render_scratch.Put(rendered)
+	tags := make([]string, 0, len(query.Tags))
+	for _, text := range query.Tags {
+		if !strings.Contains(text, "{{") {
+			tags = append(tags, tagformat.Sanitize(text))
+			continue
+		}
+		parsed, err := parse_tag_template(text)
+		if err != nil {
+			return nil, err
+		}
+		rendered.Reset()
+		if err := parsed.Execute(rendered, data); err != nil {
+			return nil, err
+		}
+		if rendered.Len() > 0 {
+			tags = append(tags, tagformat.Sanitize(rendered.String()))
+		}
+	}
+	return append(tags, value_tags(query, value)...), nil
+}
+
+// has_tag_templates is whether any of a query's tags is a template rather
+// than a static tag.
+func has_tag_templates(query Query) bool {
+	for _, text := range query.Tags {
+		if strings.Contains(text, "{{") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+// Package tagformat turns Prometheus labels into Datadog tags the way
+// prometheus_to_datadog sends them, for tools which need to predict or match
+// its tags.
+//
+// The cases it covers are listed in testdata/labels.jsonl with the tags they
+// become in testdata/tags.golden, which go test checks (go test -update
+// rewrites it after a deliberate change). The same check against a binary:
+//
+//	prometheus_to_datadog format-tags < tagformat/testdata/labels.jsonl | diff - tagformat/testdata/tags.golden
+package tagformat
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxLength is the longest tag Datadog keeps, in characters.
+const MaxLength = 200
+
+// reserved are the characters which would split a tag or a dogstatsd
+// datagram: tags are comma separated, fields | separated and datagrams
+// newline separated.
+const reserved = ",|\n\r"
+
+// Format returns the tag for a label and (already normalized) value,
+// label:value. Reserved characters become underscores, invalid UTF-8 becomes
+// U+FFFD and tags longer than MaxLength are cut at a character boundary
+// rather than mid UTF-8 sequence. An empty value is kept as label:.
+func Format(label string, value string) string {
+	return Sanitize(label + ":" + value)
+}
+
+// Sanitize applies the same rules to a whole tag, e.g. a static tag or one
+// rendered from a template, which may not have a value.
+func Sanitize(tag string) string {
+	if strings.ContainsAny(tag, reserved) {
+		tag = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(reserved, r) {
+				return '_'
+			}
+			return r
+		}, tag)
+	}
+	if !utf8.ValidString(tag) {
+		tag = strings.ToValidUTF8(tag, string(utf8.RuneError))
+	}
+	if utf8.RuneCountInString(tag) > MaxLength {
+		runes := 0
+		for i := range tag {
+			if runes == MaxLength {
+				tag = tag[:i]
+				break
+			}
+			runes++
+		}
+	}
+	return tag
+}
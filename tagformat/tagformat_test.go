@@ -0,0 +1,73 @@
+package tagformat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Rewrite testdata/tags.golden from the current Format.")
+
+const golden_path = "testdata/tags.golden"
+
+// TestFormatGolden formats every label in testdata/labels.jsonl and compares
+// the tags with testdata/tags.golden, line by line. Run with -update after
+// changing the rules on purpose.
+func TestFormatGolden(t *testing.T) {
+	labels, err := os.Open("testdata/labels.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer labels.Close()
+
+	var formatted bytes.Buffer
+	var inputs []string
+	scanner := bufio.NewScanner(labels)
+	for line := 1; scanner.Scan(); line++ {
+		var label struct {
+			Label string `json:"label"`
+			Value string `json:"value"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &label); err != nil {
+			t.Fatalf("testdata/labels.jsonl line %d: %v", line, err)
+		}
+		inputs = append(inputs, scanner.Text())
+		formatted.WriteString(Format(label.Label, label.Value) + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		if err := ioutil.WriteFile(golden_path, formatted.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(golden_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got_lines := bytes.Split(formatted.Bytes(), []byte("\n"))
+	expected_lines := bytes.Split(expected, []byte("\n"))
+	if len(got_lines) != len(expected_lines) {
+		t.Fatalf("%d tags, %v has %d (run with -update to rewrite it)", len(got_lines)-1, golden_path, len(expected_lines)-1)
+	}
+	for i := range inputs {
+		if !bytes.Equal(got_lines[i], expected_lines[i]) {
+			t.Errorf("line %d %v: got %q, expected %q", i+1, inputs[i], got_lines[i], expected_lines[i])
+		}
+	}
+}
+
+func TestSanitizeKeepsValidTags(t *testing.T) {
+	for _, tag := range []string{"team:payments", "canary", "shard:eu-1", ""} {
+		if got := Sanitize(tag); got != tag {
+			t.Errorf("Sanitize(%q) = %q, expected it unchanged", tag, got)
+		}
+	}
+}
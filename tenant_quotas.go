@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// TenantQuota limits what the queries of one tenant can push. Zero means
+// unlimited.
+type TenantQuota struct {
+	// MaxSamples is the number of samples pushed per cycle.
+	MaxSamples int
+	// MaxNames is the number of distinct metric names ever pushed.
+	MaxNames int
+}
+
+// TenantQuotas maps a tenant (or "*" for any tenant without its own quota) to
+// its quota.
+type TenantQuotas map[string]TenantQuota
+
+func (flags TenantQuotas) String() string {
+	return "TenantQuotas"
+}
+
+func (flags TenantQuotas) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Tenant quota must be in the form tenant:max_samples=N,max_names=N (%v)", value)
+	}
+	quota := flags[parts[0]]
+	for _, setting := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Tenant quota must be in the form tenant:max_samples=N,max_names=N (%v)", value)
+		}
+		limit, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return fmt.Errorf("Invalid tenant quota %v (%v)", setting, value)
+		}
+		switch kv[0] {
+		case "max_samples":
+			quota.MaxSamples = limit
+		case "max_names":
+			quota.MaxNames = limit
+		default:
+			return fmt.Errorf("Unknown tenant quota %v (%v)", kv[0], value)
+		}
+	}
+	flags[parts[0]] = quota
+	return nil
+}
+
+type tenant_usage struct {
+	samples  int
+	names    map[string]bool
+	notified map[string]bool
+}
+
+// QuotaTracker enforces TenantQuotas across query cycles.
+type QuotaTracker struct {
+	sync.Mutex
+	quotas TenantQuotas
+	usage  map[string]*tenant_usage
+}
+
+func NewQuotaTracker(quotas TenantQuotas) *QuotaTracker {
+	return &QuotaTracker{quotas: quotas, usage: map[string]*tenant_usage{}}
+}
+
+// StartCycle resets the per cycle sample counts.
+func (tracker *QuotaTracker) StartCycle() {
+	tracker.Lock()
+	defer tracker.Unlock()
+	for _, usage := range tracker.usage {
+		usage.samples = 0
+		usage.notified = map[string]bool{}
+	}
+}
+
+// Allow records a sample for a tenant, returning the name of the exceeded
+// quota if it must be dropped. notify is true the first time a quota is
+// exceeded in a cycle.
+func (tracker *QuotaTracker) Allow(tenant string, name string) (exceeded string, notify bool) {
+	tenant = tenant_name(tenant)
+	quota, ok := tracker.quotas[tenant]
+	if !ok {
+		if quota, ok = tracker.quotas["*"]; !ok {
+			return "", false
+		}
+	}
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	usage, ok := tracker.usage[tenant]
+	if !ok {
+		usage = &tenant_usage{names: map[string]bool{}, notified: map[string]bool{}}
+		tracker.usage[tenant] = usage
+	}
+
+	switch {
+	case quota.MaxSamples > 0 && usage.samples >= quota.MaxSamples:
+		exceeded = "max_samples"
+	case quota.MaxNames > 0 && !usage.names[name] && len(usage.names) >= quota.MaxNames:
+		exceeded = "max_names"
+	default:
+		usage.samples++
+		usage.names[name] = true
+		return "", false
+	}
+
+	tenantQuotaExceeded.WithLabelValues(tenant, exceeded).Inc()
+	notify = !usage.notified[exceeded]
+	usage.notified[exceeded] = true
+	return exceeded, notify
+}
+
+// tenant_name is the tenant of queries, those without one are in the
+// default tenant.
+func tenant_name(tenant string) string {
+	if tenant == "" {
+		return "default"
+	}
+	return tenant
+}
+
+func quota_exceeded_event(tenant string, quota string) *statsd.Event {
+	tenant = tenant_name(tenant)
+	event := statsd.NewEvent(
+		fmt.Sprintf("prometheus_to_datadog: tenant %v exceeded its %v quota", tenant, quota),
+		fmt.Sprintf("Samples from tenant %v over its %v quota are being dropped.", tenant, quota),
+	)
+	event.AlertType = statsd.Warning
+	event.Tags = []string{"tenant:" + tenant, "quota:" + quota}
+	return event
+}
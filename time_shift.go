@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/api/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+// time_shifts are the offsets a query can also be evaluated at, by the
+// suffix its results are pushed under: dod (day over day) and wow (week over
+// week), e.g.
+//
+//	time_shifts: [dod, wow]
+var time_shifts = map[string]time.Duration{
+	"dod": 24 * time.Hour,
+	"wow": 7 * 24 * time.Hour,
+}
+
+func validate_time_shifts(shifts []string) error {
+	for _, shift := range shifts {
+		if _, ok := time_shifts[shift]; !ok {
+			return fmt.Errorf("unknown time shift %v (expected dod or wow)", shift)
+		}
+	}
+	return nil
+}
+
+// push_time_shifts evaluates the query at each of its time shifts and pushes
+// the results as <name>.<shift> (e.g. http.requests.wow), timestamped now so
+// they line up with the current values in Datadog. A failed shift is logged
+// and doesn't fail the query.
+func push_time_shifts(ctx context.Context, query Query, query_api prometheus.QueryAPI, when time.Time, sink Sink) error {
+	for _, shift := range query.TimeShifts {
+		then := when.Add(-time_shifts[shift])
+		var vector model.Vector
+		var err error
+		if len(query.Regions) > 0 {
+			vector, err = query_regions(ctx, query, then)
+		} else {
+			var results model.Value
+			if results, err = query_api.Query(ctx, query.Query, then); err == nil {
+				if vector, err = instant_vector(results); err == nil && *use_external_labels {
+					vector = add_external_labels(vector, *prometheus_addr)
+				}
+			}
+		}
+		if err != nil {
+			class := count_failed_query(query, query_error_class(err), fmt.Errorf("%v: %v", shift, err))
+			log_throttle.Printf(query.Name+"/"+shift+"/"+class, "Query %v failed at its %v time shift (%v): %v", query.Name, shift, class, err)
+			continue
+		}
+
+		for _, sample := range vector {
+			name, tags, keep, err := series_name_and_tags(query, sample.Metric)
+			if err != nil {
+				return err
+			}
+			if !keep {
+				continue
+			}
+			computed, err := render_tags(query, sample.Metric, float64(sample.Value))
+			if err != nil {
+				return fmt.Errorf("Can't render tags for %v: %v", query.Name, err)
+			}
+			shifted := Sample{Name: name + "." + shift, Value: float64(sample.Value), Tags: append(tags, computed...), Timestamp: when}
+			if err := push_sample(query, shifted, sink); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TimingConfig sends a milliseconds query as a histogram or distribution
+// instead of a dogstatsd timing, e.g.
+//
+//	timing:
+//	  as: distribution
+//	  aggregates: [max, median, avg, p95]
+type TimingConfig struct {
+	// As is milliseconds (the default), histogram or distribution.
+	As string `yaml:"as"`
+	// Aggregates are the aggregates users of the metric expect: max, min,
+	// median, avg, sum, count or a percentile such as p95. They aren't
+	// chosen by the bridge but by the agent's configuration (timings and
+	// histograms) or the metric's settings in Datadog (distributions), see
+	// timing_requirements.
+	Aggregates []string `yaml:"aggregates"`
+}
+
+func (timing *TimingConfig) validate() error {
+	switch timing.As {
+	case "", "milliseconds", "histogram", "distribution":
+	default:
+		return fmt.Errorf("unknown timing as %v (expected milliseconds, histogram or distribution)", timing.As)
+	}
+	for _, aggregate := range timing.Aggregates {
+		switch aggregate {
+		case "max", "min", "median", "avg", "sum", "count":
+		default:
+			if _, ok := timing_percentile(aggregate); !ok {
+				return fmt.Errorf("unknown timing aggregate %v (expected max, min, median, avg, sum, count or a percentile such as p95)", aggregate)
+			}
+		}
+	}
+	return nil
+}
+
+// query_type is the type samples of the query are sent as.
+func (timing *TimingConfig) query_type() QueryType {
+	switch timing.As {
+	case "histogram":
+		return Histogram
+	case "distribution":
+		return Distribution
+	}
+	return Milliseconds
+}
+
+// timing_percentile parses a percentile aggregate, e.g. p95 is 95.
+func timing_percentile(aggregate string) (int, bool) {
+	if !strings.HasPrefix(aggregate, "p") {
+		return 0, false
+	}
+	percentile, err := strconv.Atoi(aggregate[1:])
+	if err != nil || percentile <= 0 || percentile >= 100 {
+		return 0, false
+	}
+	return percentile, true
+}
+
+// timing_requirements describes the Datadog settings needed for the timing
+// aggregates the queries expect. The agent computes the same aggregates
+// (histogram_aggregates and histogram_percentiles in datadog.yaml) for every
+// timing and histogram, distributions only have percentiles once they're
+// enabled on the metric in Datadog.
+func timing_requirements(queries Queries) []string {
+	agent_aggregates := map[string]bool{}
+	agent_percentiles := map[int]bool{}
+	var requirements []string
+	for _, query := range queries {
+		if query.Type != Milliseconds || query.Timing == nil {
+			continue
+		}
+		var distribution_percentiles []string
+		for _, aggregate := range query.Timing.Aggregates {
+			percentile, is_percentile := timing_percentile(aggregate)
+			switch {
+			case query.Timing.query_type() == Distribution:
+				if is_percentile {
+					distribution_percentiles = append(distribution_percentiles, aggregate)
+				}
+			case is_percentile:
+				agent_percentiles[percentile] = true
+			default:
+				agent_aggregates[aggregate] = true
+			}
+		}
+		if len(distribution_percentiles) > 0 {
+			requirements = append(requirements, fmt.Sprintf("%v: enable percentiles on the distribution in Datadog for %v", query.Name, strings.Join(distribution_percentiles, ", ")))
+		}
+	}
+
+	if len(agent_aggregates) > 0 {
+		var aggregates []string
+		for aggregate := range agent_aggregates {
+			aggregates = append(aggregates, aggregate)
+		}
+		sort.Strings(aggregates)
+		requirements = append(requirements, fmt.Sprintf("agent: histogram_aggregates must include %v", strings.Join(aggregates, ", ")))
+	}
+	if len(agent_percentiles) > 0 {
+		var percentiles []int
+		for percentile := range agent_percentiles {
+			percentiles = append(percentiles, percentile)
+		}
+		sort.Ints(percentiles)
+		quantiles := make([]string, len(percentiles))
+		for i, percentile := range percentiles {
+			quantiles[i] = fmt.Sprintf("\"0.%02d\"", percentile)
+		}
+		requirements = append(requirements, fmt.Sprintf("agent: histogram_percentiles must include %v", strings.Join(quantiles, ", ")))
+	}
+	return requirements
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSFiles are the files used to build a TLS client configuration.
+type TLSFiles struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// client_tls_config returns nil when no TLS options are set, so the default
+// transport configuration is used.
+func client_tls_config(files TLSFiles) (*tls.Config, error) {
+	if files == (TLSFiles{}) {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: files.InsecureSkipVerify}
+	if files.CAFile != "" {
+		root_cas, err := load_cert_pool(files.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = root_cas
+	}
+	if files.CertFile != "" || files.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// load_cert_pool reads the PEM certificates in a file.
+func load_cert_pool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %v", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// validate_config checks the flags and every configured query without
+// contacting Prometheus or Datadog, returning all the problems found rather
+// than stopping at the first. -discover isn't run.
+func validate_config() []string {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch *sink_type {
+	case "dogstatsd":
+	case "api":
+		if *api_key == "" {
+			add("the api sink needs -datadog-api-key")
+		}
+	default:
+		add("unknown sink %v (expected dogstatsd or api)", *sink_type)
+	}
+	for _, route := range sink_routes {
+		if kind := strings.SplitN(route.Destination, ":", 2); kind[0] == "api" && os.Getenv(kind[1]) == "" {
+			add("route %v: %v isn't set", route, kind[1])
+		}
+	}
+	if *api_compression != "none" && *api_compression != "gzip" {
+		add("unknown api compression %v (expected none or gzip)", *api_compression)
+	}
+	if *ha_state_store != "" {
+		if parsed, err := url.Parse(*ha_state_store); err != nil || (parsed.Scheme != "file" && parsed.Scheme != "http" && parsed.Scheme != "https") {
+			add("unknown -ha-state-store %v (expected file:///dir or http(s)://consul:8500/prefix)", *ha_state_store)
+		}
+		if *ha_lease_duration <= 0 {
+			add("-ha-lease must be positive")
+		}
+	}
+	if *remote_write || *pushgateway {
+		if _, err := parse_rollup(*remote_write_rollup); err != nil {
+			add("%v", err)
+		}
+		if *remote_write_bucket <= 0 || *remote_write_delay < 0 {
+			add("-remote-write-bucket must be positive and -remote-write-delay can't be negative")
+		}
+	}
+	if interval <= 0 {
+		add("-interval must be positive")
+	}
+	if auth, err := NewHTTPAuth(*http_auth_token, *http_basic_auth, *http_tls_client_ca, *admin_insecure); err != nil {
+		add("%v", err)
+	} else if (*remote_write || *pushgateway) && !auth.enabled() && !auth.Insecure {
+		add("-remote-write and -pushgateway need -http-auth-token, -http-basic-auth or -http-tls-client-ca-file, or -admin-insecure")
+	}
+	if _, err := server_tls_config(TLSServerFiles{CertFile: *http_tls_cert_file, KeyFile: *http_tls_key_file, ClientCAFile: *http_tls_client_ca}); err != nil {
+		add("HTTPS: %v", err)
+	}
+	if *record_fixtures != "" && *replay_fixtures != "" {
+		add("-record-fixtures and -replay-fixtures can't be used together")
+	}
+
+	loaded := append(Queries{}, queries...)
+	if *query_file != "" {
+		paths, err := query_file_paths(*query_file)
+		if err != nil {
+			add("%v", err)
+		}
+		files := map[string]string{}
+		for _, path := range paths {
+			file_queries, file_problems := decode_query_file(path)
+			if err := check_duplicate_names(files, path, file_queries); err != nil {
+				add("%v", err)
+			}
+			loaded = append(loaded, file_queries...)
+			problems = append(problems, file_problems...)
+		}
+	} else if *config_path != "" {
+		config_queries, config_problems := load_config_queries(*config_path)
+		loaded = append(loaded, config_queries...)
+		problems = append(problems, config_problems...)
+	}
+	if *openmetrics_file != "" {
+		openmetrics_queries, err := load_openmetrics_file(*openmetrics_file)
+		if err != nil {
+			add("%v", err)
+		}
+		loaded = append(loaded, openmetrics_queries...)
+	}
+	for _, query := range loaded {
+		if err := validate_query_names(Queries{query}); err != nil {
+			add("%v", err)
+		}
+		if expanded, err := expand_query_vars(Queries{query}, query_vars); err != nil {
+			add("%v", err)
+		} else if err := check_query_lengths(expanded); err != nil {
+			add("%v", err)
+		}
+	}
+	if _, err := filter_queries(loaded, only_queries, skip_queries); err != nil {
+		add("%v", err)
+	}
+	return problems
+}
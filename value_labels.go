@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/prometheus/common/model"
+)
+
+// ValueLabels splits a single query result into several Datadog metrics,
+// picking the metric name from the value of one label, e.g.
+//
+//	value_labels:
+//	  label: quantile
+//	  names:
+//	    "0.5": http.latency.median
+//	    "0.99": http.latency.p99
+//
+// The label is not sent as a tag and samples with an unmapped value are
+// dropped.
+type ValueLabels struct {
+	Label string            `yaml:"label"`
+	Names map[string]string `yaml:"names"`
+}
+
+// metric_name returns the Datadog metric name for the sample, and false if the
+// label value isn't mapped.
+func (value_labels *ValueLabels) metric_name(metric model.Metric) (string, bool) {
+	name, ok := value_labels.Names[string(metric[model.LabelName(value_labels.Label)])]
+	return name, ok
+}
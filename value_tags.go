@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/micktwomey/prometheus_to_datadog/tagformat"
+)
+
+// ValueTag tags each sample with the band its value falls in, e.g.
+//
+//	value_tags:
+//	  - tag: latency_band
+//	    bands:
+//	      - {below: 0.1, value: fast}
+//	      - {below: 1, value: slow}
+//	      - {value: very_slow}
+type ValueTag struct {
+	Tag   string      `yaml:"tag"`
+	Bands []ValueBand `yaml:"bands"`
+}
+
+// ValueBand is one band of a ValueTag, covering values from the previous
+// band's bound up to (but not including) Below. Only the last band can leave
+// Below out, covering every value above the others.
+type ValueBand struct {
+	Below *float64 `yaml:"below"`
+	Value string   `yaml:"value"`
+}
+
+func (value_tag ValueTag) validate() error {
+	if value_tag.Tag == "" || len(value_tag.Bands) == 0 {
+		return fmt.Errorf("value_tags need a tag and bands")
+	}
+	for i, band := range value_tag.Bands {
+		if band.Value == "" {
+			return fmt.Errorf("value_tags %v: every band needs a value", value_tag.Tag)
+		}
+		if band.Below == nil {
+			if i != len(value_tag.Bands)-1 {
+				return fmt.Errorf("value_tags %v: only the last band can leave out below", value_tag.Tag)
+			}
+			continue
+		}
+		if i > 0 && *band.Below <= *value_tag.Bands[i-1].Below {
+			return fmt.Errorf("value_tags %v: below must increase from band to band", value_tag.Tag)
+		}
+	}
+	return nil
+}
+
+// band returns the band value falls in, false if it's above every bound and
+// there's no last band without one, or NaN.
+func (value_tag ValueTag) band(value float64) (string, bool) {
+	if math.IsNaN(value) {
+		return "", false
+	}
+	for _, band := range value_tag.Bands {
+		if band.Below == nil || value < *band.Below {
+			return band.Value, true
+		}
+	}
+	return "", false
+}
+
+// value_tags returns the value tags of a query for a sample's value.
+func value_tags(query Query, value float64) []string {
+	var tags []string
+	for _, value_tag := range query.ValueTags {
+		if band, ok := value_tag.band(value); ok {
+			tags = append(tags, tagformat.Format(value_tag.Tag, band))
+		}
+	}
+	return tags
+}
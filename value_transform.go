@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// transform_value applies a query's multiply_by and then add to a value, e.g.
+// to publish seconds as milliseconds or bytes as megabytes without rewriting
+// the PromQL.
+func transform_value(query Query, value float64) float64 {
+	if query.MultiplyBy != nil {
+		value *= *query.MultiplyBy
+	}
+	return value + query.Add
+}
+
+// non_finite returns nan or inf for values which can't be pushed, "" for
+// finite ones.
+func non_finite(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "nan"
+	case math.IsInf(value, 0):
+		return "inf"
+	}
+	return ""
+}
+
+func validate_value_transform(query Query) error {
+	if query.MultiplyBy != nil && (*query.MultiplyBy == 0 || math.IsNaN(*query.MultiplyBy) || math.IsInf(*query.MultiplyBy, 0)) {
+		return fmt.Errorf("multiply_by must be a non-zero number")
+	}
+	if math.IsNaN(query.Add) || math.IsInf(query.Add, 0) {
+		return fmt.Errorf("add must be a number")
+	}
+	return nil
+}
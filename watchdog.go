@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ScheduleWatchdog notices queries which stopped running, e.g. because the
+// scheduler is wedged or a reload went wrong.
+type ScheduleWatchdog struct {
+	sync.Mutex
+	started  time.Time
+	last_run map[string]time.Time
+}
+
+func NewScheduleWatchdog(now time.Time) *ScheduleWatchdog {
+	return &ScheduleWatchdog{started: now, last_run: map[string]time.Time{}}
+}
+
+// Ran records that a query was run.
+func (watchdog *ScheduleWatchdog) Ran(name string, now time.Time) {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	watchdog.last_run[name] = now
+}
+
+// Overdue returns the queries which haven't run for more than twice their
+// interval. Queries which never ran are measured from when the watchdog
+// started.
+func (watchdog *ScheduleWatchdog) Overdue(query_set *QuerySet, interval time.Duration, now time.Time) []string {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	var overdue []string
+	known := map[string]bool{}
+	for _, query := range query_set.Queries() {
+		known[query.Name] = true
+		if query_set.Muted(query.Name, now) {
+			continue
+		}
+		last, ok := watchdog.last_run[query.Name]
+		if !ok {
+			last = watchdog.started
+		}
+		if now.Sub(last) > 2*query_interval(query, interval) {
+			overdue = append(overdue, query.Name)
+		}
+	}
+	// Forget queries removed by a reload
+	for name := range watchdog.last_run {
+		if !known[name] {
+			delete(watchdog.last_run, name)
+		}
+	}
+	return overdue
+}
+
+func start_watchdog(watchdog *ScheduleWatchdog, query_set *QuerySet, adaptive *AdaptiveInterval) {
+	go_background("watchdog", func() {
+		ticker := time.NewTicker(adaptive.base)
+		defer ticker.Stop()
+		for {
+			var now time.Time
+			select {
+			case <-stopping:
+				return
+			case now = <-ticker.C:
+			}
+			// Measured against the stretched interval, slowing down on
+			// purpose isn't a missed run
+			interval := adaptive.Current()
+			for _, name := range watchdog.Overdue(query_set, interval, now) {
+				missedRuns.WithLabelValues(name).Inc()
+				log.Printf("WATCHDOG: query %v hasn't run for more than %v, the scheduler may be stuck", name, 2*interval)
+			}
+		}
+	})
+}
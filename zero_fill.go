@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SeriesSet is the set of series (metric name plus tags) a query produced in
+// one run, keyed by series_key.
+type SeriesSet map[string]TrackedSeries
+
+type TrackedSeries struct {
+	Name string
+	Tags []string
+}
+
+func series_key(name string, tags []string) string {
+	scratch := tag_scratch.Get().(*[]string)
+	defer tag_scratch.Put(scratch)
+	sorted := append((*scratch)[:0], tags...)
+	*scratch = sorted
+	sort.Strings(sorted)
+
+	size := len(name) + len("|") + len(sorted)
+	for _, tag := range sorted {
+		size += len(tag)
+	}
+	var key strings.Builder
+	key.Grow(size)
+	key.WriteString(name)
+	key.WriteString("|")
+	for i, tag := range sorted {
+		if i > 0 {
+			key.WriteString(",")
+		}
+		key.WriteString(tag)
+	}
+	return key.String()
+}
+
+func (series SeriesSet) Add(name string, tags []string) {
+	series[series_key(name, tags)] = TrackedSeries{Name: name, Tags: tags}
+}
+
+var last_seen_series = struct {
+	sync.Mutex
+	by_query map[string]SeriesSet
+}{by_query: map[string]SeriesSet{}}
+
+// disappeared_series records the current series for a query and returns the
+// ones which were present in the previous run but are now gone.
+func disappeared_series(query_name string, current SeriesSet) []TrackedSeries {
+	last_seen_series.Lock()
+	defer last_seen_series.Unlock()
+
+	var gone []TrackedSeries
+	for key, series := range last_seen_series.by_query[query_name] {
+		if _, ok := current[key]; !ok {
+			gone = append(gone, series)
+		}
+	}
+	last_seen_series.by_query[query_name] = current
+	return gone
+}
+
+// zero_fill_series pushes a final zero for every series which disappeared
+// since the last run, so Datadog monitors don't keep evaluating the last known
+// value.
+func zero_fill_series(query Query, current SeriesSet, when time.Time, sink Sink) error {
+	for _, series := range disappeared_series(query.Name, current) {
+		tags := series.Tags
+		if query.ZeroFillTag != "" {
+			tags = append(append([]string{}, tags...), query.ZeroFillTag)
+		}
+		if err := push_sample(query, Sample{Name: series.Name, Value: 0, Tags: tags, Timestamp: when}, sink); err != nil {
+			return err
+		}
+		zeroFilledSeries.WithLabelValues(query.Name).Inc()
+	}
+	return nil
+}